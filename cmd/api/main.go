@@ -7,6 +7,7 @@ import (
 	"os"
 
 	"dreampicai/internal/handler"
+	"dreampicai/pkg/mail"
 	"dreampicai/pkg/sb"
 
 	"github.com/joho/godotenv"
@@ -18,11 +19,17 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if err := sb.Init(); err != nil {
+	auth, err := sb.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer, err := mail.New()
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	server := handler.NewServer()
+	server := handler.NewServer(auth, mailer)
 
 	slog.Info("application running", "port", os.Getenv("PORT"))
 	err = server.ListenAndServe()
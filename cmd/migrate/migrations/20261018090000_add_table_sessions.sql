@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists sessions(
+    id text primary key,
+    user_id uuid references auth.users on delete cascade,
+    data bytea not null,
+    user_agent text not null default '',
+    ip text not null default '',
+    created_at timestamp not null default now(),
+    last_seen_at timestamp not null default now(),
+    expires_at timestamp not null
+);
+create index if not exists sessions_user_id_idx on sessions(user_id);
+create index if not exists sessions_expires_at_idx on sessions(expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists sessions;
+-- +goose StatementEnd
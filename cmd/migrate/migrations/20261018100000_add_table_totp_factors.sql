@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists totp_factors(
+    user_id uuid primary key references auth.users on delete cascade,
+    secret text not null,
+    last_used_step bigint not null default 0,
+    confirmed_at timestamp,
+    created_at timestamp not null default now()
+);
+create table if not exists recovery_codes(
+    id serial primary key,
+    user_id uuid not null references auth.users on delete cascade,
+    code_hash text not null,
+    used_at timestamp,
+    created_at timestamp not null default now()
+);
+create index if not exists recovery_codes_user_id_idx on recovery_codes(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists recovery_codes;
+drop table if exists totp_factors;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists passkeys(
+    id serial primary key,
+    account_id integer not null references accounts on delete cascade,
+    name text not null,
+    credential_id bytea not null unique,
+    public_key bytea not null,
+    attestation_type text not null default '',
+    aaguid bytea,
+    transports text[] not null default '{}',
+    sign_count bigint not null default 0,
+    clone_warning boolean not null default false,
+    backup_eligible boolean not null default false,
+    backup_state boolean not null default false,
+    created_at timestamp not null default now(),
+    last_used_at timestamp
+);
+create index if not exists passkeys_account_id_idx on passkeys(account_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists passkeys;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists login_attempts(
+    key text primary key,
+    failures int not null default 0,
+    last_failed_at timestamp not null default now(),
+    locked_until timestamp
+);
+create table if not exists lockouts(
+    id serial primary key,
+    key text not null,
+    ip text not null default '',
+    email text not null default '',
+    failures int not null,
+    locked_until timestamp not null,
+    created_at timestamp not null default now()
+);
+create index if not exists lockouts_created_at_idx on lockouts(created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists lockouts;
+drop table if exists login_attempts;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists account_deletions(
+    id serial primary key,
+    user_id uuid not null,
+    username text not null default '',
+    requested_at timestamp not null default now(),
+    delete_after timestamp not null,
+    cancelled_at timestamp,
+    deleted_at timestamp
+);
+create index if not exists account_deletions_user_id_idx on account_deletions(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists account_deletions;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists data_exports(
+    id serial primary key,
+    user_id uuid not null references auth.users on delete cascade,
+    token text not null unique,
+    status text not null,
+    archive bytea,
+    created_at timestamp not null default now(),
+    ready_at timestamp,
+    expires_at timestamp not null
+);
+create index if not exists data_exports_user_id_idx on data_exports(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists data_exports;
+-- +goose StatementEnd
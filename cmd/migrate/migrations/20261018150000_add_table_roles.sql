@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists roles(
+    name text primary key,
+    description text not null default '',
+    permissions text[] not null default '{}',
+    built_in boolean not null default false,
+    created_at timestamp not null default now()
+);
+insert into roles(name, description, permissions, built_in) values
+    ('user', 'Every account', '{}', true),
+    ('moderator', 'Reviews content', '{content:moderate,users:read}', true),
+    ('admin', 'Full access', '{admin:access,users:read,users:manage,roles:manage,content:moderate}', true)
+on conflict (name) do nothing;
+alter table accounts add column if not exists role text not null default 'user' references roles(name) on update cascade;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table accounts drop column if exists role;
+drop table if exists roles;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table accounts add column if not exists disabled_at timestamp;
+create index if not exists accounts_username_idx on accounts(lower(username));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index if exists accounts_username_idx;
+alter table accounts drop column if exists disabled_at;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists audit_events(
+    id bigserial primary key,
+    action text not null,
+    actor_id uuid,
+    user_id uuid,
+    ip text not null default '',
+    user_agent text not null default '',
+    trace_id text not null default '',
+    metadata jsonb,
+    created_at timestamp not null default now()
+);
+create index if not exists audit_events_user_id_idx on audit_events(user_id, created_at);
+create index if not exists audit_events_created_at_idx on audit_events(created_at);
+update roles set permissions = array_append(permissions, 'users:impersonate')
+    where name = 'admin' and not 'users:impersonate' = any(permissions);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+update roles set permissions = array_remove(permissions, 'users:impersonate') where name = 'admin';
+drop table if exists audit_events;
+-- +goose StatementEnd
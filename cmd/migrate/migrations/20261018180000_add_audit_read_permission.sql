@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+update roles set permissions = array_append(permissions, 'audit:read')
+    where name = 'admin' and not 'audit:read' = any(permissions);
+create index if not exists audit_events_email_idx on audit_events((metadata->>'email')) where user_id is null;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index if exists audit_events_email_idx;
+update roles set permissions = array_remove(permissions, 'audit:read') where name = 'admin';
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists known_devices(
+    id serial primary key,
+    user_id uuid not null references auth.users on delete cascade,
+    fingerprint text not null,
+    revoke_token text unique,
+    created_at timestamp not null default now(),
+    last_seen_at timestamp not null,
+    unique (user_id, fingerprint)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists known_devices;
+-- +goose StatementEnd
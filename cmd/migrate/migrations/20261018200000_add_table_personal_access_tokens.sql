@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists personal_access_tokens(
+    id serial primary key,
+    user_id uuid not null references auth.users on delete cascade,
+    name text not null,
+    token_hash text not null unique,
+    prefix text not null,
+    scopes text[] not null default '{}',
+    expires_at timestamp,
+    last_used_at timestamp,
+    created_at timestamp not null default now()
+);
+create index if not exists personal_access_tokens_user_id_idx on personal_access_tokens(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists personal_access_tokens;
+-- +goose StatementEnd
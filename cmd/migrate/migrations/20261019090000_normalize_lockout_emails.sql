@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+update lockouts set email = lower(trim(email)) where email <> lower(trim(email));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- The original case is not kept.
+select 1;
+-- +goose StatementEnd
@@ -19,6 +19,18 @@ func main() {
 
 	tables := []string{
 		"accounts",
+		"roles",
+		"sessions",
+		"totp_factors",
+		"recovery_codes",
+		"passkeys",
+		"login_attempts",
+		"lockouts",
+		"account_deletions",
+		"data_exports",
+		"audit_events",
+		"known_devices",
+		"personal_access_tokens",
 		"goose_db_version",
 	}
 
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"dreampicai/internal/database"
+	"dreampicai/types"
+
+	"github.com/joho/godotenv"
+)
+
+// Gives an account a role, which is how the first admin is made.
+func main() {
+	username := flag.String("username", "", "username of the account")
+	role := flag.String("role", types.RoleAdmin, "name of the role")
+	flag.Parse()
+	if len(*username) == 0 {
+		log.Fatal("-username is required")
+	}
+
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := database.NewMigrationSvcProvider()
+
+	res, err := db.DB().NewUpdate().
+		Table("accounts").
+		Set("role = ?", *role).
+		Where("username = ?", *username).
+		Exec(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Fatalf("no account named %q", *username)
+	}
+	fmt.Printf("%s now has the %s role\n", *username, *role)
+}
@@ -3,7 +3,10 @@ package view
 import (
 	"context"
 	"dreampicai/types"
+	"encoding/json"
 	"log/slog"
+	"strings"
+	"time"
 )
 
 func AuthenticatedUser(ctx context.Context) types.AuthenticatedUser {
@@ -15,3 +18,124 @@ func AuthenticatedUser(ctx context.Context) types.AuthenticatedUser {
 
 	return user
 }
+
+// Can reports whether the user has every one of perms.
+func Can(ctx context.Context, perms ...types.Permission) bool {
+	return AuthenticatedUser(ctx).Can(perms...)
+}
+
+// AuditAction describes an audit event action to people.
+func AuditAction(action string) string {
+	switch action {
+	case types.AuditLoginSucceeded:
+		return "Logged in"
+	case types.AuditLoginFailed:
+		return "Failed login"
+	case types.AuditReauthFailed:
+		return "Failed to confirm the password"
+	case types.AuditLogout:
+		return "Logged out"
+	case types.AuditSignup:
+		return "Signed up"
+	case types.AuditAccountSetup:
+		return "Set up the account"
+	case types.AuditPasswordChanged:
+		return "Changed the password"
+	case types.AuditUsernameChanged:
+		return "Changed the username"
+	case types.AuditImpersonationStart:
+		return "Support started acting as the user"
+	case types.AuditImpersonationStop:
+		return "Support stopped acting as the user"
+	case types.AuditAccountSecured:
+		return "Logged out everywhere from a new device alert"
+	case types.AuditTokenCreated:
+		return "Created an access token"
+	case types.AuditTokenRevoked:
+		return "Revoked an access token"
+	case types.AuditPasskeyAdded:
+		return "Added a passkey"
+	case types.AuditPasskeyRemoved:
+		return "Removed a passkey"
+	case types.AuditAccountDeletionRequested:
+		return "Asked to delete the account"
+	case types.AuditAccountDeletionCancelled:
+		return "Kept the account by logging in"
+	case types.AuditAccountDeletionPurged:
+		return "Account deleted"
+	case types.AuditAccountDisabled:
+		return "Support disabled the account"
+	case types.AuditAccountEnabled:
+		return "Support enabled the account"
+	case types.AuditAccountLoggedOut:
+		return "Support logged the user out everywhere"
+	case types.AuditUsernameReset:
+		return "Support changed the username"
+	case types.AuditPasswordReset:
+		return "Support sent a password reset email"
+	}
+
+	return action
+}
+
+// CSRFToken returns the CSRF token of the session, creating it on first
+// use.
+func CSRFToken(ctx context.Context) string {
+	token, ok := ctx.Value(types.CSRFTokenKey).(func() string)
+	if !ok {
+		return ""
+	}
+
+	return token()
+}
+
+// CSRFHeaders is the hx-headers value that makes htmx send the CSRF token
+// with every request.
+func CSRFHeaders(ctx context.Context) string {
+	headers, _ := json.Marshal(map[string]string{"X-CSRF-Token": CSRFToken(ctx)})
+
+	return string(headers)
+}
+
+// DeviceName gives a short description of a user agent, e.g. "Firefox on
+// Linux".
+func DeviceName(userAgent string) string {
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	system := ""
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			system = o.name
+			break
+		}
+	}
+	if len(system) == 0 {
+		return browser
+	}
+
+	return browser + " on " + system
+}
+
+func FormatTime(t time.Time) string {
+	return t.Local().Format("Jan 2, 2006 15:04")
+}
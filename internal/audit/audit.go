@@ -0,0 +1,42 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+
+	"dreampicai/internal/session"
+	"dreampicai/types"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Repository persists audit events, it is implemented by database.Service.
+type Repository interface {
+	CreateAuditEvent(context.Context, *types.AuditEvent) error
+}
+
+// Recorder writes audit events, filling in where the request came from.
+type Recorder struct {
+	repo Repository
+}
+
+func NewRecorder(repo Repository) *Recorder {
+	return &Recorder{repo: repo}
+}
+
+// Record stores event along with the IP, user agent and trace ID of r.
+func (rec *Recorder) Record(r *http.Request, event types.AuditEvent) error {
+	event.IP = session.ClientIP(r)
+	event.UserAgent = r.UserAgent()
+	if span := trace.SpanContextFromContext(r.Context()); span.HasTraceID() {
+		event.TraceID = span.TraceID().String()
+	}
+
+	return rec.repo.CreateAuditEvent(r.Context(), &event)
+}
+
+// RecordBackground stores event for work done outside of a request, there
+// is nowhere it came from.
+func (rec *Recorder) RecordBackground(ctx context.Context, event types.AuditEvent) error {
+	return rec.repo.CreateAuditEvent(ctx, &event)
+}
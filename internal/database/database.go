@@ -7,11 +7,13 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"dreampicai/types"
 
+	"github.com/google/uuid"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/uptrace/bun"
@@ -36,6 +38,58 @@ type Service interface {
 	CreateAccount(context.Context, *types.Account) error
 	GetAccountByUserID(context.Context, string) (types.Account, error)
 	UpdateUsername(context.Context, *types.Account) error
+	CreateSession(context.Context, *types.Session) error
+	GetSession(context.Context, string) (types.Session, error)
+	UpdateSession(context.Context, *types.Session) error
+	DeleteSession(context.Context, string) error
+	GetSessionsByUserID(context.Context, string) ([]types.Session, error)
+	DeleteSessionsByUserID(context.Context, string, string) error
+	DeleteExpiredSessions(context.Context, time.Time) (int64, error)
+	GetTOTPFactor(context.Context, string) (types.TOTPFactor, error)
+	SaveTOTPFactor(context.Context, *types.TOTPFactor) error
+	UseTOTPStep(context.Context, string, int64) (bool, error)
+	DeleteTOTPFactor(context.Context, string) error
+	ReplaceRecoveryCodes(context.Context, string, []types.RecoveryCode) error
+	UseRecoveryCode(context.Context, string, string) (bool, error)
+	CreatePasskey(context.Context, *types.Passkey) error
+	GetPasskeysByAccountID(context.Context, int) ([]types.Passkey, error)
+	UpdatePasskey(context.Context, *types.Passkey) error
+	DeletePasskey(context.Context, int, int) error
+	GetLoginAttempts(context.Context, ...string) ([]types.LoginAttempt, error)
+	RecordLoginFailure(context.Context, string, time.Time) (types.LoginAttempt, error)
+	LockLogin(context.Context, *types.LoginAttempt, *types.Lockout) error
+	ClearLoginAttempts(context.Context, string) error
+	CreateAccountDeletion(context.Context, *types.AccountDeletion) error
+	CancelAccountDeletion(context.Context, string) (bool, error)
+	GetDueAccountDeletions(context.Context, time.Time) ([]types.AccountDeletion, error)
+	DeleteAccount(context.Context, *types.AccountDeletion) error
+	GetAccountDeletions(context.Context, string) ([]types.AccountDeletion, error)
+	GetRecoveryCodes(context.Context, string) ([]types.RecoveryCode, error)
+	CreateDataExport(context.Context, *types.DataExport) error
+	UpdateDataExport(context.Context, *types.DataExport) error
+	GetDataExportsByUserID(context.Context, string) ([]types.DataExport, error)
+	GetDataExport(context.Context, string) (types.DataExport, error)
+	DeleteExpiredDataExports(context.Context, time.Time) (int64, error)
+	GetRole(context.Context, string) (types.Role, error)
+	SearchAccounts(context.Context, string, int, int) ([]types.AccountSummary, int, error)
+	GetAccountByID(context.Context, int) (types.Account, error)
+	SetAccountDisabled(context.Context, int, bool) error
+	GetLockoutsByEmail(context.Context, string, int) ([]types.Lockout, error)
+	CreateAuditEvent(context.Context, *types.AuditEvent) error
+	GetAuditEventsByUserID(context.Context, string, string, int) ([]types.AuditEvent, error)
+	SearchAuditEvents(context.Context, types.AuditFilter, int, int) ([]types.AuditEvent, int, error)
+	ListAuditEvents(context.Context, types.AuditFilter, int) ([]types.AuditEvent, error)
+	CountKnownDevices(context.Context, string) (int, error)
+	GetKnownDevicesByUserID(context.Context, string) ([]types.KnownDevice, error)
+	RememberDevice(context.Context, *types.KnownDevice) (bool, error)
+	GetKnownDeviceByRevokeToken(context.Context, string) (types.KnownDevice, error)
+	DeleteKnownDevice(context.Context, int) error
+	CreatePersonalAccessToken(context.Context, *types.PersonalAccessToken) error
+	GetPersonalAccessTokensByUserID(context.Context, string) ([]types.PersonalAccessToken, error)
+	GetPersonalAccessTokenByHash(context.Context, string) (types.PersonalAccessToken, error)
+	TouchPersonalAccessToken(context.Context, int, time.Time) error
+	DeletePersonalAccessToken(context.Context, string, int) error
+	DeletePersonalAccessTokensByUserID(context.Context, string) error
 }
 
 type MigrationServiceProvider interface {
@@ -116,3 +170,657 @@ func (s *service) UpdateUsername(ctx context.Context, account *types.Account) er
 
 	return err
 }
+
+func (s *service) CreateSession(ctx context.Context, session *types.Session) error {
+	_, err := s.db.NewInsert().Model(session).Exec(ctx)
+	return err
+}
+
+func (s *service) GetSession(ctx context.Context, id string) (types.Session, error) {
+	var sess types.Session
+	err := s.db.NewSelect().Model(&sess).Where("id = ?", id).Scan(ctx)
+
+	return sess, err
+}
+
+// UpdateSession writes what a request can change of a session, the user,
+// data and last use. It fails with sql.ErrNoRows when the session is gone.
+func (s *service) UpdateSession(ctx context.Context, session *types.Session) error {
+	res, err := s.db.NewUpdate().
+		Model(session).
+		Column("user_id", "data", "last_seen_at", "ip").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (s *service) DeleteSession(ctx context.Context, id string) error {
+	_, err := s.db.NewDelete().
+		Model((*types.Session)(nil)).
+		Where("id = ?", id).
+		Exec(ctx)
+
+	return err
+}
+
+func (s *service) GetSessionsByUserID(ctx context.Context, userID string) ([]types.Session, error) {
+	var sessions []types.Session
+	err := s.db.NewSelect().
+		Model(&sessions).
+		Where("user_id = ?", userID).
+		Where("expires_at > now()").
+		Order("last_seen_at desc").
+		Scan(ctx)
+
+	return sessions, err
+}
+
+// DeleteSessionsByUserID removes every session of the user except keep,
+// which may be empty.
+func (s *service) DeleteSessionsByUserID(ctx context.Context, userID string, keep string) error {
+	_, err := s.db.NewDelete().
+		Model((*types.Session)(nil)).
+		Where("user_id = ?", userID).
+		Where("id != ?", keep).
+		Exec(ctx)
+
+	return err
+}
+
+// DeleteExpiredSessions removes sessions past their absolute expiry or idle
+// since before idleSince.
+func (s *service) DeleteExpiredSessions(ctx context.Context, idleSince time.Time) (int64, error) {
+	res, err := s.db.NewDelete().
+		Model((*types.Session)(nil)).
+		Where("expires_at < now()").
+		WhereOr("last_seen_at < ?", idleSince).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *service) GetTOTPFactor(ctx context.Context, userID string) (types.TOTPFactor, error) {
+	var factor types.TOTPFactor
+	err := s.db.NewSelect().Model(&factor).Where("user_id = ?", userID).Scan(ctx)
+
+	return factor, err
+}
+
+func (s *service) SaveTOTPFactor(ctx context.Context, factor *types.TOTPFactor) error {
+	_, err := s.db.NewInsert().
+		Model(factor).
+		On("conflict (user_id) do update").
+		Set("secret = excluded.secret").
+		Set("last_used_step = excluded.last_used_step").
+		Set("confirmed_at = excluded.confirmed_at").
+		Exec(ctx)
+
+	return err
+}
+
+// UseTOTPStep records step as the last one a code was accepted for. It
+// reports false when a code for that step, or a later one, was already used.
+func (s *service) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	res, err := s.db.NewUpdate().
+		Model((*types.TOTPFactor)(nil)).
+		Set("last_used_step = ?", step).
+		Where("user_id = ?", userID).
+		Where("last_used_step < ?", step).
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// DeleteTOTPFactor removes the factor along with the recovery codes.
+func (s *service) DeleteTOTPFactor(ctx context.Context, userID string) error {
+	return s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewDelete().
+			Model((*types.RecoveryCode)(nil)).
+			Where("user_id = ?", userID).
+			Exec(ctx); err != nil {
+			return err
+		}
+		_, err := tx.NewDelete().
+			Model((*types.TOTPFactor)(nil)).
+			Where("user_id = ?", userID).
+			Exec(ctx)
+
+		return err
+	})
+}
+
+func (s *service) ReplaceRecoveryCodes(ctx context.Context, userID string, codes []types.RecoveryCode) error {
+	return s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewDelete().
+			Model((*types.RecoveryCode)(nil)).
+			Where("user_id = ?", userID).
+			Exec(ctx); err != nil {
+			return err
+		}
+		_, err := tx.NewInsert().Model(&codes).Exec(ctx)
+
+		return err
+	})
+}
+
+// UseRecoveryCode marks the code as used, reporting false when there is no
+// unused code with that hash.
+func (s *service) UseRecoveryCode(ctx context.Context, userID string, codeHash string) (bool, error) {
+	res, err := s.db.NewUpdate().
+		Model((*types.RecoveryCode)(nil)).
+		Set("used_at = now()").
+		Where("user_id = ?", userID).
+		Where("code_hash = ?", codeHash).
+		Where("used_at is null").
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+func (s *service) CreatePasskey(ctx context.Context, passkey *types.Passkey) error {
+	_, err := s.db.NewInsert().Model(passkey).Exec(ctx)
+	return err
+}
+
+func (s *service) GetPasskeysByAccountID(ctx context.Context, accountID int) ([]types.Passkey, error) {
+	var passkeys []types.Passkey
+	err := s.db.NewSelect().
+		Model(&passkeys).
+		Where("account_id = ?", accountID).
+		Order("created_at").
+		Scan(ctx)
+
+	return passkeys, err
+}
+
+func (s *service) UpdatePasskey(ctx context.Context, passkey *types.Passkey) error {
+	_, err := s.db.NewUpdate().
+		Model(passkey).
+		WherePK().
+		Exec(ctx)
+
+	return err
+}
+
+func (s *service) DeletePasskey(ctx context.Context, accountID int, id int) error {
+	_, err := s.db.NewDelete().
+		Model((*types.Passkey)(nil)).
+		Where("account_id = ?", accountID).
+		Where("id = ?", id).
+		Exec(ctx)
+
+	return err
+}
+
+func (s *service) GetLoginAttempts(ctx context.Context, keys ...string) ([]types.LoginAttempt, error) {
+	var attempts []types.LoginAttempt
+	err := s.db.NewSelect().
+		Model(&attempts).
+		Where("key in (?)", bun.In(keys)).
+		Scan(ctx)
+
+	return attempts, err
+}
+
+// RecordLoginFailure counts a failed login for key. Failures from before
+// resetBefore are forgotten and the count starts over.
+func (s *service) RecordLoginFailure(ctx context.Context, key string, resetBefore time.Time) (types.LoginAttempt, error) {
+	attempt := types.LoginAttempt{
+		Key:          key,
+		Failures:     1,
+		LastFailedAt: time.Now(),
+	}
+	_, err := s.db.NewInsert().
+		Model(&attempt).
+		On("conflict (key) do update").
+		Set("failures = case when ?TableAlias.last_failed_at < ? then 1 else ?TableAlias.failures + 1 end", resetBefore).
+		Set("last_failed_at = excluded.last_failed_at").
+		Returning("*").
+		Exec(ctx)
+
+	return attempt, err
+}
+
+// LockLogin stores the lock on the attempt and records the lockout.
+func (s *service) LockLogin(ctx context.Context, attempt *types.LoginAttempt, lockout *types.Lockout) error {
+	return s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewUpdate().
+			Model(attempt).
+			Column("locked_until").
+			WherePK().
+			Exec(ctx); err != nil {
+			return err
+		}
+		_, err := tx.NewInsert().Model(lockout).Exec(ctx)
+
+		return err
+	})
+}
+
+func (s *service) ClearLoginAttempts(ctx context.Context, key string) error {
+	_, err := s.db.NewDelete().
+		Model((*types.LoginAttempt)(nil)).
+		Where("key = ?", key).
+		Exec(ctx)
+
+	return err
+}
+
+func (s *service) CreateAccountDeletion(ctx context.Context, deletion *types.AccountDeletion) error {
+	_, err := s.db.NewInsert().Model(deletion).Exec(ctx)
+	return err
+}
+
+// CancelAccountDeletion cancels the pending deletion of the user, reporting
+// false when there is none.
+func (s *service) CancelAccountDeletion(ctx context.Context, userID string) (bool, error) {
+	res, err := s.db.NewUpdate().
+		Model((*types.AccountDeletion)(nil)).
+		Set("cancelled_at = now()").
+		Where("user_id = ?", userID).
+		Where("cancelled_at is null").
+		Where("deleted_at is null").
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+
+	return n > 0, err
+}
+
+// GetDueAccountDeletions returns the pending deletions whose grace period
+// ended before now.
+func (s *service) GetDueAccountDeletions(ctx context.Context, now time.Time) ([]types.AccountDeletion, error) {
+	var deletions []types.AccountDeletion
+	err := s.db.NewSelect().
+		Model(&deletions).
+		Where("delete_after <= ?", now).
+		Where("cancelled_at is null").
+		Where("deleted_at is null").
+		Scan(ctx)
+
+	return deletions, err
+}
+
+// DeleteAccount removes the account and everything stored for the user,
+// and marks the deletion as done.
+func (s *service) DeleteAccount(ctx context.Context, deletion *types.AccountDeletion) error {
+	return s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewDelete().
+			Model((*types.Passkey)(nil)).
+			Where("account_id in (?)", tx.NewSelect().
+				Model((*types.Account)(nil)).
+				Column("id").
+				Where("user_id = ?", deletion.UserID)).
+			Exec(ctx); err != nil {
+			return err
+		}
+		for _, model := range []interface{}{
+			(*types.Account)(nil),
+			(*types.Session)(nil),
+			(*types.RecoveryCode)(nil),
+			(*types.TOTPFactor)(nil),
+			(*types.DataExport)(nil),
+			(*types.KnownDevice)(nil),
+			(*types.PersonalAccessToken)(nil),
+		} {
+			if _, err := tx.NewDelete().
+				Model(model).
+				Where("user_id = ?", deletion.UserID).
+				Exec(ctx); err != nil {
+				return err
+			}
+		}
+
+		deletion.DeletedAt = time.Now()
+		_, err := tx.NewUpdate().
+			Model(deletion).
+			Column("deleted_at").
+			WherePK().
+			Exec(ctx)
+
+		return err
+	})
+}
+
+func (s *service) GetAccountDeletions(ctx context.Context, userID string) ([]types.AccountDeletion, error) {
+	var deletions []types.AccountDeletion
+	err := s.db.NewSelect().
+		Model(&deletions).
+		Where("user_id = ?", userID).
+		Order("requested_at").
+		Scan(ctx)
+
+	return deletions, err
+}
+
+func (s *service) GetRecoveryCodes(ctx context.Context, userID string) ([]types.RecoveryCode, error) {
+	var codes []types.RecoveryCode
+	err := s.db.NewSelect().
+		Model(&codes).
+		Where("user_id = ?", userID).
+		Order("id").
+		Scan(ctx)
+
+	return codes, err
+}
+
+func (s *service) CreateDataExport(ctx context.Context, export *types.DataExport) error {
+	_, err := s.db.NewInsert().Model(export).Exec(ctx)
+	return err
+}
+
+func (s *service) UpdateDataExport(ctx context.Context, export *types.DataExport) error {
+	_, err := s.db.NewUpdate().
+		Model(export).
+		WherePK().
+		Exec(ctx)
+
+	return err
+}
+
+// GetDataExportsByUserID returns the exports of the user, newest first and
+// without their archive.
+func (s *service) GetDataExportsByUserID(ctx context.Context, userID string) ([]types.DataExport, error) {
+	var exports []types.DataExport
+	err := s.db.NewSelect().
+		Model(&exports).
+		ExcludeColumn("archive").
+		Where("user_id = ?", userID).
+		Order("created_at desc").
+		Scan(ctx)
+
+	return exports, err
+}
+
+func (s *service) GetDataExport(ctx context.Context, token string) (types.DataExport, error) {
+	var export types.DataExport
+	err := s.db.NewSelect().Model(&export).Where("token = ?", token).Scan(ctx)
+
+	return export, err
+}
+
+func (s *service) DeleteExpiredDataExports(ctx context.Context, now time.Time) (int64, error) {
+	res, err := s.db.NewDelete().
+		Model((*types.DataExport)(nil)).
+		Where("expires_at < ?", now).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *service) GetRole(ctx context.Context, name string) (types.Role, error) {
+	var role types.Role
+	err := s.db.NewSelect().Model(&role).Where("name = ?", name).Scan(ctx)
+
+	return role, err
+}
+
+// SearchAccounts returns a page of the accounts whose username or email
+// contains query, along with the number of matches. Emails come from the
+// Supabase auth schema.
+func (s *service) SearchAccounts(ctx context.Context, query string, limit, offset int) ([]types.AccountSummary, int, error) {
+	accounts := []types.AccountSummary{}
+	q := s.db.NewSelect().
+		Model(&accounts).
+		ColumnExpr("account.*").
+		ColumnExpr("u.email").
+		Join("left join auth.users as u on u.id = account.user_id").
+		Order("account.id").
+		Limit(limit).
+		Offset(offset)
+	if len(query) > 0 {
+		pattern := "%" + likeEscaper.Replace(query) + "%"
+		q = q.Where("(account.username ilike ? or u.email ilike ?)", pattern, pattern)
+	}
+	count, err := q.ScanAndCount(ctx)
+
+	return accounts, count, err
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *service) GetAccountByID(ctx context.Context, id int) (types.Account, error) {
+	var acc types.Account
+	err := s.db.NewSelect().Model(&acc).Where("id = ?", id).Scan(ctx)
+
+	return acc, err
+}
+
+func (s *service) SetAccountDisabled(ctx context.Context, id int, disabled bool) error {
+	q := s.db.NewUpdate().
+		Model((*types.Account)(nil)).
+		Where("id = ?", id)
+	if disabled {
+		q = q.Set("disabled_at = now()")
+	} else {
+		q = q.Set("disabled_at = null")
+	}
+	_, err := q.Exec(ctx)
+
+	return err
+}
+
+// GetLockoutsByEmail returns the latest lockouts of the email, newest first.
+func (s *service) GetLockoutsByEmail(ctx context.Context, email string, limit int) ([]types.Lockout, error) {
+	var lockouts []types.Lockout
+	err := s.db.NewSelect().
+		Model(&lockouts).
+		Where("email = ?", email).
+		Order("created_at desc").
+		Limit(limit).
+		Scan(ctx)
+
+	return lockouts, err
+}
+
+func (s *service) CreateAuditEvent(ctx context.Context, event *types.AuditEvent) error {
+	_, err := s.db.NewInsert().Model(event).Exec(ctx)
+	return err
+}
+
+// GetAuditEventsByUserID returns the latest events about the user, newest
+// first, including failed logins with their email. A limit of 0 returns
+// them all.
+func (s *service) GetAuditEventsByUserID(ctx context.Context, userID string, email string, limit int) ([]types.AuditEvent, error) {
+	var events []types.AuditEvent
+	q := s.db.NewSelect().
+		Model(&events).
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("user_id = ?", userID).
+				WhereOr("user_id is null and metadata->>'email' = ?", email)
+		}).
+		Order("id desc")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	err := q.Scan(ctx)
+
+	return events, err
+}
+
+// SearchAuditEvents returns a page of the events matching filter, newest
+// first, along with the number of matches.
+func (s *service) SearchAuditEvents(ctx context.Context, filter types.AuditFilter, limit, offset int) ([]types.AuditEvent, int, error) {
+	events := []types.AuditEvent{}
+	count, err := s.auditEventsQuery(&events, filter).
+		Limit(limit).
+		Offset(offset).
+		ScanAndCount(ctx)
+
+	return events, count, err
+}
+
+// ListAuditEvents returns the latest events matching filter, newest first,
+// without counting them. Page through with filter.BeforeID.
+func (s *service) ListAuditEvents(ctx context.Context, filter types.AuditFilter, limit int) ([]types.AuditEvent, error) {
+	events := []types.AuditEvent{}
+	err := s.auditEventsQuery(&events, filter).
+		Limit(limit).
+		Scan(ctx)
+
+	return events, err
+}
+
+func (s *service) auditEventsQuery(events *[]types.AuditEvent, filter types.AuditFilter) *bun.SelectQuery {
+	q := s.db.NewSelect().
+		Model(events).
+		Order("id desc")
+	if len(filter.Action) > 0 {
+		q = q.Where("action = ?", filter.Action)
+	}
+	if filter.UserID != uuid.Nil {
+		q = q.WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where("user_id = ?", filter.UserID).WhereOr("actor_id = ?", filter.UserID)
+		})
+	}
+	if !filter.Since.IsZero() {
+		q = q.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		q = q.Where("created_at < ?", filter.Until)
+	}
+	if filter.BeforeID > 0 {
+		q = q.Where("id < ?", filter.BeforeID)
+	}
+
+	return q
+}
+
+func (s *service) CountKnownDevices(ctx context.Context, userID string) (int, error) {
+	return s.db.NewSelect().
+		Model((*types.KnownDevice)(nil)).
+		Where("user_id = ?", userID).
+		Count(ctx)
+}
+
+// GetKnownDevicesByUserID returns the devices the user logged in from, most
+// recently seen first.
+func (s *service) GetKnownDevicesByUserID(ctx context.Context, userID string) ([]types.KnownDevice, error) {
+	var devices []types.KnownDevice
+	err := s.db.NewSelect().
+		Model(&devices).
+		Where("user_id = ?", userID).
+		Order("last_seen_at desc").
+		Scan(ctx)
+
+	return devices, err
+}
+
+// RememberDevice saves the device, or only bumps when it was last seen when
+// the account already knows it. It reports whether the device was new.
+func (s *service) RememberDevice(ctx context.Context, device *types.KnownDevice) (bool, error) {
+	res, err := s.db.NewInsert().
+		Model(device).
+		On("CONFLICT (user_id, fingerprint) DO NOTHING").
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return n > 0, err
+	}
+
+	_, err = s.db.NewUpdate().
+		Model(device).
+		Column("last_seen_at").
+		Where("user_id = ?", device.UserID).
+		Where("fingerprint = ?", device.Fingerprint).
+		Exec(ctx)
+
+	return false, err
+}
+
+func (s *service) GetKnownDeviceByRevokeToken(ctx context.Context, token string) (types.KnownDevice, error) {
+	var device types.KnownDevice
+	err := s.db.NewSelect().Model(&device).Where("revoke_token = ?", token).Scan(ctx)
+
+	return device, err
+}
+
+func (s *service) DeleteKnownDevice(ctx context.Context, id int) error {
+	_, err := s.db.NewDelete().
+		Model((*types.KnownDevice)(nil)).
+		Where("id = ?", id).
+		Exec(ctx)
+
+	return err
+}
+
+func (s *service) CreatePersonalAccessToken(ctx context.Context, token *types.PersonalAccessToken) error {
+	_, err := s.db.NewInsert().Model(token).Exec(ctx)
+	return err
+}
+
+// GetPersonalAccessTokensByUserID returns the tokens of the user, newest
+// first.
+func (s *service) GetPersonalAccessTokensByUserID(ctx context.Context, userID string) ([]types.PersonalAccessToken, error) {
+	var tokens []types.PersonalAccessToken
+	err := s.db.NewSelect().
+		Model(&tokens).
+		Where("user_id = ?", userID).
+		Order("created_at desc").
+		Scan(ctx)
+
+	return tokens, err
+}
+
+func (s *service) GetPersonalAccessTokenByHash(ctx context.Context, hash string) (types.PersonalAccessToken, error) {
+	var token types.PersonalAccessToken
+	err := s.db.NewSelect().Model(&token).Where("token_hash = ?", hash).Scan(ctx)
+
+	return token, err
+}
+
+func (s *service) TouchPersonalAccessToken(ctx context.Context, id int, at time.Time) error {
+	_, err := s.db.NewUpdate().
+		Model((*types.PersonalAccessToken)(nil)).
+		Set("last_used_at = ?", at).
+		Where("id = ?", id).
+		Exec(ctx)
+
+	return err
+}
+
+// DeletePersonalAccessToken only deletes the token when it belongs to the
+// user.
+func (s *service) DeletePersonalAccessToken(ctx context.Context, userID string, id int) error {
+	_, err := s.db.NewDelete().
+		Model((*types.PersonalAccessToken)(nil)).
+		Where("id = ?", id).
+		Where("user_id = ?", userID).
+		Exec(ctx)
+
+	return err
+}
+
+func (s *service) DeletePersonalAccessTokensByUserID(ctx context.Context, userID string) error {
+	_, err := s.db.NewDelete().
+		Model((*types.PersonalAccessToken)(nil)).
+		Where("user_id = ?", userID).
+		Exec(ctx)
+
+	return err
+}
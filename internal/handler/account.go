@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+
+	"dreampicai/pkg/kit/validate"
+	"dreampicai/types"
+
+	"github.com/google/uuid"
+	"github.com/nedpals/supabase-go"
+)
+
+// The rules of the forms shared by the pages and the JSON API. They apply to
+// any params struct with the named fields.
+var (
+	usernameFields = validate.Fields{
+		"Username": validate.Rules(validate.Min(3), validate.Max(50)),
+	}
+	loginFields = validate.Fields{
+		"Email":    validate.Rules(validate.Email, validate.Required),
+		"Password": validate.Rules(validate.Password, validate.Required),
+	}
+)
+
+func signupFields(password string) validate.Fields {
+	return validate.Fields{
+		"Email":           validate.Rules(validate.Email, validate.Required),
+		"Password":        validate.Rules(validate.Password, validate.Required),
+		"ConfirmPassword": validate.Rules(validate.Equal(password), validate.Message("Passwords must match.")),
+	}
+}
+
+// signUp registers the user with the auth backend, which mails them the
+// confirmation link.
+func (s *Server) signUp(r *http.Request, email, password string) (*supabase.User, error) {
+	user, err := s.auth.SignUp(r.Context(), supabase.UserCredentials{
+		Email:    email,
+		Password: password,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("user", "data", user)
+	if id, err := uuid.Parse(user.ID); err == nil {
+		s.recordAudit(r, types.AuditSignup, id, map[string]string{"email": user.Email})
+	}
+
+	return user, nil
+}
+
+// createAccount sets up the account of the user, the username is validated
+// with usernameFields by the caller.
+func (s *Server) createAccount(r *http.Request, user types.AuthenticatedUser, username string) (types.Account, error) {
+	account := types.Account{
+		UserID:   user.ID,
+		Username: username,
+	}
+	if err := s.db.CreateAccount(r.Context(), &account); err != nil {
+		return types.Account{}, err
+	}
+	s.recordAudit(r, types.AuditAccountSetup, user.ID, map[string]string{"username": account.Username})
+
+	return account, nil
+}
+
+// changeUsername updates the account of the user, the username is
+// validated with usernameFields by the caller.
+func (s *Server) changeUsername(r *http.Request, user types.AuthenticatedUser, username string) (types.Account, error) {
+	account := user.Account
+	account.Username = username
+	if err := s.db.UpdateUsername(r.Context(), &account); err != nil {
+		slog.Error("failed to update username", "username", username)
+		return types.Account{}, err
+	}
+	s.recordAudit(r, types.AuditUsernameChanged, user.ID, map[string]string{"from": user.Account.Username, "to": username})
+
+	return account, nil
+}
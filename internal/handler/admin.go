@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"dreampicai/cmd/web/view/admin"
+	"dreampicai/cmd/web/view/auth"
+	"dreampicai/internal/lockout"
+	"dreampicai/pkg/kit/validate"
+	"dreampicai/pkg/mail"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	adminPageSize = 20
+	// adminLockouts is how many of the latest lockouts an account page lists.
+	adminLockouts = 10
+)
+
+func (s *Server) HandleAdminIndex(w http.ResponseWriter, r *http.Request) error {
+	list, err := s.adminAccounts(r)
+	if err != nil {
+		return err
+	}
+
+	return render(r, w, admin.Index(list))
+}
+
+// HandleAdminAccounts renders the account list alone, for searching and
+// paging.
+func (s *Server) HandleAdminAccounts(w http.ResponseWriter, r *http.Request) error {
+	list, err := s.adminAccounts(r)
+	if err != nil {
+		return err
+	}
+
+	return render(r, w, admin.AccountList(list))
+}
+
+func (s *Server) adminAccounts(r *http.Request) (admin.AccountListParams, error) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	accounts, total, err := s.db.SearchAccounts(r.Context(), query, adminPageSize, (page-1)*adminPageSize)
+	if err != nil {
+		return admin.AccountListParams{}, err
+	}
+
+	return admin.AccountListParams{
+		Query:    query,
+		Accounts: accounts,
+		Page:     page,
+		Pages:    (total + adminPageSize - 1) / adminPageSize,
+		Total:    total,
+	}, nil
+}
+
+func (s *Server) HandleAdminAccount(w http.ResponseWriter, r *http.Request) error {
+	details, err := s.adminAccount(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return render(r, w, admin.Account(details))
+}
+
+// adminAccount loads the account named in the URL, with the identity of its
+// user. The identity is missing when the auth user is gone.
+func (s *Server) adminAccount(r *http.Request) (admin.AccountDetails, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return admin.AccountDetails{}, sql.ErrNoRows
+	}
+	account, err := s.db.GetAccountByID(r.Context(), id)
+	if err != nil {
+		return admin.AccountDetails{}, err
+	}
+
+	details := admin.AccountDetails{Account: account}
+	details.Identity, err = s.auth.GetUser(r.Context(), account.UserID.String())
+	if err != nil {
+		slog.Error("fetching identity failed", "user", account.UserID, "err", err)
+	}
+	details.Sessions, err = s.db.GetSessionsByUserID(r.Context(), account.UserID.String())
+	if err != nil {
+		return admin.AccountDetails{}, err
+	}
+	if details.Identity != nil {
+		details.Lockouts, err = s.db.GetLockoutsByEmail(r.Context(), lockout.NormalizeEmail(details.Identity.Email), adminLockouts)
+		if err != nil {
+			return admin.AccountDetails{}, err
+		}
+	}
+
+	return details, nil
+}
+
+// adminAction runs an admin action on the account named in the URL and
+// renders the account again along with the outcome.
+func (s *Server) adminAction(w http.ResponseWriter, r *http.Request, action func(context.Context, admin.AccountDetails) (admin.Notice, error)) error {
+	details, err := s.adminAccount(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	notice, err := action(r.Context(), details)
+	if err != nil {
+		return err
+	}
+	slog.Info("admin action", "admin", getAuthenticatedUser(r).ID, "account", details.Account.ID, "path", r.URL.Path, "notice", notice.Message)
+
+	details, err = s.adminAccount(r)
+	if err != nil {
+		return err
+	}
+
+	return render(r, w, admin.AccountDetail(details, notice))
+}
+
+func (s *Server) HandleAdminAccountDisable(w http.ResponseWriter, r *http.Request) error {
+	return s.adminAction(w, r, func(ctx context.Context, details admin.AccountDetails) (admin.Notice, error) {
+		if details.Account.UserID == getAuthenticatedUser(r).ID {
+			return admin.Notice{Message: "You cannot disable your own account.", Error: true}, nil
+		}
+		if err := s.db.SetAccountDisabled(ctx, details.Account.ID, true); err != nil {
+			return admin.Notice{}, err
+		}
+		s.recordAdminAudit(r, types.AuditAccountDisabled, details.Account, nil)
+		// Disabled accounts are turned away anyway, this logs them out.
+		if err := s.logoutEverywhere(r, details.Account.UserID); err != nil {
+			return admin.Notice{}, err
+		}
+
+		return admin.Notice{Message: "The account was disabled and logged out."}, nil
+	})
+}
+
+func (s *Server) HandleAdminAccountEnable(w http.ResponseWriter, r *http.Request) error {
+	return s.adminAction(w, r, func(ctx context.Context, details admin.AccountDetails) (admin.Notice, error) {
+		if err := s.db.SetAccountDisabled(ctx, details.Account.ID, false); err != nil {
+			return admin.Notice{}, err
+		}
+		s.recordAdminAudit(r, types.AuditAccountEnabled, details.Account, nil)
+
+		return admin.Notice{Message: "The account was enabled."}, nil
+	})
+}
+
+func (s *Server) HandleAdminAccountLogout(w http.ResponseWriter, r *http.Request) error {
+	return s.adminAction(w, r, func(ctx context.Context, details admin.AccountDetails) (admin.Notice, error) {
+		if err := s.logoutEverywhere(r, details.Account.UserID); err != nil {
+			return admin.Notice{}, err
+		}
+		s.recordAdminAudit(r, types.AuditAccountLoggedOut, details.Account, nil)
+
+		return admin.Notice{Message: "The user was logged out everywhere."}, nil
+	})
+}
+
+func (s *Server) HandleAdminAccountUsername(w http.ResponseWriter, r *http.Request) error {
+	return s.adminAction(w, r, func(ctx context.Context, details admin.AccountDetails) (admin.Notice, error) {
+		params := admin.UsernameParams{
+			Username: strings.TrimSpace(r.FormValue("username")),
+		}
+		var errs admin.UsernameErrors
+		if ok := validate.New(&params, usernameFields).Validate(&errs); !ok {
+			return admin.Notice{Message: errs.Username, Error: true}, nil
+		}
+
+		account := details.Account
+		account.Username = params.Username
+		if err := s.db.UpdateUsername(ctx, &account); err != nil {
+			return admin.Notice{}, err
+		}
+		s.recordAdminAudit(r, types.AuditUsernameReset, details.Account, map[string]string{"new_username": account.Username})
+
+		return admin.Notice{Message: fmt.Sprintf("The username was changed to %s.", account.Username)}, nil
+	})
+}
+
+// HandleAdminAccountPasswordReset mails the user a link to the forgot
+// password form. Supabase's own reset link would carry a PKCE code bound to
+// the admin's browser, so the user starts the reset themselves.
+func (s *Server) HandleAdminAccountPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	return s.adminAction(w, r, func(ctx context.Context, details admin.AccountDetails) (admin.Notice, error) {
+		if details.Identity == nil {
+			return admin.Notice{Message: "The user has no identity to reset.", Error: true}, nil
+		}
+
+		err := s.mailer.Send(ctx, mail.Message{
+			To:      details.Identity.Email,
+			Subject: "Reset your dreampicai password",
+			Body: fmt.Sprintf("An administrator asked you to reset your password. Open this link to get a reset link mailed to you:\n\n%s/forgot-password?email=%s\n",
+				appURL(), url.QueryEscape(details.Identity.Email)),
+		})
+		if err != nil {
+			slog.Error("sending password reset email failed", "user", details.Account.UserID, "err", err)
+			return admin.Notice{Message: "The email could not be sent.", Error: true}, nil
+		}
+		s.recordAdminAudit(r, types.AuditPasswordReset, details.Account, nil)
+
+		return admin.Notice{Message: "A password reset email was sent to " + details.Identity.Email + "."}, nil
+	})
+}
+
+// HandleAccountDisabled is where users of disabled accounts land.
+func (s *Server) HandleAccountDisabled(w http.ResponseWriter, r *http.Request) error {
+	w.WriteHeader(http.StatusForbidden)
+
+	return render(r, w, auth.AccountDisabled())
+}
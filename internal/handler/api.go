@@ -0,0 +1,429 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"dreampicai/internal/session"
+	"dreampicai/pkg/kit/validate"
+	"dreampicai/pkg/sb"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nedpals/supabase-go"
+)
+
+// maxAPIBody limits the size of JSON request bodies.
+const maxAPIBody = 1 << 20
+
+// isAPI reports whether the request is for the JSON API, which answers
+// errors with an apiError instead of a page.
+func isAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// apiError is the body of every error response of the API. Code is stable
+// for scripts to match on, Message is for people. Fields holds the message
+// of each invalid field, keyed by its JSON name.
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, msg string) error {
+	return writeJSON(w, status, apiError{Error: apiErrorBody{Code: code, Message: msg}})
+}
+
+// writeValidationError answers with the errors of validate.Validator for
+// req, renaming the fields to the JSON names of req.
+func writeValidationError(w http.ResponseWriter, req any, errs map[string]string) error {
+	t := reflect.TypeOf(req)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	fields := make(map[string]string, len(errs))
+	for name, msg := range errs {
+		key := name
+		if field, ok := t.FieldByName(name); ok {
+			if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); len(tag) > 0 && tag != "-" {
+				key = tag
+			}
+		}
+		fields[key] = msg
+	}
+
+	return writeJSON(w, http.StatusUnprocessableEntity, apiError{Error: apiErrorBody{
+		Code:    "validation_failed",
+		Message: "Some fields are invalid.",
+		Fields:  fields,
+	}})
+}
+
+// readJSON decodes the body of r into v. Unknown fields are rejected, so
+// typos do not go unnoticed.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
+
+func invalidJSON(w http.ResponseWriter, err error) error {
+	return writeAPIError(w, http.StatusBadRequest, "invalid_json", "The body is not valid JSON: "+err.Error())
+}
+
+// apiRoutes is the router of version 1 of the API. It authenticates with
+// personal access tokens only, see WithUser.
+func (s *Server) apiRoutes() chi.Router {
+	r := chi.NewRouter()
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "There is no such endpoint.")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "The endpoint does not support this method.")
+	})
+
+	r.Post("/auth/signup", MakeHandler("api_signup", s.HandleAPISignup))
+	r.Post("/auth/token", MakeHandler("api_token_post", s.HandleAPITokenPost))
+
+	r.Group(func(r chi.Router) {
+		r.Use(apiAuth)
+		r.With(AllowTokens()).Get("/auth/token", MakeHandler("api_token_get", s.HandleAPITokenGet))
+		r.With(AllowTokens()).Delete("/auth/token", MakeHandler("api_token_delete", s.HandleAPITokenDelete))
+		r.With(AllowTokens(types.ScopeAccountWrite)).Post("/account", MakeHandler("api_account_post", s.HandleAPIAccountPost))
+		r.Group(func(r chi.Router) {
+			r.Use(s.apiAccount)
+			r.With(AllowTokens(types.ScopeAccountRead)).Get("/account", MakeHandler("api_account_get", s.HandleAPIAccountGet))
+			r.With(AllowTokens(types.ScopeAccountWrite)).Patch("/account", MakeHandler("api_account_patch", s.HandleAPIAccountPatch))
+		})
+	})
+
+	return r
+}
+
+// apiAuth is WithAuth for the API.
+func apiAuth(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := getAuthenticatedUser(r)
+		if !user.IsLoggedIn {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			unauthorized(w, r, "Send a personal access token in the Authorization header.")
+			return
+		}
+		if !user.EmailConfirmed {
+			writeAPIError(w, http.StatusForbidden, "email_unconfirmed", "Confirm your email address first.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// apiAccount is WithAccount for the API.
+func (s *Server) apiAccount(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.loadAccount(r.Context(), getAuthenticatedUser(r))
+		if errors.Is(err, sql.ErrNoRows) {
+			writeAPIError(w, http.StatusNotFound, "account_not_found", "Set up the account first.")
+			return
+		}
+		if err != nil {
+			internalError(w, r)
+			return
+		}
+		if user.Account.Disabled() {
+			writeAPIError(w, http.StatusForbidden, "account_disabled", "The account is disabled.")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), types.UserContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+type apiUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+}
+
+type apiAccount struct {
+	ID        int       `json:"id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newAPIAccount(user types.AuthenticatedUser, account types.Account) apiAccount {
+	role := account.Role
+	if len(role) == 0 {
+		role = types.RoleUser
+	}
+
+	return apiAccount{
+		ID:        account.ID,
+		UserID:    user.ID,
+		Username:  account.Username,
+		Email:     user.Email,
+		Role:      role,
+		CreatedAt: account.CreatedAt,
+	}
+}
+
+type apiToken struct {
+	ID         int                `json:"id"`
+	Name       string             `json:"name"`
+	Prefix     string             `json:"prefix"`
+	Scopes     []types.TokenScope `json:"scopes"`
+	ExpiresAt  *time.Time         `json:"expires_at"`
+	LastUsedAt *time.Time         `json:"last_used_at"`
+	CreatedAt  time.Time          `json:"created_at"`
+}
+
+// apiNewToken is a token just created, the only time the token itself is
+// shown.
+type apiNewToken struct {
+	apiToken
+	Token string `json:"token"`
+}
+
+func newAPIToken(token types.PersonalAccessToken) apiToken {
+	t := apiToken{
+		ID:        token.ID,
+		Name:      token.Name,
+		Prefix:    token.Prefix,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+	}
+	if !token.ExpiresAt.IsZero() {
+		t.ExpiresAt = &token.ExpiresAt
+	}
+	if !token.LastUsedAt.IsZero() {
+		t.LastUsedAt = &token.LastUsedAt
+	}
+
+	return t
+}
+
+type apiSignupRequest struct {
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	ConfirmPassword string `json:"confirm_password"`
+}
+
+// HandleAPISignup registers a user. Like the signup page, the email must be
+// confirmed before a token can be created.
+func (s *Server) HandleAPISignup(w http.ResponseWriter, r *http.Request) error {
+	var req apiSignupRequest
+	if err := readJSON(w, r, &req); err != nil {
+		return invalidJSON(w, err)
+	}
+	errs := map[string]string{}
+	if ok := validate.New(&req, signupFields(req.Password)).Validate(errs); !ok {
+		return writeValidationError(w, &req, errs)
+	}
+
+	user, err := s.signUp(r, req.Email, req.Password)
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "signup_failed", "Signup failed, the email may already be registered.")
+	}
+
+	return writeJSON(w, http.StatusCreated, apiUser{ID: user.ID, Email: user.Email})
+}
+
+type apiTokenRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Code is the second factor, required when two-factor authentication is
+	// on.
+	Code          string             `json:"code,omitempty"`
+	Name          string             `json:"name"`
+	Scopes        []types.TokenScope `json:"scopes"`
+	ExpiresInDays int                `json:"expires_in_days"`
+}
+
+// HandleAPITokenPost logs in with a password and answers with a new
+// personal access token, the API has no sessions of its own. The lockout is
+// only cleared once the second factor passed too, failed codes count
+// against it.
+func (s *Server) HandleAPITokenPost(w http.ResponseWriter, r *http.Request) error {
+	var req apiTokenRequest
+	if err := readJSON(w, r, &req); err != nil {
+		return invalidJSON(w, err)
+	}
+	token := tokenRequest{Name: strings.TrimSpace(req.Name), Scopes: req.Scopes, ExpiresInDays: req.ExpiresInDays}
+	errs := map[string]string{}
+	ok := validate.New(&req, loginFields).Validate(errs)
+	if !token.validate(errs) || !ok {
+		return writeValidationError(w, &req, errs)
+	}
+
+	credentials := supabase.UserCredentials{Email: req.Email, Password: req.Password}
+	details, wait, err := s.checkLogin(r, credentials)
+	if wait > 0 {
+		return writeAPIError(w, http.StatusTooManyRequests, "too_many_attempts", tooManyAttempts(wait))
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		return writeAPIError(w, http.StatusUnauthorized, "invalid_credentials", "Invalid credentials.")
+	}
+	if err != nil {
+		return err
+	}
+	// The backend session only checked the password.
+	defer s.signOut(r, details.AccessToken, sb.ScopeLocal)
+
+	userID, err := uuid.Parse(details.User.ID)
+	if err != nil {
+		return err
+	}
+	factor, err := s.db.GetTOTPFactor(r.Context(), details.User.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if factor.Enabled() {
+		if len(req.Code) == 0 {
+			return writeAPIError(w, http.StatusUnauthorized, "second_factor_required", "Send the code of your authenticator app or a recovery code.")
+		}
+		valid, err := s.verifySecondFactor(r.Context(), details.User.ID, req.Code)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			s.recordAudit(r, types.AuditLoginFailed, userID, map[string]string{"reason": "invalid_second_factor"})
+			wait, err := s.logins.Fail(r.Context(), session.ClientIP(r), req.Email)
+			if err != nil {
+				return err
+			}
+			if wait > 0 {
+				return writeAPIError(w, http.StatusTooManyRequests, "too_many_attempts", tooManyAttempts(wait))
+			}
+			return writeAPIError(w, http.StatusUnauthorized, "invalid_second_factor", "Invalid code.")
+		}
+	}
+	account, err := s.db.GetAccountByUserID(r.Context(), details.User.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if account.Disabled() {
+		return writeAPIError(w, http.StatusForbidden, "account_disabled", "The account is disabled.")
+	}
+	if err := s.logins.Succeed(r.Context(), req.Email); err != nil {
+		return err
+	}
+	if err := s.cancelAccountDeletion(r, userID); err != nil {
+		return err
+	}
+
+	s.recordAudit(r, types.AuditLoginSucceeded, userID, map[string]string{"path": r.URL.Path})
+	s.checkDevice(r, details.User)
+	raw, created, err := s.createPersonalToken(r, userID, token)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, apiNewToken{apiToken: newAPIToken(created), Token: raw})
+}
+
+// HandleAPITokenGet describes the token the request is made with.
+func (s *Server) HandleAPITokenGet(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	tokens, err := s.db.GetPersonalAccessTokensByUserID(r.Context(), user.ID.String())
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if token.ID == user.TokenID {
+			return writeJSON(w, http.StatusOK, newAPIToken(token))
+		}
+	}
+
+	return writeAPIError(w, http.StatusNotFound, "not_found", "The token no longer exists.")
+}
+
+// HandleAPITokenDelete revokes the token the request is made with, the API
+// counterpart of logging out.
+func (s *Server) HandleAPITokenDelete(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	if err := s.db.DeletePersonalAccessToken(r.Context(), user.ID.String(), user.TokenID); err != nil {
+		return err
+	}
+	s.recordAudit(r, types.AuditTokenRevoked, user.ID, map[string]string{"id": strconv.Itoa(user.TokenID)})
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+func (s *Server) HandleAPIAccountGet(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+
+	return writeJSON(w, http.StatusOK, newAPIAccount(user, user.Account))
+}
+
+type apiUsernameRequest struct {
+	Username string `json:"username"`
+}
+
+// HandleAPIAccountPost sets up the account, like HandleAccountPost.
+func (s *Server) HandleAPIAccountPost(w http.ResponseWriter, r *http.Request) error {
+	var req apiUsernameRequest
+	if err := readJSON(w, r, &req); err != nil {
+		return invalidJSON(w, err)
+	}
+	errs := map[string]string{}
+	if ok := validate.New(&req, usernameFields).Validate(errs); !ok {
+		return writeValidationError(w, &req, errs)
+	}
+
+	user := getAuthenticatedUser(r)
+	_, err := s.db.GetAccountByUserID(r.Context(), user.ID.String())
+	if err == nil {
+		return writeAPIError(w, http.StatusConflict, "account_exists", "The account is already set up.")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	account, err := s.createAccount(r, user, req.Username)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, newAPIAccount(user, account))
+}
+
+// HandleAPIAccountPatch updates the profile, like HandleUpdateProfilePut.
+func (s *Server) HandleAPIAccountPatch(w http.ResponseWriter, r *http.Request) error {
+	var req apiUsernameRequest
+	if err := readJSON(w, r, &req); err != nil {
+		return invalidJSON(w, err)
+	}
+	errs := map[string]string{}
+	if ok := validate.New(&req, usernameFields).Validate(errs); !ok {
+		return writeValidationError(w, &req, errs)
+	}
+
+	user := getAuthenticatedUser(r)
+	account, err := s.changeUsername(r, user, req.Username)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, newAPIAccount(user, account))
+}
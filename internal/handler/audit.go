@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dreampicai/cmd/web/view/admin"
+	"dreampicai/types"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// activityLimit is how many events the settings page lists.
+	activityLimit = 20
+	auditPageSize = 50
+	// auditExportBatch is how many events an export reads at a time.
+	auditExportBatch = 1000
+	auditDateLayout  = "2006-01-02"
+)
+
+// recordAudit records a security event about the user, acted by the user or
+// by the admin impersonating them. The request goes on when it fails.
+func (s *Server) recordAudit(r *http.Request, action string, userID uuid.UUID, metadata map[string]string) {
+	actor := userID
+	if imp, ok := s.impersonation(r); ok {
+		actor, _ = uuid.Parse(imp.AdminID)
+	}
+
+	if err := s.audit.Record(r, types.AuditEvent{
+		Action:   action,
+		ActorID:  actor,
+		UserID:   userID,
+		Metadata: metadata,
+	}); err != nil {
+		slog.Error("recording audit event failed", "action", action, "user", userID, "err", err)
+	}
+}
+
+// recordAdminAudit records an action of the admin making the request on the
+// account of another user.
+func (s *Server) recordAdminAudit(r *http.Request, action string, account types.Account, metadata map[string]string) {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata["username"] = account.Username
+
+	if err := s.audit.Record(r, types.AuditEvent{
+		Action:   action,
+		ActorID:  getAuthenticatedUser(r).ID,
+		UserID:   account.UserID,
+		Metadata: metadata,
+	}); err != nil {
+		slog.Error("recording audit event failed", "action", action, "user", account.UserID, "err", err)
+	}
+}
+
+func (s *Server) HandleAuditIndex(w http.ResponseWriter, r *http.Request) error {
+	list, err := s.auditEvents(r)
+	if err != nil {
+		return err
+	}
+
+	return render(r, w, admin.Audit(list))
+}
+
+// HandleAuditEvents renders the event list alone, for filtering and paging.
+func (s *Server) HandleAuditEvents(w http.ResponseWriter, r *http.Request) error {
+	list, err := s.auditEvents(r)
+	if err != nil {
+		return err
+	}
+
+	return render(r, w, admin.AuditList(list))
+}
+
+func (s *Server) auditEvents(r *http.Request) (admin.AuditListParams, error) {
+	params, filter := auditFilter(r)
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	if len(params.Error) > 0 {
+		return admin.AuditListParams{Filter: params, Page: 1}, nil
+	}
+
+	events, total, err := s.db.SearchAuditEvents(r.Context(), filter, auditPageSize, (page-1)*auditPageSize)
+	if err != nil {
+		return admin.AuditListParams{}, err
+	}
+
+	return admin.AuditListParams{
+		Filter: params,
+		Events: events,
+		Page:   page,
+		Pages:  (total + auditPageSize - 1) / auditPageSize,
+		Total:  total,
+	}, nil
+}
+
+// auditFilter reads the filter from the query. Until is inclusive of the
+// whole day.
+func auditFilter(r *http.Request) (admin.AuditFilterParams, types.AuditFilter) {
+	query := r.URL.Query()
+	params := admin.AuditFilterParams{
+		Action: query.Get("action"),
+		User:   strings.TrimSpace(query.Get("user")),
+		Since:  query.Get("since"),
+		Until:  query.Get("until"),
+	}
+
+	filter := types.AuditFilter{Action: params.Action}
+	var err error
+	if len(params.User) > 0 {
+		if filter.UserID, err = uuid.Parse(params.User); err != nil {
+			params.Error = "The user must be a user ID."
+		}
+	}
+	if len(params.Since) > 0 {
+		if filter.Since, err = time.ParseInLocation(auditDateLayout, params.Since, time.Local); err != nil {
+			params.Error = "The dates must look like 2006-01-02."
+		}
+	}
+	if len(params.Until) > 0 {
+		if filter.Until, err = time.ParseInLocation(auditDateLayout, params.Until, time.Local); err != nil {
+			params.Error = "The dates must look like 2006-01-02."
+		}
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+
+	return params, filter
+}
+
+// HandleAuditExport streams the events matching the filter as CSV, newest
+// first.
+func (s *Server) HandleAuditExport(w http.ResponseWriter, r *http.Request) error {
+	params, filter := auditFilter(r)
+	if len(params.Error) > 0 {
+		http.Error(w, params.Error, http.StatusBadRequest)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-`+time.Now().Format(auditDateLayout)+`.csv"`)
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "created_at", "action", "actor_id", "user_id", "ip", "user_agent", "trace_id", "metadata"}); err != nil {
+		return err
+	}
+
+	for {
+		events, err := s.db.ListAuditEvents(r.Context(), filter, auditExportBatch)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			// The metadata cell is a JSON object, it cannot start a formula
+			// and its values are kept as they are.
+			metadata, err := json.Marshal(event.Metadata)
+			if err != nil {
+				return err
+			}
+			if err := cw.Write([]string{
+				strconv.Itoa(event.ID),
+				event.CreatedAt.UTC().Format(time.RFC3339),
+				csvCell(event.Action),
+				uuidString(event.ActorID),
+				uuidString(event.UserID),
+				csvCell(event.IP),
+				csvCell(event.UserAgent),
+				csvCell(event.TraceID),
+				string(metadata),
+			}); err != nil {
+				return err
+			}
+		}
+		if len(events) < auditExportBatch {
+			break
+		}
+		filter.BeforeID = events[len(events)-1].ID
+	}
+	cw.Flush()
+	slog.Info("audit log exported", "admin", getAuthenticatedUser(r).ID, "action", params.Action, "user", params.User)
+
+	return cw.Error()
+}
+
+// csvCell keeps spreadsheets from reading a cell users control, e.g. their
+// user agent, as a formula.
+func csvCell(value string) string {
+	if len(value) > 0 && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+func uuidString(id uuid.UUID) string {
+	if id == uuid.Nil {
+		return ""
+	}
+
+	return id.String()
+}
@@ -1,16 +1,23 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"dreampicai/cmd/web/view/auth"
+	"dreampicai/internal/session"
 	"dreampicai/pkg/kit/validate"
 	"dreampicai/pkg/sb"
 	"dreampicai/types"
 
-	"github.com/gorilla/sessions"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/nedpals/supabase-go"
 )
 
@@ -20,17 +27,10 @@ func (s *Server) HandleAccountPost(w http.ResponseWriter, r *http.Request) error
 	}
 
 	var errors auth.AccountSetupFormDataErrors
-	if ok := validate.New(&params, validate.Fields{
-		"Username": validate.Rules(validate.Min(3), validate.Max(50)),
-	}).Validate(&errors); !ok {
+	if ok := validate.New(&params, usernameFields).Validate(&errors); !ok {
 		return render(r, w, auth.AccountSetupForm(params, errors))
 	}
-	user := getAuthenticatedUser(r)
-	account := types.Account{
-		UserID:   user.ID,
-		Username: params.Username,
-	}
-	if err := s.db.CreateAccount(r.Context(), &account); err != nil {
+	if _, err := s.createAccount(r, getAuthenticatedUser(r), params.Username); err != nil {
 		return err
 	}
 
@@ -54,30 +54,21 @@ func (s *Server) HandleSignupPost(w http.ResponseWriter, r *http.Request) error
 
 	errors := auth.SignupErrors{}
 
-	if ok := validate.New(&params, validate.Fields{
-		"Email":           validate.Rules(validate.Email, validate.Required),
-		"Password":        validate.Rules(validate.Password, validate.Required),
-		"ConfirmPassword": validate.Rules(validate.Equal(params.Password), validate.Message("Passwords must match.")),
-	}).Validate(&errors); !ok {
+	if ok := validate.New(&params, signupFields(params.Password)).Validate(&errors); !ok {
 		return render(r, w, auth.SignupForm(params, errors))
 	}
 
-	user, err := sb.Client.Auth.SignUp(r.Context(), supabase.UserCredentials{
-		Email:    params.Email,
-		Password: params.Password,
-	})
+	user, err := s.signUp(r, params.Email, params.Password)
 	if err != nil {
 		slog.Error("signup error", "err", err)
 		return render(r, w, auth.SignupForm(params, auth.SignupErrors{SignupErr: "Signup failed."}))
 	}
 
-	slog.Info("user", "data", user)
-
 	return render(r, w, auth.SignupSuccess(user.Email))
 }
 
 func (s *Server) HandleLoginIndex(w http.ResponseWriter, r *http.Request) error {
-	return render(r, w, auth.Login())
+	return render(r, w, auth.Login(s.oauthProviders))
 }
 
 func (s *Server) HandleLoginPost(w http.ResponseWriter, r *http.Request) error {
@@ -86,42 +77,195 @@ func (s *Server) HandleLoginPost(w http.ResponseWriter, r *http.Request) error {
 		Password: r.FormValue("password"),
 	}
 
-	var errors auth.LoginErrors
-	if ok := validate.New(&credentials, validate.Fields{
-		"Email":    validate.Rules(validate.Email, validate.Required),
-		"Password": validate.Rules(validate.Password, validate.Required),
-	}).Validate(&errors); !ok {
-		return render(r, w, auth.LoginForm(credentials, errors))
+	var errs auth.LoginErrors
+	if ok := validate.New(&credentials, loginFields).Validate(&errs); !ok {
+		return render(r, w, auth.LoginForm(credentials, errs, s.oauthProviders))
 	}
 
-	resp, err := sb.Client.Auth.SignIn(r.Context(), credentials)
-	if err != nil {
-		slog.Error("login error", "err", err)
+	resp, wait, err := s.checkLogin(r, credentials)
+	if wait > 0 {
+		return render(r, w, auth.LoginForm(credentials, auth.LoginErrors{
+			TooManyAttempts: tooManyAttempts(wait),
+		}, s.oauthProviders))
+	}
+	if errors.Is(err, errInvalidCredentials) {
 		return render(r, w, auth.LoginForm(credentials, auth.LoginErrors{
 			InvalidCredentials: "Invalid credentials.",
-		}))
+		}, s.oauthProviders))
+	}
+	if err != nil {
+		return err
 	}
 
-	setAuthCookie(w, r, resp.AccessToken)
+	return s.completeLogin(w, r, resp, "/")
+}
 
-	return hxRedirect(w, r, "/")
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errLockedOut          = errors.New("locked out")
+)
+
+// checkLogin is verifyPassword for logins, failures are audited. The
+// lockout is cleared by completeLogin, once the second factor passed too.
+func (s *Server) checkLogin(r *http.Request, credentials supabase.UserCredentials) (*supabase.AuthenticatedDetails, time.Duration, error) {
+	resp, wait, err := s.verifyPassword(r, credentials)
+	switch {
+	case errors.Is(err, errLockedOut):
+		s.recordAudit(r, types.AuditLoginFailed, uuid.Nil, map[string]string{"email": credentials.Email, "reason": "locked"})
+		return nil, wait, err
+	case errors.Is(err, errInvalidCredentials):
+		s.recordAudit(r, types.AuditLoginFailed, uuid.Nil, map[string]string{"email": credentials.Email, "reason": "invalid_credentials"})
+		return nil, wait, err
+	case err != nil:
+		return nil, 0, err
+	}
+
+	return resp, 0, nil
+}
+
+// verifyPassword checks the password with the auth backend, within the
+// limits of the lockout. wait is set while the email or address is locked
+// out, including by this very attempt. The lockout is left as it is on
+// success, for the caller to clear once every check passed.
+func (s *Server) verifyPassword(r *http.Request, credentials supabase.UserCredentials) (*supabase.AuthenticatedDetails, time.Duration, error) {
+	ip := session.ClientIP(r)
+	wait, err := s.logins.Check(r.Context(), ip, credentials.Email)
+	if err != nil {
+		return nil, 0, err
+	}
+	if wait > 0 {
+		return nil, wait, errLockedOut
+	}
+
+	resp, err := s.auth.SignIn(r.Context(), credentials)
+	if err != nil {
+		slog.Error("login error", "err", err)
+		wait, err := s.logins.Fail(r.Context(), ip, credentials.Email)
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, wait, errInvalidCredentials
+	}
+
+	return resp, 0, nil
+}
+
+func tooManyAttempts(wait time.Duration) string {
+	minutes := int(math.Ceil(wait.Minutes()))
+	if minutes == 1 {
+		return "Too many failed attempts, please try again in 1 minute."
+	}
+
+	return fmt.Sprintf("Too many failed attempts, please try again in %d minutes.", minutes)
+}
+
+func (s *Server) HandlePasswordlessIndex(w http.ResponseWriter, r *http.Request) error {
+	return render(r, w, auth.PasswordlessLogin())
+}
+
+func (s *Server) HandleOTPPost(w http.ResponseWriter, r *http.Request) error {
+	params := auth.OTPParams{
+		Email: r.FormValue("email"),
+	}
+
+	var errors auth.OTPErrors
+	if ok := validate.New(&params, validate.Fields{
+		"Email": validate.Rules(validate.Email, validate.Required),
+	}).Validate(&errors); !ok {
+		return render(r, w, auth.PasswordlessForm(params, errors))
+	}
+
+	// Like the forgot password flow, unknown emails get the same answer.
+	opts, err := s.startEmailFlow(w, r, os.Getenv("MAGIC_LINK_CALLBACK_URL"), "/")
+	if err != nil {
+		return err
+	}
+	if err := s.auth.SendOTP(r.Context(), params.Email, opts); err != nil {
+		slog.Error("send otp failed", "err", err)
+	}
+
+	return render(r, w, auth.OTPVerifyForm(params, errors))
+}
+
+func (s *Server) HandleOTPVerifyPost(w http.ResponseWriter, r *http.Request) error {
+	params := auth.OTPParams{
+		Email: r.FormValue("email"),
+		Token: strings.TrimSpace(r.FormValue("token")),
+	}
+
+	var errors auth.OTPErrors
+	if ok := validate.New(&params, validate.Fields{
+		"Email": validate.Rules(validate.Email, validate.Required),
+		"Token": validate.Rules(validate.Required, validate.Min(6), validate.Max(6)),
+	}).Validate(&errors); !ok {
+		return render(r, w, auth.OTPVerifyForm(params, errors))
+	}
+
+	resp, err := s.auth.VerifyOTP(r.Context(), params.Email, params.Token)
+	if err != nil {
+		slog.Error("otp verification error", "err", err)
+		s.recordAudit(r, types.AuditLoginFailed, uuid.Nil, map[string]string{"email": params.Email, "reason": "invalid_code"})
+		return render(r, w, auth.OTPVerifyForm(params, auth.OTPErrors{
+			InvalidToken: "Invalid or expired code.",
+		}))
+	}
+
+	return s.completeLogin(w, r, resp, "/")
 }
 
 func (s *Server) HandleAuthCallback(w http.ResponseWriter, r *http.Request) error {
-	accessToken := r.URL.Query().Get("access_token")
-	if len(accessToken) == 0 {
-		return render(r, w, auth.CallbackScript())
+	flow, err := s.takeAuthFlow(w, r)
+	if err != nil {
+		return err
 	}
 
-	setAuthCookie(w, r, accessToken)
+	query := r.URL.Query()
+	if desc := query.Get("error_description"); len(desc) > 0 {
+		slog.Error("auth callback error", "err", desc)
+		return renderCallbackError(w, r, "Login failed, please try again.")
+	}
+	if len(flow.Verifier) == 0 || !flow.validState(query.Get("state")) {
+		return renderCallbackError(w, r, "This login link is invalid or was opened in a different browser.")
+	}
 
-	return hxRedirect(w, r, "/")
+	resp, err := s.auth.ExchangeCode(r.Context(), supabase.ExchangeCodeOpts{
+		AuthCode:     query.Get("code"),
+		CodeVerifier: flow.Verifier,
+	})
+	if err != nil {
+		slog.Error("code exchange error", "err", err)
+		return renderCallbackError(w, r, "This login link has expired, please try again.")
+	}
+
+	next := flow.Next
+	if len(next) == 0 {
+		next = "/"
+	}
+
+	return s.completeLogin(w, r, resp, next)
+}
+
+func renderCallbackError(w http.ResponseWriter, r *http.Request, msg string) error {
+	w.WriteHeader(http.StatusBadRequest)
+
+	return render(r, w, auth.CallbackError(msg))
 }
 
 func (s *Server) HandleLogoutPost(w http.ResponseWriter, r *http.Request) error {
-	store := sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
-	sess, _ := store.Get(r, types.UserContextKey)
-	sess.Values[types.AccessTokenKey] = ""
+	sess, _ := s.getSession(r)
+	token, _ := sess.Values[types.AccessTokenKey].(string)
+	if user := getAuthenticatedUser(r); user.IsLoggedIn {
+		s.recordAudit(r, types.AuditLogout, user.ID, nil)
+	}
+	s.signOut(r, token, sb.ScopeLocal)
+	if imp, ok := s.impersonation(r); ok {
+		s.signOut(r, imp.AccessToken, sb.ScopeLocal)
+		if err := s.recordImpersonationStop(r, imp, "logout"); err != nil {
+			slog.Error("recording audit event failed", "action", types.AuditImpersonationStop, "user", imp.UserID, "err", err)
+		}
+	}
+
+	sess.Options.MaxAge = -1
 	if err := sess.Save(r, w); err != nil {
 		return err
 	}
@@ -130,8 +274,7 @@ func (s *Server) HandleLogoutPost(w http.ResponseWriter, r *http.Request) error
 }
 
 func (s *Server) HandleUpdatePasswordPut(w http.ResponseWriter, r *http.Request) error {
-	store := sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
-	sess, _ := store.Get(r, types.UserContextKey)
+	sess, _ := s.getSession(r)
 	token, ok := sess.Values[types.AccessTokenKey]
 	if !ok {
 		return hxRedirect(w, r, "/")
@@ -150,7 +293,7 @@ func (s *Server) HandleUpdatePasswordPut(w http.ResponseWriter, r *http.Request)
 		return render(r, w, auth.ResetPasswordForm(pwdVal, pwdErr))
 	}
 
-	u, err := sb.Client.Auth.UpdateUser(r.Context(), token.(string), map[string]interface{}{
+	u, err := s.auth.UpdateUser(r.Context(), token.(string), map[string]interface{}{
 		"password": pwdVal.Password,
 	})
 	if err != nil {
@@ -159,28 +302,118 @@ func (s *Server) HandleUpdatePasswordPut(w http.ResponseWriter, r *http.Request)
 	}
 	pwdVal.Success = true
 	slog.Info("account password updated", "user", u.Email)
+	s.recordAudit(r, types.AuditPasswordChanged, getAuthenticatedUser(r).ID, nil)
 
 	return render(r, w, auth.ResetPasswordForm(pwdVal, pwdErr))
 }
 
-func (s *Server) HandleLoginWithGoogle(w http.ResponseWriter, r *http.Request) error {
-	resp, err := sb.Client.Auth.SignInWithProvider(supabase.ProviderSignInOptions{
-		Provider:   "google",
-		RedirectTo: os.Getenv("GOOGLE_LOGIN_CALLBACK_URL"),
+func (s *Server) HandleForgotPasswordIndex(w http.ResponseWriter, r *http.Request) error {
+	return render(r, w, auth.ForgotPassword(r.URL.Query().Get("email")))
+}
+
+func (s *Server) HandleForgotPasswordPost(w http.ResponseWriter, r *http.Request) error {
+	params := auth.ForgotPasswordParams{
+		Email: r.FormValue("email"),
+	}
+
+	var errors auth.ForgotPasswordErrors
+	if ok := validate.New(&params, validate.Fields{
+		"Email": validate.Rules(validate.Email, validate.Required),
+	}).Validate(&errors); !ok {
+		return render(r, w, auth.ForgotPasswordForm(params, errors))
+	}
+
+	// The outcome is not disclosed, so the form cannot be used to find out
+	// which emails are registered.
+	opts, err := s.startEmailFlow(w, r, os.Getenv("PASSWORD_RECOVERY_CALLBACK_URL"), "/settings/account/reset-password")
+	if err != nil {
+		return err
+	}
+	if err := s.auth.ResetPasswordForEmail(r.Context(), params.Email, opts); err != nil {
+		slog.Error("reset password for email failed", "err", err)
+	}
+	params.Success = true
+
+	return render(r, w, auth.ForgotPasswordForm(params, errors))
+}
+
+func (s *Server) HandleLoginWithProvider(w http.ResponseWriter, r *http.Request) error {
+	provider, ok := s.oauthProvider(chi.URLParam(r, "provider"))
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return err
+	}
+	redirectTo, err := withState(provider.RedirectTo, state)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.auth.SignInWithProvider(supabase.ProviderSignInOptions{
+		Provider:   provider.Name,
+		RedirectTo: redirectTo,
+		Scopes:     provider.Scopes,
+		FlowType:   supabase.PKCE,
 	})
 	if err != nil {
 		return err
 	}
 
+	if err := s.saveAuthFlow(w, r, authFlow{Verifier: resp.CodeVerifier, State: state, Next: "/"}); err != nil {
+		return err
+	}
+
 	return hxRedirect(w, r, resp.URL)
 }
 
-func setAuthCookie(w http.ResponseWriter, r *http.Request, accessToken string) error {
-	store := sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
-	sess, _ := store.Get(r, types.UserContextKey)
-	sess.Values[types.AccessTokenKey] = accessToken
-	if err := sess.Save(r, w); err != nil {
-		return err
+// setAuthCookie stores the tokens in the session. The session id is rotated
+// whenever a different user signs in, so an id planted before login cannot
+// be used to ride the authenticated session.
+func (s *Server) setAuthCookie(w http.ResponseWriter, r *http.Request, details *supabase.AuthenticatedDetails) error {
+	sess, _ := s.getSession(r)
+	if imp, ok := sess.Values[types.ImpersonationKey].(impersonation); ok {
+		if imp.UserID == details.User.ID {
+			return s.saveTokens(w, r, details)
+		}
+		// A login of its own ends the impersonation.
+		delete(sess.Values, types.ImpersonationKey)
+		if err := s.recordImpersonationStop(r, imp, "login"); err != nil {
+			slog.Error("recording audit event failed", "action", types.AuditImpersonationStop, "user", imp.UserID, "err", err)
+		}
+	}
+	if userID, _ := sess.Values[types.UserIDKey].(string); userID != details.User.ID {
+		if err := s.sessions.Regenerate(r.Context(), sess); err != nil {
+			return err
+		}
+		sess.Values[types.UserIDKey] = details.User.ID
+		id, err := uuid.Parse(details.User.ID)
+		if err != nil {
+			return err
+		}
+		if err := s.cancelAccountDeletion(r, id); err != nil {
+			return err
+		}
+		s.recordAudit(r, types.AuditLoginSucceeded, id, map[string]string{"path": r.URL.Path})
+		s.checkDevice(r, details.User)
+	}
+
+	return s.saveTokens(w, r, details)
+}
+
+// saveTokens stores the tokens of details in the session as they are, the
+// session keeps its owner.
+func (s *Server) saveTokens(w http.ResponseWriter, r *http.Request, details *supabase.AuthenticatedDetails) error {
+	sess, _ := s.getSession(r)
+	sess.Values[types.AccessTokenKey] = details.AccessToken
+	sess.Values[types.RefreshTokenKey] = details.RefreshToken
+	if details.ExpiresIn > 0 {
+		sess.Values[types.ExpiresAtKey] = time.Now().Add(time.Duration(details.ExpiresIn) * time.Second).Unix()
+	} else {
+		delete(sess.Values, types.ExpiresAtKey)
 	}
 
 	return sess.Save(r, w)
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"dreampicai/cmd/web/view/auth"
+)
+
+// resendInterval is the least time between two confirmation emails to the
+// same user. Supabase limits emails as well, this keeps one user from using
+// up the quota.
+const resendInterval = time.Minute
+
+// HandleConfirmEmailIndex is where users land until they confirm their
+// email.
+func (s *Server) HandleConfirmEmailIndex(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	if !user.IsLoggedIn {
+		return hxRedirect(w, r, "/login")
+	}
+	if user.EmailConfirmed {
+		return hxRedirect(w, r, "/")
+	}
+
+	return render(r, w, auth.ConfirmEmail(user.Email))
+}
+
+func (s *Server) HandleConfirmEmailResendPost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	if !user.IsLoggedIn || user.EmailConfirmed {
+		return hxRedirect(w, r, "/")
+	}
+
+	if wait := s.resends.Allow(user.ID.String()); wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		return render(r, w, auth.ConfirmEmailResend(fmt.Sprintf("Please wait %d seconds before asking again.", seconds)))
+	}
+
+	opts, err := s.startEmailFlow(w, r, os.Getenv("SIGNUP_CALLBACK_URL"), "/")
+	if err != nil {
+		return err
+	}
+	if err := s.auth.ResendConfirmation(r.Context(), user.Email, opts); err != nil {
+		slog.Error("resending confirmation email failed", "user", user.ID, "err", err)
+		return render(r, w, auth.ConfirmEmailResend("The email could not be sent, please try again later."))
+	}
+
+	return render(r, w, auth.ConfirmEmailResend("We sent the email again."))
+}
+
+// throttle allows an action once per interval for each key. The state is
+// kept per instance.
+type throttle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	return &throttle{interval: interval, last: map[string]time.Time{}}
+}
+
+// Allow returns how long until key is allowed again, or zero after
+// recording the use when it is allowed now.
+func (t *throttle) Allow(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for k, last := range t.last {
+		if now.Sub(last) >= t.interval {
+			delete(t.last, k)
+		}
+	}
+	if last, ok := t.last[key]; ok {
+		return t.interval - now.Sub(last)
+	}
+	t.last[key] = now
+
+	return 0
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"dreampicai/types"
+)
+
+const (
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+// WithCSRF keeps a synchronizer token in the session and rejects state
+// changing requests that do not send it back, either in the X-CSRF-Token
+// header set by htmx or in the csrf_token form field. The token, and the
+// session holding it, are only created once a page asks for it, so
+// requests that render no form leave no session behind.
+func (s *Server) WithCSRF(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/public") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Browsers never send a bearer token on their own, and the API
+		// ignores cookies, there is no session to ride on.
+		if _, ok := bearerToken(r); ok || isAPI(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sess, _ := s.getSession(r)
+		token, _ := sess.Values[types.CSRFTokenKey].(string)
+		if !isSafeMethod(r.Method) {
+			sent := r.Header.Get(csrfHeader)
+			if len(sent) == 0 {
+				sent = r.PostFormValue(csrfFormField)
+			}
+			if len(token) == 0 || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				slog.Warn("csrf token mismatch", "path", r.URL.Path, "method", r.Method)
+				rejectCSRF(w, r)
+				return
+			}
+		}
+
+		// Pages are rendered to a buffer before being written, the cookie
+		// set here still goes out with them.
+		var once sync.Once
+		lazy := func() string {
+			once.Do(func() {
+				if len(token) > 0 {
+					return
+				}
+				created, err := randomToken()
+				if err != nil {
+					slog.Error("csrf token generation failed", "err", err)
+					return
+				}
+				sess.Values[types.CSRFTokenKey] = created
+				if err := sess.Save(r, w); err != nil {
+					slog.Error("saving csrf token failed", "err", err)
+					return
+				}
+				token = created
+			})
+			return token
+		}
+
+		ctx := context.WithValue(r.Context(), types.CSRFTokenKey, lazy)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
+
+// rejectCSRF answers htmx requests with a toast appended to the page, so
+// the form being submitted is left untouched.
+func rejectCSRF(w http.ResponseWriter, r *http.Request) {
+	rejectWithToast(w, r, "Your session has expired, please reload the page and try again.")
+}
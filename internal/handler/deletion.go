@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"dreampicai/cmd/web/view/settings"
+	"dreampicai/pkg/kit/validate"
+	"dreampicai/types"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultDeletionGracePeriod = 7 * 24 * time.Hour
+	accountPurgeInterval       = time.Hour
+)
+
+// deletionGracePeriod is how long a deleted account can be restored by
+// logging in again, from ACCOUNT_DELETION_GRACE_PERIOD. Zero deletes right
+// away.
+func deletionGracePeriod() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"))
+	if err != nil || d < 0 {
+		return defaultDeletionGracePeriod
+	}
+
+	return d
+}
+
+// HandleAccountDeletePost schedules the deletion of the account and logs the
+// user out everywhere.
+func (s *Server) HandleAccountDeletePost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	params := settings.DeleteAccountParams{
+		Username: r.FormValue("username"),
+		Password: r.FormValue("password"),
+	}
+
+	var errors settings.DeleteAccountErrors
+	if ok := validate.New(&params, validate.Fields{
+		"Username": validate.Rules(validate.Required),
+	}).Validate(&errors); !ok {
+		return render(r, w, settings.DeleteAccountForm(params, errors))
+	}
+	if params.Username != user.Account.Username {
+		return render(r, w, settings.DeleteAccountForm(params, settings.DeleteAccountErrors{
+			Username: "Type your username to confirm.",
+		}))
+	}
+	msg, err := s.reauthenticate(w, r, user, params.Password)
+	if err != nil {
+		return err
+	}
+	if len(msg) > 0 {
+		return render(r, w, settings.DeleteAccountForm(params, settings.DeleteAccountErrors{
+			Password: msg,
+		}))
+	}
+
+	deletion := &types.AccountDeletion{
+		UserID:      user.ID,
+		Username:    user.Account.Username,
+		DeleteAfter: time.Now().Add(deletionGracePeriod()),
+	}
+	if err := s.db.CreateAccountDeletion(r.Context(), deletion); err != nil {
+		return err
+	}
+	slog.Info("account deletion requested", "user", user.ID, "after", deletion.DeleteAfter)
+	s.recordAudit(r, types.AuditAccountDeletionRequested, user.ID, map[string]string{"delete_after": deletion.DeleteAfter.Format(time.RFC3339)})
+
+	if err := s.logoutEverywhere(r, user.ID); err != nil {
+		return err
+	}
+	sess, _ := s.getSession(r)
+	sess.Options.MaxAge = -1
+	if err := sess.Save(r, w); err != nil {
+		return err
+	}
+
+	if !deletion.DeleteAfter.After(time.Now()) {
+		if err := s.deleteAccount(r.Context(), deletion); err != nil {
+			return err
+		}
+	}
+
+	return render(r, w, settings.AccountDeleted(deletion.DeleteAfter, deletionGracePeriod() > 0))
+}
+
+// cancelAccountDeletion keeps the account of a user logging in during the
+// grace period.
+func (s *Server) cancelAccountDeletion(r *http.Request, userID uuid.UUID) error {
+	cancelled, err := s.db.CancelAccountDeletion(r.Context(), userID.String())
+	if err != nil {
+		return err
+	}
+	if cancelled {
+		slog.Info("account deletion cancelled by login", "user", userID)
+		s.recordAudit(r, types.AuditAccountDeletionCancelled, userID, nil)
+	}
+
+	return nil
+}
+
+// deleteAccount removes the auth user first, so a failure on either side
+// leaves the deletion pending and it is retried.
+func (s *Server) deleteAccount(ctx context.Context, deletion *types.AccountDeletion) error {
+	if err := s.auth.DeleteUser(ctx, deletion.UserID.String()); err != nil {
+		return err
+	}
+	if err := s.db.DeleteAccount(ctx, deletion); err != nil {
+		return err
+	}
+	slog.Info("account deleted", "user", deletion.UserID, "requested", deletion.RequestedAt)
+	if err := s.audit.RecordBackground(ctx, types.AuditEvent{
+		Action:   types.AuditAccountDeletionPurged,
+		UserID:   deletion.UserID,
+		Metadata: map[string]string{"username": deletion.Username},
+	}); err != nil {
+		slog.Error("recording audit event failed", "action", types.AuditAccountDeletionPurged, "user", deletion.UserID, "err", err)
+	}
+
+	return nil
+}
+
+// purgeAccounts deletes the accounts whose grace period ended.
+func (s *Server) purgeAccounts(ctx context.Context) {
+	deletions, err := s.db.GetDueAccountDeletions(ctx, time.Now())
+	if err != nil {
+		slog.Error("loading due account deletions failed", "err", err)
+		return
+	}
+	for i := range deletions {
+		if err := s.deleteAccount(ctx, &deletions[i]); err != nil {
+			slog.Error("account deletion failed", "user", deletions[i].UserID, "err", err)
+		}
+	}
+}
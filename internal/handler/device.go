@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"dreampicai/cmd/web/view"
+	"dreampicai/cmd/web/view/auth"
+	"dreampicai/internal/session"
+	"dreampicai/pkg/mail"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nedpals/supabase-go"
+)
+
+// secureLinkTTL is how long the "this wasn't me" link of a new device alert
+// works.
+const secureLinkTTL = 7 * 24 * time.Hour
+
+// newDeviceAlert is what the user is told about a login from a new device.
+type newDeviceAlert struct {
+	UserID   uuid.UUID
+	Email    string
+	Time     time.Time
+	Location string
+	IP       string
+	Device   string
+	Link     string
+}
+
+// checkDevice remembers the browser and address the user logs in from, and
+// mails them when the account has not been used from there before. The
+// first device of an account is remembered without an alert. The login goes
+// on when it fails.
+func (s *Server) checkDevice(r *http.Request, user supabase.User) {
+	userID, err := uuid.Parse(user.ID)
+	if err != nil {
+		return
+	}
+	known, err := s.db.CountKnownDevices(r.Context(), user.ID)
+	if err != nil {
+		slog.Error("counting known devices failed", "user", user.ID, "err", err)
+		return
+	}
+
+	device := &types.KnownDevice{
+		UserID:      userID,
+		Fingerprint: deviceFingerprint(r),
+		LastSeenAt:  time.Now(),
+	}
+	var token string
+	if known > 0 {
+		if token, err = randomToken(); err != nil {
+			slog.Error("creating secure link failed", "user", user.ID, "err", err)
+			return
+		}
+		device.RevokeToken = hashToken(token)
+	}
+	isNew, err := s.db.RememberDevice(r.Context(), device)
+	if err != nil {
+		slog.Error("remembering device failed", "user", user.ID, "err", err)
+		return
+	}
+	if !isNew || known == 0 {
+		return
+	}
+
+	go s.sendNewDeviceAlert(newDeviceAlert{
+		UserID:   userID,
+		Email:    user.Email,
+		Time:     device.LastSeenAt,
+		Location: approximateLocation(r),
+		IP:       session.ClientIP(r),
+		Device:   view.DeviceName(r.UserAgent()),
+		Link:     appURL() + "/account/secure/" + token,
+	})
+}
+
+func (s *Server) sendNewDeviceAlert(alert newDeviceAlert) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := s.mailer.Send(ctx, mail.Message{
+		To:      alert.Email,
+		Subject: "New login to your dreampicai account",
+		Body: fmt.Sprintf("Your account was just logged into from a device we have not seen before.\n\nTime: %s\nLocation: %s (%s)\nBrowser: %s\n\nIf this was you, there is nothing to do. If it wasn't, open this link within %d days to log out everywhere and reset your password:\n\n%s\n",
+			alert.Time.Format(time.RFC1123), alert.Location, alert.IP, alert.Device, int(secureLinkTTL.Hours()/24), alert.Link),
+	}); err != nil {
+		slog.Error("sending new device alert failed", "user", alert.UserID, "err", err)
+	}
+}
+
+// deviceFingerprint identifies the browser by its name rather than its full
+// user agent, so browser updates do not look like new devices.
+func deviceFingerprint(r *http.Request) string {
+	return hashToken(view.DeviceName(r.UserAgent()) + "\x00" + session.ClientIP(r))
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// approximateLocation reads where the request comes from off the headers
+// listed in LOCATION_HEADERS, most precise first, e.g.
+// "CF-IPCity,CF-IPCountry" behind Cloudflare. They are set by the proxy in
+// front of the application, there is no lookup of our own.
+func approximateLocation(r *http.Request) string {
+	var parts []string
+	for _, name := range strings.Split(os.Getenv("LOCATION_HEADERS"), ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if v := strings.TrimSpace(r.Header.Get(name)); len(v) > 0 {
+			parts = append(parts, v)
+		}
+	}
+	if len(parts) == 0 {
+		return "Unknown location"
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// secureDevice looks up the device of a "this wasn't me" link.
+func (s *Server) secureDevice(r *http.Request) (types.KnownDevice, bool, error) {
+	device, err := s.db.GetKnownDeviceByRevokeToken(r.Context(), hashToken(chi.URLParam(r, "token")))
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.KnownDevice{}, false, nil
+	}
+	if err != nil {
+		return types.KnownDevice{}, false, err
+	}
+
+	return device, time.Since(device.CreatedAt) < secureLinkTTL, nil
+}
+
+// HandleSecureAccountIndex asks to confirm, the link is opened from an email
+// and may be fetched by mail scanners.
+func (s *Server) HandleSecureAccountIndex(w http.ResponseWriter, r *http.Request) error {
+	_, ok, err := s.secureDevice(r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return render(r, w, auth.SecureAccountInvalid())
+	}
+
+	return render(r, w, auth.SecureAccount(chi.URLParam(r, "token")))
+}
+
+// HandleSecureAccountPost locks out whoever logged in from the new device.
+// The password is replaced with a random one and every session is revoked,
+// then a reset link is mailed to the user, bound to the browser they opened
+// the alert in.
+func (s *Server) HandleSecureAccountPost(w http.ResponseWriter, r *http.Request) error {
+	device, ok, err := s.secureDevice(r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return render(r, w, auth.SecureAccountInvalid())
+	}
+	userID := device.UserID.String()
+
+	identity, err := s.auth.GetUser(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	details, err := s.auth.SignInAsUser(r.Context(), userID)
+	if err != nil {
+		return err
+	}
+	password, err := randomToken()
+	if err != nil {
+		return err
+	}
+	if _, err := s.auth.UpdateUser(r.Context(), details.AccessToken, map[string]interface{}{"password": password}); err != nil {
+		return err
+	}
+	if err := s.logoutEverywhere(r, device.UserID); err != nil {
+		return err
+	}
+	// The device is forgotten, logging in from it again alerts again.
+	if err := s.db.DeleteKnownDevice(r.Context(), device.ID); err != nil {
+		return err
+	}
+	s.recordAudit(r, types.AuditAccountSecured, device.UserID, nil)
+	slog.Info("account secured from new device alert", "user", userID)
+
+	// The session of this browser may be the user's, it must not be saved
+	// back with their tokens.
+	sess, _ := s.getSession(r)
+	if owner, _ := sess.Values[types.UserIDKey].(string); owner == userID {
+		for _, key := range []string{types.UserIDKey, types.AccessTokenKey, types.RefreshTokenKey, types.ExpiresAtKey, types.ImpersonationKey} {
+			delete(sess.Values, key)
+		}
+		if err := s.sessions.Regenerate(r.Context(), sess); err != nil {
+			return err
+		}
+	}
+	opts, err := s.startEmailFlow(w, r, os.Getenv("PASSWORD_RECOVERY_CALLBACK_URL"), "/settings/account/reset-password")
+	if err != nil {
+		return err
+	}
+	if err := s.auth.ResetPasswordForEmail(r.Context(), identity.Email, opts); err != nil {
+		slog.Error("reset password for email failed", "err", err)
+	}
+
+	return render(r, w, auth.AccountSecured(identity.Email))
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"dreampicai/cmd/web/view/settings"
+	"dreampicai/internal/takeout"
+	"dreampicai/pkg/mail"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nedpals/supabase-go"
+)
+
+const (
+	defaultExportTTL    = 48 * time.Hour
+	exportTimeout       = 10 * time.Minute
+	exportPurgeInterval = time.Hour
+)
+
+// exportTTL is how long an archive can be downloaded, from DATA_EXPORT_TTL.
+func exportTTL() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("DATA_EXPORT_TTL"))
+	if err != nil || d <= 0 {
+		return defaultExportTTL
+	}
+
+	return d
+}
+
+// appURL is where links in emails point to, from APP_URL.
+func appURL() string {
+	if u := os.Getenv("APP_URL"); len(u) > 0 {
+		return u
+	}
+
+	return fmt.Sprintf("http://localhost:%s", os.Getenv("PORT"))
+}
+
+func (s *Server) HandleExportsIndex(w http.ResponseWriter, r *http.Request) error {
+	return s.renderExports(w, r)
+}
+
+// HandleExportPost starts building an archive of the user's data. It is
+// built in the background and the user is mailed once it is ready.
+func (s *Server) HandleExportPost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	exports, err := s.exports(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	for _, e := range exports {
+		if e.Status == types.ExportPending {
+			return s.renderExports(w, r)
+		}
+	}
+
+	identity, err := s.identity(r)
+	if err != nil {
+		return err
+	}
+
+	downloadToken, err := randomToken()
+	if err != nil {
+		return err
+	}
+	export := types.DataExport{
+		UserID:    user.ID,
+		Token:     downloadToken,
+		Status:    types.ExportPending,
+		ExpiresAt: time.Now().Add(exportTTL()),
+	}
+	if err := s.db.CreateDataExport(r.Context(), &export); err != nil {
+		return err
+	}
+	slog.Info("data export requested", "user", user.ID)
+	go s.buildExport(export, *identity)
+
+	return s.renderExports(w, r)
+}
+
+// identity fetches the user from the auth backend. Requests made with a
+// personal access token have no session token to ask with, they are looked
+// up by ID.
+func (s *Server) identity(r *http.Request) (*supabase.User, error) {
+	if user := getAuthenticatedUser(r); user.ViaToken() {
+		return s.auth.GetUser(r.Context(), user.ID.String())
+	}
+	sess, _ := s.getSession(r)
+	token, _ := sess.Values[types.AccessTokenKey].(string)
+
+	return s.auth.User(r.Context(), token)
+}
+
+func (s *Server) buildExport(export types.DataExport, identity supabase.User) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	archive, err := takeout.Build(ctx, s.db, identity)
+	if err != nil {
+		slog.Error("building data export failed", "user", export.UserID, "err", err)
+		export.Status = types.ExportFailed
+		if err := s.db.UpdateDataExport(ctx, &export); err != nil {
+			slog.Error("updating data export failed", "err", err)
+		}
+		return
+	}
+
+	export.Status = types.ExportReady
+	export.Archive = archive
+	export.ReadyAt = time.Now()
+	if err := s.db.UpdateDataExport(ctx, &export); err != nil {
+		slog.Error("updating data export failed", "err", err)
+		return
+	}
+
+	if err := s.mailer.Send(ctx, mail.Message{
+		To:      identity.Email,
+		Subject: "Your dreampicai data export is ready",
+		Body: fmt.Sprintf("The archive of your data is ready to download until %s:\n\n%s/settings/exports/%s\n\nYou need to be logged in to download it.\n",
+			export.ExpiresAt.Format(time.RFC1123), appURL(), export.Token),
+	}); err != nil {
+		slog.Error("sending data export email failed", "user", export.UserID, "err", err)
+	}
+}
+
+func (s *Server) HandleExportDownload(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	export, err := s.db.GetDataExport(r.Context(), chi.URLParam(r, "token"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err != nil || export.UserID != user.ID || export.Status != types.ExportReady || time.Now().After(export.ExpiresAt) {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="dreampicai-export-%s.zip"`, export.ReadyAt.Format("2006-01-02")))
+	_, err = w.Write(export.Archive)
+
+	return err
+}
+
+func (s *Server) renderExports(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	exports, err := s.exports(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+
+	return render(r, w, settings.DataExports(exports))
+}
+
+// exports returns the exports of the user that can still be downloaded.
+// Exports pending for longer than a build may take were lost, e.g. to a
+// restart, and are marked failed so the user can ask again.
+func (s *Server) exports(ctx context.Context, userID uuid.UUID) ([]types.DataExport, error) {
+	all, err := s.db.GetDataExportsByUserID(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	exports := all[:0]
+	for _, e := range all {
+		if e.Status == types.ExportPending && time.Since(e.CreatedAt) > exportTimeout+time.Minute {
+			e.Status = types.ExportFailed
+			if err := s.db.UpdateDataExport(ctx, &e); err != nil {
+				return nil, err
+			}
+			slog.Warn("stale data export marked failed", "user", userID, "requested", e.CreatedAt)
+		}
+		if time.Now().Before(e.ExpiresAt) {
+			exports = append(exports, e)
+		}
+	}
+
+	return exports, nil
+}
+
+func (s *Server) purgeExports(ctx context.Context) {
+	n, err := s.db.DeleteExpiredDataExports(ctx, time.Now())
+	if err != nil {
+		slog.Error("deleting expired data exports failed", "err", err)
+		return
+	}
+	if n > 0 {
+		slog.Info("expired data exports deleted", "count", n)
+	}
+}
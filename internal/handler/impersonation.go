@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dreampicai/cmd/web/view/admin"
+	"dreampicai/pkg/sb"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// impersonation is an admin acting as a user. The admin's tokens are set
+// aside in the server side session, the session itself stays the admin's.
+type impersonation struct {
+	AdminID      string
+	AdminEmail   string
+	AccessToken  string
+	RefreshToken string
+	ExpiresAt    int64
+	UserID       string
+	AccountID    int
+	StartedAt    time.Time
+}
+
+func init() {
+	gob.Register(impersonation{})
+}
+
+func (s *Server) impersonation(r *http.Request) (impersonation, bool) {
+	sess, _ := s.getSession(r)
+	imp, ok := sess.Values[types.ImpersonationKey].(impersonation)
+
+	return imp, ok
+}
+
+func (s *Server) HandleImpersonatePost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	if len(user.Impersonator) > 0 {
+		forbidden(w, r)
+		return nil
+	}
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	account, err := s.db.GetAccountByID(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	refuse := func(msg string) error {
+		details, err := s.adminAccount(r)
+		if err != nil {
+			return err
+		}
+		return render(r, w, admin.AccountDetail(details, admin.Notice{Message: msg, Error: true}))
+	}
+	if account.UserID == user.ID {
+		return refuse("You cannot impersonate yourself.")
+	}
+	if account.Disabled() {
+		return refuse("Disabled accounts cannot be impersonated.")
+	}
+	// Support staff must not gain more than they have by acting as an admin.
+	role, err := s.db.GetRole(r.Context(), account.Role)
+	if err != nil {
+		return err
+	}
+	if role.Has(types.PermissionAdminAccess) {
+		return refuse("Admins cannot be impersonated.")
+	}
+
+	details, err := s.auth.SignInAsUser(r.Context(), account.UserID.String())
+	if err != nil {
+		return err
+	}
+
+	sess, _ := s.getSession(r)
+	imp := impersonation{
+		AdminID:    user.ID.String(),
+		AdminEmail: user.Email,
+		UserID:     account.UserID.String(),
+		AccountID:  account.ID,
+		StartedAt:  time.Now(),
+	}
+	imp.AccessToken, _ = sess.Values[types.AccessTokenKey].(string)
+	imp.RefreshToken, _ = sess.Values[types.RefreshTokenKey].(string)
+	imp.ExpiresAt, _ = sess.Values[types.ExpiresAtKey].(int64)
+
+	// The audit entry is written first, no impersonation goes unrecorded.
+	if err := s.audit.Record(r, types.AuditEvent{
+		Action:   types.AuditImpersonationStart,
+		ActorID:  user.ID,
+		UserID:   account.UserID,
+		Metadata: map[string]string{"username": account.Username},
+	}); err != nil {
+		s.signOut(r, details.AccessToken, sb.ScopeLocal)
+		return err
+	}
+	slog.Warn("impersonation started", "admin", user.ID, "user", account.UserID)
+
+	sess.Values[types.ImpersonationKey] = imp
+	if err := s.saveTokens(w, r, details); err != nil {
+		return err
+	}
+
+	return hxRedirect(w, r, "/")
+}
+
+// HandleImpersonationStopPost gives the admin their own login back.
+func (s *Server) HandleImpersonationStopPost(w http.ResponseWriter, r *http.Request) error {
+	imp, ok := s.impersonation(r)
+	if !ok {
+		return hxRedirect(w, r, "/")
+	}
+
+	sess, _ := s.getSession(r)
+	token, _ := sess.Values[types.AccessTokenKey].(string)
+	s.signOut(r, token, sb.ScopeLocal)
+
+	delete(sess.Values, types.ImpersonationKey)
+	sess.Values[types.AccessTokenKey] = imp.AccessToken
+	sess.Values[types.RefreshTokenKey] = imp.RefreshToken
+	if imp.ExpiresAt > 0 {
+		sess.Values[types.ExpiresAtKey] = imp.ExpiresAt
+	} else {
+		delete(sess.Values, types.ExpiresAtKey)
+	}
+	if err := sess.Save(r, w); err != nil {
+		return err
+	}
+
+	if err := s.recordImpersonationStop(r, imp, "stop"); err != nil {
+		return err
+	}
+
+	return hxRedirect(w, r, fmt.Sprintf("/admin/accounts/%d", imp.AccountID))
+}
+
+// recordImpersonationStop records the end of the impersonation, whether the
+// admin stopped it, logged out or logged in as someone else.
+func (s *Server) recordImpersonationStop(r *http.Request, imp impersonation, ended string) error {
+	adminID, _ := uuid.Parse(imp.AdminID)
+	userID, _ := uuid.Parse(imp.UserID)
+	if err := s.audit.Record(r, types.AuditEvent{
+		Action:  types.AuditImpersonationStop,
+		ActorID: adminID,
+		UserID:  userID,
+		Metadata: map[string]string{
+			"admin":    imp.AdminEmail,
+			"duration": time.Since(imp.StartedAt).Round(time.Second).String(),
+			"ended":    ended,
+		},
+	}); err != nil {
+		return err
+	}
+	slog.Warn("impersonation stopped", "admin", imp.AdminID, "user", imp.UserID, "ended", ended)
+
+	return nil
+}
+
+// DenyImpersonation refuses requests made while impersonating, for actions
+// only the user themselves may take.
+func DenyImpersonation(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if user := getAuthenticatedUser(r); len(user.Impersonator) > 0 {
+			slog.Warn("action denied while impersonating", "admin", user.Impersonator, "user", user.ID, "path", r.URL.Path)
+			rejectWithToast(w, r, "This is not available while impersonating.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -4,20 +4,19 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
-	"os"
+	"slices"
 	"strings"
+	"time"
 
-	"dreampicai/internal/database"
-	"dreampicai/pkg/sb"
 	"dreampicai/types"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
 )
 
-func RedirectIfAccountExists(next http.Handler) http.Handler {
+func (s *Server) RedirectIfAccountExists(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.Contains(r.URL.Path, "/public") {
 			next.ServeHTTP(w, r)
@@ -26,14 +25,14 @@ func RedirectIfAccountExists(next http.Handler) http.Handler {
 
 		user := getAuthenticatedUser(r)
 		if user.IsLoggedIn {
-			account, err := database.GetInstance().GetAccountByUserID(r.Context(), user.ID.String())
+			account, err := s.db.GetAccountByUserID(r.Context(), user.ID.String())
 			if err != nil && !errors.Is(err, sql.ErrNoRows) {
 				slog.Error("Error fetching account", "err", err)
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
 
-			if len(account.UserID.String()) > 0 {
+			if account.UserID != uuid.Nil {
 				http.Redirect(w, r, "/", http.StatusSeeOther)
 				return
 			}
@@ -43,27 +42,27 @@ func RedirectIfAccountExists(next http.Handler) http.Handler {
 	})
 }
 
-func WithAccount(next http.Handler) http.Handler {
+func (s *Server) WithAccount(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		if strings.Contains(r.URL.Path, "/public") {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		user := getAuthenticatedUser(r)
-		account, err := database.GetInstance().GetAccountByUserID(r.Context(), user.ID.String())
+		user, err := s.loadAccount(r.Context(), getAuthenticatedUser(r))
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Redirect(w, r, "/account/setup", http.StatusSeeOther)
+			return
+		}
 		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				http.Redirect(w, r, "/account/setup", http.StatusSeeOther)
-				return
-			}
-			const errMsg = "could not fetch account data"
-			slog.Error(errMsg, "err", err)
-			http.Error(w, errMsg, http.StatusInternalServerError)
+			slog.Error("could not fetch account data", "err", err)
+			http.Error(w, "could not fetch account data", http.StatusInternalServerError)
+			return
+		}
+		if user.Account.Disabled() {
+			hxRedirect(w, r, "/account/disabled")
 			return
 		}
-		user.Account = account
-		slog.Info("account", "data", user)
 
 		ctx := context.WithValue(r.Context(), types.UserContextKey, user)
 		next.ServeHTTP(w, r.WithContext(ctx))
@@ -72,6 +71,66 @@ func WithAccount(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// loadAccount adds the account of the user and the permissions of its role.
+// It fails with sql.ErrNoRows until the user sets the account up.
+func (s *Server) loadAccount(ctx context.Context, user types.AuthenticatedUser) (types.AuthenticatedUser, error) {
+	account, err := s.db.GetAccountByUserID(ctx, user.ID.String())
+	if err != nil {
+		return user, err
+	}
+	user.Account = account
+	role, err := s.db.GetRole(ctx, account.Role)
+	if err != nil {
+		return user, fmt.Errorf("fetching role %q: %w", account.Role, err)
+	}
+	user.Permissions = role.Permissions
+	slog.Info("account", "data", user)
+
+	return user, nil
+}
+
+// RequirePermission refuses requests from users lacking any of perms. It
+// goes after WithAccount, which loads the permissions.
+func RequirePermission(perms ...types.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			user := getAuthenticatedUser(r)
+			if !user.Can(perms...) {
+				slog.Warn("permission denied", "user", user.ID, "path", r.URL.Path, "required", perms)
+				forbidden(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// AllowTokens lets personal access tokens with all of scopes call the
+// route, any token when there are none. Every other route refuses them, see
+// MakeHandler. Browser sessions are not affected.
+func AllowTokens(scopes ...types.TokenScope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			user := getAuthenticatedUser(r)
+			for _, scope := range scopes {
+				if user.ViaToken() && !slices.Contains(user.Scopes, scope) {
+					slog.Warn("token scope denied", "user", user.ID, "token", user.TokenID, "path", r.URL.Path, "required", scope)
+					forbidden(w, r)
+					return
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), types.TokenScopeKey, true)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
 func WithAuth(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		if strings.Contains(r.URL.Path, "/public") {
@@ -84,6 +143,10 @@ func WithAuth(next http.Handler) http.Handler {
 			hxRedirect(w, r, "/login")
 			return
 		}
+		if !user.EmailConfirmed {
+			hxRedirect(w, r, "/confirm-email")
+			return
+		}
 
 		next.ServeHTTP(w, r)
 	}
@@ -91,35 +154,81 @@ func WithAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
-func WithUser(next http.Handler) http.Handler {
+func (s *Server) WithUser(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		if strings.Contains(r.URL.Path, "/public") {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		store := sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
-		sess, err := store.Get(r, types.UserContextKey)
+		// Scripts send a personal access token instead of the session cookie.
+		if raw, ok := bearerToken(r); ok {
+			user, err := s.userFromPersonalToken(r.Context(), raw)
+			if errors.Is(err, errInvalidPersonalToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				unauthorized(w, r, "Invalid or expired token.")
+				return
+			}
+			if errors.Is(err, errAccountDisabled) {
+				if isAPI(r) {
+					writeAPIError(w, http.StatusForbidden, "account_disabled", "The account is disabled.")
+					return
+				}
+				rejectWithToast(w, r, "The account is disabled.")
+				return
+			}
+			if err != nil {
+				slog.Error("personal access token lookup failed", "err", err)
+				internalError(w, r)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), types.UserContextKey, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		// The API is for scripts, it ignores the session cookie a browser
+		// would send along.
+		if isAPI(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sess, err := s.getSession(r)
 		if err != nil || len(sess.Values) == 0 {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		accessToken, ok := sess.Values[types.AccessTokenKey]
-		if !ok {
+		accessToken, ok := sess.Values[types.AccessTokenKey].(string)
+		if !ok || len(accessToken) == 0 {
 			next.ServeHTTP(w, r)
+			return
+		}
+
+		refreshToken, _ := sess.Values[types.RefreshTokenKey].(string)
+		expiresAt, ok := sess.Values[types.ExpiresAtKey].(int64)
+		if ok && len(refreshToken) > 0 && time.Until(time.Unix(expiresAt, 0)) < refreshThreshold {
+			details, err := s.refresher.Refresh(r.Context(), accessToken, refreshToken)
+			if err != nil {
+				slog.Error("access token refresh failed", "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err := s.setAuthCookie(w, r, details); err != nil {
+				slog.Error("saving refreshed session failed", "err", err)
+			}
+			accessToken = details.AccessToken
 		}
 
-		resp, err := sb.Client.Auth.User(r.Context(), accessToken.(string))
+		user, err := s.userFromToken(r.Context(), accessToken)
 		if err != nil {
 			next.ServeHTTP(w, r)
 			return
 		}
-
-		user := types.AuthenticatedUser{
-			ID:         uuid.MustParse(resp.ID),
-			Email:      resp.Email,
-			IsLoggedIn: true,
+		if imp, ok := sess.Values[types.ImpersonationKey].(impersonation); ok && imp.UserID == user.ID.String() {
+			user.Impersonator = imp.AdminEmail
 		}
 
 		ctx := context.WithValue(r.Context(), types.UserContextKey, user)
@@ -128,3 +237,59 @@ func WithUser(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(fn)
 }
+
+// userFromToken builds the user from the access token claims. The remote
+// lookup is only used when local verification fails and the fallback is
+// enabled.
+func (s *Server) userFromToken(ctx context.Context, accessToken string) (types.AuthenticatedUser, error) {
+	claims, err := s.auth.VerifyToken(ctx, accessToken)
+	if err == nil {
+		id, err := uuid.Parse(claims.Subject)
+		if err != nil {
+			return types.AuthenticatedUser{}, err
+		}
+		confirmed, err := s.emailConfirmed(ctx, claims.Subject)
+		if err != nil {
+			return types.AuthenticatedUser{}, err
+		}
+		return types.AuthenticatedUser{
+			ID:             id,
+			Email:          claims.Email,
+			IsLoggedIn:     true,
+			EmailConfirmed: confirmed,
+		}, nil
+	}
+	if !s.remoteUserFallback {
+		return types.AuthenticatedUser{}, err
+	}
+
+	slog.Warn("local token verification failed, falling back to remote lookup", "err", err)
+	resp, err := s.auth.User(ctx, accessToken)
+	if err != nil {
+		return types.AuthenticatedUser{}, err
+	}
+	id, err := uuid.Parse(resp.ID)
+	if err != nil {
+		return types.AuthenticatedUser{}, err
+	}
+
+	return types.AuthenticatedUser{
+		ID:             id,
+		Email:          resp.Email,
+		IsLoggedIn:     true,
+		EmailConfirmed: !resp.ConfirmedAt.IsZero(),
+	}, nil
+}
+
+// emailConfirmed asks the auth backend whether the user confirmed their
+// email, the claims only carry metadata users can write themselves. The
+// answer is cached for a while like for personal access tokens.
+func (s *Server) emailConfirmed(ctx context.Context, userID string) (bool, error) {
+	identity, err := s.identities.get(ctx, s.auth, userID)
+	if err != nil {
+		slog.Error("email confirmation lookup failed", "user", userID, "err", err)
+		return false, err
+	}
+
+	return identity.EmailConfirmed, nil
+}
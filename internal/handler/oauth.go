@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"dreampicai/types"
+)
+
+var knownOAuthProviders = map[string]types.OAuthProvider{
+	"apple":         {Label: "Apple", Icon: "fa-brands fa-apple"},
+	"azure":         {Label: "Microsoft", Icon: "fa-brands fa-microsoft"},
+	"bitbucket":     {Label: "Bitbucket", Icon: "fa-brands fa-bitbucket"},
+	"discord":       {Label: "Discord", Icon: "fa-brands fa-discord"},
+	"facebook":      {Label: "Facebook", Icon: "fa-brands fa-facebook"},
+	"github":        {Label: "GitHub", Icon: "fa-brands fa-github"},
+	"gitlab":        {Label: "GitLab", Icon: "fa-brands fa-gitlab"},
+	"google":        {Label: "Google", Icon: "fa-brands fa-google"},
+	"linkedin_oidc": {Label: "LinkedIn", Icon: "fa-brands fa-linkedin"},
+	"slack":         {Label: "Slack", Icon: "fa-brands fa-slack"},
+	"spotify":       {Label: "Spotify", Icon: "fa-brands fa-spotify"},
+	"twitch":        {Label: "Twitch", Icon: "fa-brands fa-twitch"},
+	"twitter":       {Label: "X", Icon: "fa-brands fa-x-twitter"},
+}
+
+// loadOAuthProviders reads the allowed providers from OAUTH_PROVIDERS, a
+// comma separated list of names. Each one can be tuned with
+// OAUTH_<NAME>_REDIRECT_URL, OAUTH_<NAME>_SCOPES and OAUTH_<NAME>_LABEL.
+// Without it only Google is enabled, as it used to be.
+func loadOAuthProviders() []types.OAuthProvider {
+	names := os.Getenv("OAUTH_PROVIDERS")
+	if len(names) == 0 {
+		names = "google"
+	}
+
+	var providers []types.OAuthProvider
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+
+		p := knownOAuthProviders[name]
+		p.Name = name
+		if len(p.Label) == 0 {
+			p.Label = strings.ToUpper(name[:1]) + name[1:]
+			p.Icon = "fa-solid fa-right-to-bracket"
+		}
+
+		prefix := fmt.Sprintf("OAUTH_%s_", strings.ToUpper(name))
+		if label := os.Getenv(prefix + "LABEL"); len(label) > 0 {
+			p.Label = label
+		}
+		p.RedirectTo = os.Getenv(prefix + "REDIRECT_URL")
+		if len(p.RedirectTo) == 0 && name == "google" {
+			p.RedirectTo = os.Getenv("GOOGLE_LOGIN_CALLBACK_URL")
+		}
+		if len(p.RedirectTo) == 0 {
+			p.RedirectTo = os.Getenv("OAUTH_REDIRECT_URL")
+		}
+		p.Scopes = strings.FieldsFunc(os.Getenv(prefix+"SCOPES"), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+
+		providers = append(providers, p)
+	}
+
+	return providers
+}
+
+func (s *Server) oauthProvider(name string) (types.OAuthProvider, bool) {
+	for _, p := range s.oauthProviders {
+		if p.Name == name {
+			return p, true
+		}
+	}
+
+	return types.OAuthProvider{}, false
+}
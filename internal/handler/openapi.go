@@ -0,0 +1,385 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"dreampicai/cmd/web/view/docs"
+	"dreampicai/pkg/kit/validate"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// apiOperation documents a route of apiRoutes in the OpenAPI document.
+type apiOperation struct {
+	ID      string
+	Summary string
+	// Public operations need no token. The others need one with Scope, any
+	// token when it is empty.
+	Public bool
+	Scope  types.TokenScope
+	// Request is the JSON body, checked with Fields.
+	Request any
+	Fields  validate.Fields
+	// Status is the status of success, answered with Response, or no body
+	// when it is nil.
+	Status   int
+	Response any
+	// Errors are the statuses of the error responses, besides those of
+	// validation and authentication.
+	Errors []int
+}
+
+// apiOperations documents apiRoutes, keyed by method and route. Building the
+// document fails when they disagree.
+var apiOperations = map[string]apiOperation{
+	"POST /auth/signup": {
+		ID:       "signUp",
+		Summary:  "Sign up. The email address must be confirmed before creating a token.",
+		Public:   true,
+		Request:  apiSignupRequest{},
+		Fields:   signupFields(""),
+		Status:   http.StatusCreated,
+		Response: apiUser{},
+		Errors:   []int{http.StatusBadRequest},
+	},
+	"POST /auth/token": {
+		ID:       "createToken",
+		Summary:  "Log in and create a personal access token.",
+		Public:   true,
+		Request:  apiTokenRequest{},
+		Fields:   mergeFields(loginFields, tokenFields),
+		Status:   http.StatusCreated,
+		Response: apiNewToken{},
+		Errors:   []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests},
+	},
+	"GET /auth/token": {
+		ID:       "getToken",
+		Summary:  "Describe the token of the request.",
+		Status:   http.StatusOK,
+		Response: apiToken{},
+		Errors:   []int{http.StatusNotFound},
+	},
+	"DELETE /auth/token": {
+		ID:      "revokeToken",
+		Summary: "Revoke the token of the request.",
+		Status:  http.StatusNoContent,
+	},
+	"GET /account": {
+		ID:       "getAccount",
+		Summary:  "Get the account.",
+		Scope:    types.ScopeAccountRead,
+		Status:   http.StatusOK,
+		Response: apiAccount{},
+		Errors:   []int{http.StatusNotFound},
+	},
+	"POST /account": {
+		ID:       "createAccount",
+		Summary:  "Set up the account.",
+		Scope:    types.ScopeAccountWrite,
+		Request:  apiUsernameRequest{},
+		Fields:   usernameFields,
+		Status:   http.StatusCreated,
+		Response: apiAccount{},
+		Errors:   []int{http.StatusConflict},
+	},
+	"PATCH /account": {
+		ID:       "updateAccount",
+		Summary:  "Update the profile.",
+		Scope:    types.ScopeAccountWrite,
+		Request:  apiUsernameRequest{},
+		Fields:   usernameFields,
+		Status:   http.StatusOK,
+		Response: apiAccount{},
+		Errors:   []int{http.StatusNotFound},
+	},
+}
+
+func mergeFields(all ...validate.Fields) validate.Fields {
+	merged := validate.Fields{}
+	for _, fields := range all {
+		for name, rules := range fields {
+			merged[name] = append(merged[name], rules...)
+		}
+	}
+
+	return merged
+}
+
+// openAPI builds the OpenAPI document of routes, the router mounted at
+// /api/v1.
+func openAPI(routes chi.Routes) (map[string]any, error) {
+	g := &schemaGenerator{schemas: map[string]any{}}
+	errorRef := g.ref(reflect.TypeOf(apiError{}), nil)
+	paths := map[string]map[string]any{}
+	routed := map[string]bool{}
+
+	err := chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		key := method + " " + route
+		op, ok := apiOperations[key]
+		if !ok {
+			return fmt.Errorf("route %s is not documented in apiOperations", key)
+		}
+		routed[key] = true
+
+		errs := map[int]bool{}
+		for _, status := range op.Errors {
+			errs[status] = true
+		}
+		operation := map[string]any{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+		}
+		if op.Public {
+			operation["security"] = []any{}
+		} else {
+			scopes := []string{}
+			if len(op.Scope) > 0 {
+				scopes = append(scopes, string(op.Scope))
+			}
+			operation["security"] = []any{map[string]any{"token": scopes}}
+			errs[http.StatusUnauthorized] = true
+			errs[http.StatusForbidden] = true
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": g.ref(reflect.TypeOf(op.Request), op.Fields)}},
+			}
+			errs[http.StatusBadRequest] = true
+			errs[http.StatusUnprocessableEntity] = true
+		}
+
+		success := map[string]any{"description": http.StatusText(op.Status)}
+		if op.Response != nil {
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": g.ref(reflect.TypeOf(op.Response), nil)}}
+		}
+		responses := map[string]any{strconv.Itoa(op.Status): success}
+		for status := range errs {
+			responses[strconv.Itoa(status)] = map[string]any{
+				"description": http.StatusText(status),
+				"content":     map[string]any{"application/json": map[string]any{"schema": errorRef}},
+			}
+		}
+		operation["responses"] = responses
+
+		if paths[route] == nil {
+			paths[route] = map[string]any{}
+		}
+		paths[route][strings.ToLower(method)] = operation
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for key := range apiOperations {
+		if !routed[key] {
+			return nil, fmt.Errorf("%s is documented in apiOperations but not routed", key)
+		}
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "Dreampicai API",
+			"version": "1",
+		},
+		"servers": []any{map[string]any{"url": "/api/v1"}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"token": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A personal access token, created in the settings or with createToken.",
+				},
+			},
+		},
+	}, nil
+}
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	uuidType  = reflect.TypeOf(uuid.UUID{})
+	scopeType = reflect.TypeOf(types.TokenScope(""))
+)
+
+// schemaGenerator builds the JSON schemas of Go types, named after the type
+// without its api prefix.
+type schemaGenerator struct {
+	schemas map[string]any
+	err     error
+}
+
+// ref adds the schema of the struct t and refers to it. The constraints of
+// fields apply to request bodies, which reject unknown properties.
+func (g *schemaGenerator) ref(t reflect.Type, fields validate.Fields) map[string]any {
+	name := strings.TrimPrefix(t.Name(), "api")
+	if len(name) > 0 {
+		name = string(unicode.ToUpper(rune(name[0]))) + name[1:]
+	}
+	if _, ok := g.schemas[name]; !ok {
+		// The placeholder ends recursion on types referring to themselves.
+		g.schemas[name] = nil
+		g.schemas[name] = g.object(t, fields)
+	}
+
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func (g *schemaGenerator) object(t reflect.Type, fields validate.Fields) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	g.properties(t, fields, properties, &required)
+	sort.Strings(required)
+
+	schema := map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	if fields != nil {
+		schema["additionalProperties"] = false
+	}
+
+	return schema
+}
+
+// properties adds the JSON properties of the struct t. Properties of
+// responses are required unless omitted when empty, those of requests when
+// their rules reject an empty value.
+func (g *schemaGenerator) properties(t reflect.Type, fields validate.Fields, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			g.properties(field.Type, fields, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+
+		schema := g.schema(field.Type)
+		if fields != nil {
+			if g.constrain(schema, fields[field.Name]) {
+				*required = append(*required, name)
+			}
+		} else if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+		properties[name] = schema
+	}
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case uuidType:
+		return map[string]any{"type": "string", "format": "uuid"}
+	case scopeType:
+		return map[string]any{"type": "string", "enum": types.TokenScopes}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := g.schema(t.Elem())
+		schema["type"] = []any{schema["type"], "null"}
+		return schema
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		return g.ref(t, nil)
+	}
+	g.fail(fmt.Errorf("no JSON schema for type %v", t))
+
+	return map[string]any{}
+}
+
+// constrain adds the constraints of rules to schema, and reports whether
+// they make the property required.
+func (g *schemaGenerator) constrain(schema map[string]any, rules []validate.RuleSet) bool {
+	required := false
+	for _, rule := range rules {
+		switch rule.Name {
+		case "required":
+			required = true
+			if _, ok := schema["minLength"]; !ok {
+				schema["minLength"] = 1
+			}
+		case "min":
+			schema["minLength"] = rule.RuleValue
+			required = required || rule.RuleValue.(int) > 0
+		case "max":
+			schema["maxLength"] = rule.RuleValue
+		case "email":
+			schema["format"] = "email"
+		case "url":
+			schema["format"] = "uri"
+		case "password":
+			schema["format"] = "password"
+			schema["minLength"] = validate.MinPasswordLength
+			schema["description"] = "Must contain an uppercase and a lowercase letter, a digit and a special character."
+		case "equal":
+			// Compared with another field of the request, the message says
+			// which.
+		case "message":
+			schema["description"] = rule.RuleValue
+		default:
+			g.fail(fmt.Errorf("no JSON schema constraint for rule %q", rule.Name))
+		}
+	}
+
+	return required
+}
+
+func (g *schemaGenerator) fail(err error) {
+	if g.err == nil {
+		g.err = err
+	}
+}
+
+func (s *Server) HandleOpenAPI(w http.ResponseWriter, r *http.Request) error {
+	doc, err := openAPI(s.apiRoutes())
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, doc)
+}
+
+func (s *Server) HandleAPIDocs(w http.ResponseWriter, r *http.Request) error {
+	return render(r, w, docs.APIReference("/api/openapi.json"))
+}
@@ -0,0 +1,343 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"dreampicai/cmd/web/view"
+	"dreampicai/cmd/web/view/settings"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+func init() {
+	gob.Register(webauthn.SessionData{})
+}
+
+// loadWebAuthn configures the relying party from WEBAUTHN_RP_ID and the comma
+// separated WEBAUTHN_RP_ORIGINS. Passkeys are disabled when it is invalid.
+func loadWebAuthn() *webauthn.WebAuthn {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if len(rpID) == 0 {
+		rpID = "localhost"
+	}
+	origins := strings.Split(os.Getenv("WEBAUTHN_RP_ORIGINS"), ",")
+	if len(origins[0]) == 0 {
+		origins = []string{fmt.Sprintf("http://localhost:%s", os.Getenv("PORT"))}
+	}
+
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "dreampicai",
+		RPOrigins:     origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		},
+	})
+	if err != nil {
+		slog.Error("invalid webauthn config, passkeys are disabled", "err", err)
+		return nil
+	}
+
+	return w
+}
+
+// passkeyUser is an account as seen by the WebAuthn ceremonies. The user
+// handle is the auth user id.
+type passkeyUser struct {
+	account  types.Account
+	email    string
+	passkeys []types.Passkey
+}
+
+func (u passkeyUser) WebAuthnID() []byte {
+	id := u.account.UserID
+	return id[:]
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	return u.email
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	return u.account.Username
+}
+
+func (u passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.passkeys))
+	for i, p := range u.passkeys {
+		transports := make([]protocol.AuthenticatorTransport, len(p.Transports))
+		for j, t := range p.Transports {
+			transports[j] = protocol.AuthenticatorTransport(t)
+		}
+		credentials[i] = webauthn.Credential{
+			ID:              p.CredentialID,
+			PublicKey:       p.PublicKey,
+			AttestationType: p.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: p.BackupEligible,
+				BackupState:    p.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:       p.AAGUID,
+				SignCount:    uint32(p.SignCount),
+				CloneWarning: p.CloneWarning,
+			},
+		}
+	}
+
+	return credentials
+}
+
+func (u passkeyUser) passkey(credentialID []byte) (types.Passkey, bool) {
+	for _, p := range u.passkeys {
+		if bytes.Equal(p.CredentialID, credentialID) {
+			return p, true
+		}
+	}
+
+	return types.Passkey{}, false
+}
+
+func (s *Server) passkeyUser(r *http.Request, account types.Account, email string) (passkeyUser, error) {
+	passkeys, err := s.db.GetPasskeysByAccountID(r.Context(), account.ID)
+	if err != nil {
+		return passkeyUser{}, err
+	}
+
+	return passkeyUser{account: account, email: email, passkeys: passkeys}, nil
+}
+
+func (s *Server) saveCeremony(w http.ResponseWriter, r *http.Request, key string, data *webauthn.SessionData) error {
+	sess, _ := s.getSession(r)
+	sess.Values[key] = *data
+
+	return sess.Save(r, w)
+}
+
+// takeCeremony removes the ceremony from the session, a challenge is only
+// good for one response.
+func (s *Server) takeCeremony(w http.ResponseWriter, r *http.Request, key string) (webauthn.SessionData, bool) {
+	sess, _ := s.getSession(r)
+	data, ok := sess.Values[key].(webauthn.SessionData)
+	if !ok {
+		return data, false
+	}
+	delete(sess.Values, key)
+	if err := sess.Save(r, w); err != nil {
+		slog.Error("saving session failed", "err", err)
+	}
+
+	return data, true
+}
+
+// HandlePasskeyRegisterBegin starts adding a passkey, once the user
+// confirmed it is them like for any other sign in method.
+func (s *Server) HandlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) error {
+	if s.webauthn == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	user := getAuthenticatedUser(r)
+	msg, err := s.reauthenticate(w, r, user, r.FormValue("password"))
+	if err != nil {
+		return err
+	}
+	if len(msg) > 0 {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"error": msg})
+	}
+	pu, err := s.passkeyUser(r, user.Account, user.Email)
+	if err != nil {
+		return err
+	}
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(pu.passkeys))
+	for _, c := range pu.WebAuthnCredentials() {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+
+	creation, data, err := s.webauthn.BeginRegistration(pu, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return err
+	}
+	if err := s.saveCeremony(w, r, types.PasskeyRegistrationKey, data); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, creation)
+}
+
+func (s *Server) HandlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) error {
+	if s.webauthn == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	user := getAuthenticatedUser(r)
+	data, ok := s.takeCeremony(w, r, types.PasskeyRegistrationKey)
+	if !ok {
+		return writeJSON(w, http.StatusBadRequest, map[string]string{"error": "No passkey registration in progress."})
+	}
+	pu, err := s.passkeyUser(r, user.Account, user.Email)
+	if err != nil {
+		return err
+	}
+	credential, err := s.webauthn.FinishRegistration(pu, data, r)
+	if err != nil {
+		slog.Error("passkey registration failed", "err", err)
+		return writeJSON(w, http.StatusBadRequest, map[string]string{"error": "Passkey registration failed."})
+	}
+
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if len(name) == 0 {
+		name = view.DeviceName(r.UserAgent())
+	}
+	transports := make([]string, len(credential.Transport))
+	for i, t := range credential.Transport {
+		transports[i] = string(t)
+	}
+	passkey := &types.Passkey{
+		AccountID:       user.Account.ID,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		Transports:      transports,
+		SignCount:       int64(credential.Authenticator.SignCount),
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+	if err := s.db.CreatePasskey(r.Context(), passkey); err != nil {
+		return err
+	}
+	slog.Info("passkey registered", "user", user.ID)
+	s.recordAudit(r, types.AuditPasskeyAdded, user.ID, map[string]string{"name": name})
+
+	return s.renderPasskeys(w, r)
+}
+
+func (s *Server) HandlePasskeyDelete(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err := s.db.DeletePasskey(r.Context(), user.Account.ID, id); err != nil {
+		return err
+	}
+	s.recordAudit(r, types.AuditPasskeyRemoved, user.ID, map[string]string{"id": strconv.Itoa(id)})
+
+	return s.renderPasskeys(w, r)
+}
+
+func (s *Server) renderPasskeys(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	passkeys, err := s.db.GetPasskeysByAccountID(r.Context(), user.Account.ID)
+	if err != nil {
+		return err
+	}
+
+	return render(r, w, settings.Passkeys(passkeys))
+}
+
+// HandlePasskeyLoginBegin starts a discoverable login, the authenticator
+// tells which account it holds a passkey for.
+func (s *Server) HandlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) error {
+	if s.webauthn == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	assertion, data, err := s.webauthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return err
+	}
+	if err := s.saveCeremony(w, r, types.PasskeyLoginKey, data); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, assertion)
+}
+
+// HandlePasskeyLoginFinish checks the assertion and signs the user in. The
+// passkey verified the user, so no second factor is asked for.
+func (s *Server) HandlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) error {
+	if s.webauthn == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	failed := map[string]string{"error": "Passkey login failed."}
+	data, ok := s.takeCeremony(w, r, types.PasskeyLoginKey)
+	if !ok {
+		return writeJSON(w, http.StatusBadRequest, failed)
+	}
+
+	var pu passkeyUser
+	credential, err := s.webauthn.FinishDiscoverableLogin(func(_, userHandle []byte) (webauthn.User, error) {
+		userID, err := uuid.FromBytes(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		account, err := s.db.GetAccountByUserID(r.Context(), userID.String())
+		if err != nil {
+			return nil, err
+		}
+		pu, err = s.passkeyUser(r, account, "")
+		return pu, err
+	}, data, r)
+	if err != nil {
+		slog.Error("passkey login failed", "err", err)
+		return writeJSON(w, http.StatusUnauthorized, failed)
+	}
+
+	passkey, ok := pu.passkey(credential.ID)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, failed)
+	}
+	if credential.Authenticator.CloneWarning {
+		slog.Warn("passkey sign count did not increase, rejecting possibly cloned passkey", "passkey", passkey.ID, "user", pu.account.UserID)
+		passkey.CloneWarning = true
+		if err := s.db.UpdatePasskey(r.Context(), &passkey); err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{
+			"error": "This passkey looks like it was copied and has been disabled, please log in another way.",
+		})
+	}
+	passkey.SignCount = int64(credential.Authenticator.SignCount)
+	passkey.BackupState = credential.Flags.BackupState
+	passkey.LastUsedAt = time.Now()
+	if err := s.db.UpdatePasskey(r.Context(), &passkey); err != nil {
+		return err
+	}
+
+	details, err := s.auth.SignInAsUser(r.Context(), pu.account.UserID.String())
+	if err != nil {
+		return err
+	}
+	if err := s.setAuthCookie(w, r, details); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"redirect": "/"})
+}
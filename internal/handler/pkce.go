@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+
+	"dreampicai/pkg/sb"
+	"dreampicai/types"
+)
+
+// authFlow is a PKCE login waiting for its callback.
+type authFlow struct {
+	Verifier string
+	State    string
+	// Next is where the user lands once the code is exchanged.
+	Next string
+}
+
+// withState appends the state to the callback URL, so it comes back with the
+// authorization code.
+func withState(redirectTo string, state string) (string, error) {
+	u, err := url.Parse(redirectTo)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("state", state)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+func (s *Server) saveAuthFlow(w http.ResponseWriter, r *http.Request, flow authFlow) error {
+	sess, _ := s.getSession(r)
+	sess.Values[types.CodeVerifierKey] = flow.Verifier
+	sess.Values[types.AuthStateKey] = flow.State
+	sess.Values[types.AuthNextKey] = flow.Next
+
+	return sess.Save(r, w)
+}
+
+// takeAuthFlow removes the pending flow from the session, a code verifier
+// is only ever good for one exchange.
+func (s *Server) takeAuthFlow(w http.ResponseWriter, r *http.Request) (authFlow, error) {
+	sess, _ := s.getSession(r)
+
+	var flow authFlow
+	flow.Verifier, _ = sess.Values[types.CodeVerifierKey].(string)
+	flow.State, _ = sess.Values[types.AuthStateKey].(string)
+	flow.Next, _ = sess.Values[types.AuthNextKey].(string)
+	if len(flow.Verifier) == 0 {
+		return flow, nil
+	}
+
+	delete(sess.Values, types.CodeVerifierKey)
+	delete(sess.Values, types.AuthStateKey)
+	delete(sess.Values, types.AuthNextKey)
+
+	return flow, sess.Save(r, w)
+}
+
+func (f authFlow) validState(state string) bool {
+	return len(f.State) > 0 && subtle.ConstantTimeCompare([]byte(f.State), []byte(state)) == 1
+}
+
+// startEmailFlow prepares the PKCE flow for a link mailed to the user. The
+// link only works in the browser that asked for it.
+func (s *Server) startEmailFlow(w http.ResponseWriter, r *http.Request, callbackURL string, next string) (sb.EmailLinkOptions, error) {
+	pkce, err := sb.NewPKCEParams()
+	if err != nil {
+		return sb.EmailLinkOptions{}, err
+	}
+	state, err := randomToken()
+	if err != nil {
+		return sb.EmailLinkOptions{}, err
+	}
+	redirectTo, err := withState(callbackURL, state)
+	if err != nil {
+		return sb.EmailLinkOptions{}, err
+	}
+
+	flow := authFlow{Verifier: pkce.Verifier, State: state, Next: next}
+	if err := s.saveAuthFlow(w, r, flow); err != nil {
+		return sb.EmailLinkOptions{}, err
+	}
+
+	return sb.EmailLinkOptions{RedirectTo: redirectTo, CodeChallenge: pkce.Challenge}, nil
+}
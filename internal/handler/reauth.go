@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"dreampicai/cmd/web/view/settings"
+	"dreampicai/pkg/mail"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// reauthLinkTTL is how long the emailed confirmation link works.
+	reauthLinkTTL = 15 * time.Minute
+	// reauthTTL is how long a confirmation stands in for the password once
+	// the link is opened.
+	reauthTTL = 10 * time.Minute
+)
+
+// reauthentication confirms who is behind the session by a link mailed to
+// the user, for those who log in without a password. It only lives in the
+// server side session, so the link is useless in another browser.
+type reauthentication struct {
+	UserID    string
+	TokenHash string
+	ExpiresAt time.Time
+	Confirmed bool
+}
+
+func init() {
+	gob.Register(reauthentication{})
+}
+
+// HandleReauthPost mails a confirmation link standing in for the password
+// before a sensitive change.
+func (s *Server) HandleReauthPost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	sess, _ := s.getSession(r)
+	sess.Values[types.ReauthKey] = reauthentication{
+		UserID:    user.ID.String(),
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(reauthLinkTTL),
+	}
+	if err := sess.Save(r, w); err != nil {
+		return err
+	}
+
+	if err := s.mailer.Send(r.Context(), mail.Message{
+		To:      user.Email,
+		Subject: "Confirm it's you",
+		Body: fmt.Sprintf("Open this link in the browser you asked from to confirm a change to your dreampicai account:\n\n%s/settings/reauth/%s\n\nIt expires in %d minutes. If you did not ask for it, change your password and log out your other sessions.\n",
+			appURL(), token, int(reauthLinkTTL.Minutes())),
+	}); err != nil {
+		return err
+	}
+	slog.Info("reauthentication link sent", "user", user.ID)
+
+	return render(r, w, settings.ReauthEmailSent(user.Email))
+}
+
+// HandleReauthConfirm confirms the session once the link comes back in the
+// browser that asked for it.
+func (s *Server) HandleReauthConfirm(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	sess, _ := s.getSession(r)
+	pending, ok := sess.Values[types.ReauthKey].(reauthentication)
+	if !ok || pending.Confirmed || pending.UserID != user.ID.String() ||
+		pending.TokenHash != hashToken(chi.URLParam(r, "token")) || time.Now().After(pending.ExpiresAt) {
+		w.WriteHeader(http.StatusNotFound)
+		return render(r, w, settings.ReauthConfirmed(false))
+	}
+
+	pending.Confirmed = true
+	pending.ExpiresAt = time.Now().Add(reauthTTL)
+	sess.Values[types.ReauthKey] = pending
+	if err := sess.Save(r, w); err != nil {
+		return err
+	}
+
+	return render(r, w, settings.ReauthConfirmed(true))
+}
+
+// reauthenticate confirms the user before a sensitive change, with the
+// password when one is given, else with a confirmation by email, used up
+// here. It returns the message to show when neither holds.
+func (s *Server) reauthenticate(w http.ResponseWriter, r *http.Request, user types.AuthenticatedUser, password string) (string, error) {
+	if len(password) > 0 {
+		return s.checkPassword(r, user, password)
+	}
+
+	sess, _ := s.getSession(r)
+	pending, ok := sess.Values[types.ReauthKey].(reauthentication)
+	if !ok || !pending.Confirmed || pending.UserID != user.ID.String() || time.Now().After(pending.ExpiresAt) {
+		return "Enter your password, or confirm by email.", nil
+	}
+	delete(sess.Values, types.ReauthKey)
+	if err := sess.Save(r, w); err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
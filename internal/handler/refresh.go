@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"dreampicai/pkg/sb"
+
+	"github.com/nedpals/supabase-go"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// refreshThreshold is how long before expiry an access token gets refreshed.
+	refreshThreshold = time.Minute
+	// refreshReuseWindow is how long a refresh result is handed out to requests
+	// that still carry the old cookie, e.g. htmx requests fired in parallel.
+	refreshReuseWindow = 10 * time.Second
+)
+
+type refreshResult struct {
+	details   *supabase.AuthenticatedDetails
+	expiresAt time.Time
+}
+
+// tokenRefresher makes sure a refresh token is exchanged only once, no matter
+// how many requests carrying it arrive at the same time.
+type tokenRefresher struct {
+	auth  sb.AuthProvider
+	group singleflight.Group
+
+	mu     sync.Mutex
+	recent map[string]refreshResult
+}
+
+func newTokenRefresher(auth sb.AuthProvider) *tokenRefresher {
+	return &tokenRefresher{
+		auth:   auth,
+		recent: map[string]refreshResult{},
+	}
+}
+
+func (t *tokenRefresher) Refresh(ctx context.Context, accessToken, refreshToken string) (*supabase.AuthenticatedDetails, error) {
+	if details, ok := t.lookup(refreshToken); ok {
+		return details, nil
+	}
+
+	v, err, _ := t.group.Do(refreshToken, func() (interface{}, error) {
+		if details, ok := t.lookup(refreshToken); ok {
+			return details, nil
+		}
+
+		// Detach from the caller, the result is shared with other requests.
+		details, err := t.auth.RefreshUser(context.WithoutCancel(ctx), accessToken, refreshToken)
+		if err != nil {
+			return nil, err
+		}
+		t.store(refreshToken, details)
+
+		return details, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*supabase.AuthenticatedDetails), nil
+}
+
+func (t *tokenRefresher) lookup(refreshToken string) (*supabase.AuthenticatedDetails, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res, ok := t.recent[refreshToken]
+	if !ok || time.Now().After(res.expiresAt) {
+		return nil, false
+	}
+
+	return res.details, true
+}
+
+func (t *tokenRefresher) store(refreshToken string, details *supabase.AuthenticatedDetails) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for k, res := range t.recent {
+		if now.After(res.expiresAt) {
+			delete(t.recent, k)
+		}
+	}
+	t.recent[refreshToken] = refreshResult{details: details, expiresAt: now.Add(refreshReuseWindow)}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"dreampicai/cmd/web"
+	"dreampicai/types"
 
 	_ "dreampicai/cmd/web"
 
@@ -48,32 +49,111 @@ func (s *Server) RegisterRoutes() http.Handler {
 	r.Use(middleware.Logger)
 	r.Use(middleware.Heartbeat("/health"))
 	r.Use(middleware.Recoverer)
-	r.Use(WithUser)
+	r.Use(s.WithUser)
+	r.Use(s.WithCSRF)
 	r.Handle("/*", http.StripPrefix("/", http.FileServer(http.FS(web.Files))))
 
 	r.Get("/health", s.healthHandler)
+	r.Mount("/api/v1", s.apiRoutes())
+	r.Get("/api/openapi.json", MakeHandler("api_openapi", s.HandleOpenAPI))
+	r.Get("/api/docs", MakeHandler("api_docs", s.HandleAPIDocs))
 
 	r.Get("/login", MakeHandler("login_index", s.HandleLoginIndex))
-	r.Get("/login/provider/google", MakeHandler("login_provider_google", s.HandleLoginWithGoogle))
+	r.Get("/login/provider/{provider}", MakeHandler("login_provider", s.HandleLoginWithProvider))
 	r.Post("/login", MakeHandler("login_post", s.HandleLoginPost))
+	r.Get("/login/otp", MakeHandler("login_otp_index", s.HandlePasswordlessIndex))
+	r.Post("/login/otp", MakeHandler("login_otp_post", s.HandleOTPPost))
+	r.Post("/login/otp/verify", MakeHandler("login_otp_verify_post", s.HandleOTPVerifyPost))
+	r.Get("/login/2fa", MakeHandler("login_2fa_index", s.HandleTwoFactorIndex))
+	r.Post("/login/2fa", MakeHandler("login_2fa_post", s.HandleTwoFactorPost))
+	r.Post("/login/passkey/begin", MakeHandler("login_passkey_begin", s.HandlePasskeyLoginBegin))
+	r.Post("/login/passkey/finish", MakeHandler("login_passkey_finish", s.HandlePasskeyLoginFinish))
 	r.Post("/logout", MakeHandler("logout_post", s.HandleLogoutPost))
 	r.Get("/auth/callback", MakeHandler("auth_callback_get", s.HandleAuthCallback))
+	r.Get("/forgot-password", MakeHandler("forgot_password_index", s.HandleForgotPasswordIndex))
+	r.Post("/forgot-password", MakeHandler("forgot_password_post", s.HandleForgotPasswordPost))
+	r.Get("/confirm-email", MakeHandler("confirm_email_index", s.HandleConfirmEmailIndex))
+	r.Post("/confirm-email/resend", MakeHandler("confirm_email_resend", s.HandleConfirmEmailResendPost))
+	r.Get("/account/disabled", MakeHandler("account_disabled", s.HandleAccountDisabled))
+	r.Get("/account/secure/{token}", MakeHandler("account_secure_index", s.HandleSecureAccountIndex))
+	r.Post("/account/secure/{token}", MakeHandler("account_secure_post", s.HandleSecureAccountPost))
 	r.Get("/signup", MakeHandler("signup_index", s.HandleSignupIndex))
 	r.Post("/signup", MakeHandler("signup_post", s.HandleSignupPost))
 
 	r.Group(func(r chi.Router) {
-		r.Use(WithAuth, RedirectIfAccountExists)
+		r.Use(WithAuth, s.RedirectIfAccountExists)
 		r.Get("/account/setup", MakeHandler("account_setup_get", s.HandleAccountSetup))
 		r.Post("/account/setup", MakeHandler("account_setup_post", s.HandleAccountPost))
 	})
 
 	r.Group(func(r chi.Router) {
-		r.Use(WithAuth, WithAccount)
+		r.Use(WithAuth, s.WithAccount)
 		r.Get("/", MakeHandler("home_index", s.HandleHomeIndex))
-		r.Get("/settings", MakeHandler("settings_index", s.HandleSettingsIndex))
-		r.Put("/settings/account/profile", MakeHandler("settings_account_profile", s.HandleUpdateProfilePut))
-		r.Put("/settings/account/reset-password", MakeHandler("update_password", s.HandleUpdatePasswordPut))
-		r.Get("/settings/account/reset-password", MakeHandler("change_password", s.HandleChangePasswordPut))
+		r.With(AllowTokens(types.ScopeAccountRead)).Get("/settings", MakeHandler("settings_index", s.HandleSettingsIndex))
+		r.With(AllowTokens(types.ScopeAccountWrite)).Put("/settings/account/profile", MakeHandler("settings_account_profile", s.HandleUpdateProfilePut))
+		r.Group(func(r chi.Router) {
+			r.Use(AllowTokens(types.ScopeExports))
+			r.Get("/settings/exports", MakeHandler("settings_exports_index", s.HandleExportsIndex))
+			// Archives hold everything about the user, support does not
+			// take them.
+			r.Group(func(r chi.Router) {
+				r.Use(DenyImpersonation)
+				r.Post("/settings/exports", MakeHandler("settings_exports_post", s.HandleExportPost))
+				r.Get("/settings/exports/{token}", MakeHandler("settings_export_download", s.HandleExportDownload))
+			})
+		})
+
+		// Credentials and the account itself are only for the user to change.
+		r.Group(func(r chi.Router) {
+			r.Use(DenyImpersonation)
+			r.Post("/settings/reauth", MakeHandler("settings_reauth_post", s.HandleReauthPost))
+			r.Get("/settings/reauth/{token}", MakeHandler("settings_reauth_confirm", s.HandleReauthConfirm))
+			r.Post("/settings/account/email", MakeHandler("settings_account_email", s.HandleEmailChangePost))
+			r.Post("/settings/account/delete", MakeHandler("settings_account_delete", s.HandleAccountDeletePost))
+			r.Put("/settings/account/reset-password", MakeHandler("update_password", s.HandleUpdatePasswordPut))
+			r.Get("/settings/account/reset-password", MakeHandler("change_password", s.HandleChangePasswordPut))
+			r.Delete("/settings/sessions", MakeHandler("settings_sessions_delete", s.HandleSessionsDelete))
+			r.Delete("/settings/sessions/{id}", MakeHandler("settings_session_delete", s.HandleSessionDelete))
+			r.Post("/settings/passkeys/begin", MakeHandler("settings_passkey_begin", s.HandlePasskeyRegisterBegin))
+			r.Post("/settings/passkeys/finish", MakeHandler("settings_passkey_finish", s.HandlePasskeyRegisterFinish))
+			r.Delete("/settings/passkeys/{id}", MakeHandler("settings_passkey_delete", s.HandlePasskeyDelete))
+			r.Post("/settings/2fa/setup", MakeHandler("settings_2fa_setup", s.HandleTwoFactorSetupPost))
+			r.Post("/settings/2fa/confirm", MakeHandler("settings_2fa_confirm", s.HandleTwoFactorConfirmPost))
+			r.Post("/settings/2fa/disable", MakeHandler("settings_2fa_disable", s.HandleTwoFactorDisablePost))
+			r.Post("/settings/tokens", MakeHandler("settings_tokens_post", s.HandleTokenPost))
+			r.Delete("/settings/tokens/{id}", MakeHandler("settings_token_delete", s.HandleTokenDelete))
+		})
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(WithAuth)
+		r.Post("/impersonation/stop", MakeHandler("impersonation_stop", s.HandleImpersonationStopPost))
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(WithAuth, s.WithAccount, RequirePermission(types.PermissionAdminAccess))
+		r.Group(func(r chi.Router) {
+			r.Use(RequirePermission(types.PermissionUsersRead))
+			r.Get("/admin", MakeHandler("admin_index", s.HandleAdminIndex))
+			r.Get("/admin/accounts", MakeHandler("admin_accounts", s.HandleAdminAccounts))
+			r.Get("/admin/accounts/{id}", MakeHandler("admin_account", s.HandleAdminAccount))
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(RequirePermission(types.PermissionUsersManage))
+			r.Post("/admin/accounts/{id}/disable", MakeHandler("admin_account_disable", s.HandleAdminAccountDisable))
+			r.Post("/admin/accounts/{id}/enable", MakeHandler("admin_account_enable", s.HandleAdminAccountEnable))
+			r.Post("/admin/accounts/{id}/logout", MakeHandler("admin_account_logout", s.HandleAdminAccountLogout))
+			r.Post("/admin/accounts/{id}/username", MakeHandler("admin_account_username", s.HandleAdminAccountUsername))
+			r.Post("/admin/accounts/{id}/password-reset", MakeHandler("admin_account_password_reset", s.HandleAdminAccountPasswordReset))
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(RequirePermission(types.PermissionAuditRead))
+			r.Get("/admin/audit", MakeHandler("admin_audit", s.HandleAuditIndex))
+			r.Get("/admin/audit/events", MakeHandler("admin_audit_events", s.HandleAuditEvents))
+			r.Get("/admin/audit.csv", MakeHandler("admin_audit_export", s.HandleAuditExport))
+		})
+		r.With(RequirePermission(types.PermissionUsersImpersonate)).
+			Post("/admin/accounts/{id}/impersonate", MakeHandler("admin_account_impersonate", s.HandleImpersonatePost))
 	})
 
 	return r
@@ -1,30 +1,81 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
 	_ "github.com/joho/godotenv/autoload"
 
+	"dreampicai/internal/audit"
 	"dreampicai/internal/database"
+	"dreampicai/internal/lockout"
+	"dreampicai/internal/session"
+	"dreampicai/pkg/mail"
+	"dreampicai/pkg/sb"
+	"dreampicai/types"
 )
 
+const sessionCleanupInterval = time.Hour
+
 type Server struct {
 	port int
 
-	db database.Service
+	db        database.Service
+	auth      sb.AuthProvider
+	mailer    mail.Sender
+	refresher *tokenRefresher
+	sessions  *session.Store
+	logins    *lockout.Limiter
+	resends   *throttle
+	audit     *audit.Recorder
+	// identities caches the identities of the users of sessions and
+	// personal access tokens.
+	identities *identityCache
+
+	oauthProviders []types.OAuthProvider
+	// webauthn is nil when passkeys are not configured.
+	webauthn *webauthn.WebAuthn
+
+	// remoteUserFallback looks the user up on the auth backend when the
+	// access token cannot be verified locally.
+	remoteUserFallback bool
 }
 
-func NewServer() *http.Server {
+func New(db database.Service, auth sb.AuthProvider, mailer mail.Sender) *Server {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
-	NewServer := &Server{
+
+	return &Server{
 		port: port,
 
-		db: database.New(),
+		db:        db,
+		auth:      auth,
+		mailer:    mailer,
+		refresher: newTokenRefresher(auth),
+		sessions:  session.NewStore(db),
+		logins:    lockout.NewLimiter(db),
+		resends:   newThrottle(resendInterval),
+		audit:     audit.NewRecorder(db),
+
+		identities: newIdentityCache(identityTTL),
+
+		oauthProviders: loadOAuthProviders(),
+		webauthn:       loadWebAuthn(),
+
+		remoteUserFallback: os.Getenv("AUTH_REMOTE_USER_FALLBACK") == "true",
 	}
+}
+
+func NewServer(auth sb.AuthProvider, mailer mail.Sender) *http.Server {
+	NewServer := New(database.New(), auth, mailer)
+	go NewServer.sessions.Cleanup(context.Background(), sessionCleanupInterval)
+	go every(context.Background(), accountPurgeInterval, NewServer.purgeAccounts)
+	go every(context.Background(), exportPurgeInterval, NewServer.purgeExports)
 
 	// Declare Server config
 	server := &http.Server{
@@ -37,3 +88,24 @@ func NewServer() *http.Server {
 
 	return server
 }
+
+// getSession returns the request session, shared by every handler and
+// middleware that reads it during the request.
+func (s *Server) getSession(r *http.Request) (*sessions.Session, error) {
+	return s.sessions.Get(r, types.UserContextKey)
+}
+
+// every runs fn every interval until ctx is done.
+func every(ctx context.Context, interval time.Duration, fn func(context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn(ctx)
+		}
+	}
+}
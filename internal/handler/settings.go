@@ -1,18 +1,63 @@
 package handler
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"strings"
 
 	"dreampicai/cmd/web/view/auth"
 	"dreampicai/cmd/web/view/settings"
+	"dreampicai/internal/session"
 	"dreampicai/pkg/kit/validate"
+	"dreampicai/pkg/mail"
+	"dreampicai/pkg/sb"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/nedpals/supabase-go"
 )
 
 func (s *Server) HandleSettingsIndex(w http.ResponseWriter, r *http.Request) error {
 	user := getAuthenticatedUser(r)
+	sessions, err := s.db.GetSessionsByUserID(r.Context(), user.ID.String())
+	if err != nil {
+		return err
+	}
+	factor, err := s.db.GetTOTPFactor(r.Context(), user.ID.String())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	passkeys, err := s.db.GetPasskeysByAccountID(r.Context(), user.Account.ID)
+	if err != nil {
+		return err
+	}
+	exports, err := s.exports(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	activity, err := s.db.GetAuditEventsByUserID(r.Context(), user.ID.String(), user.Email, activityLimit)
+	if err != nil {
+		return err
+	}
+	tokens, err := s.db.GetPersonalAccessTokensByUserID(r.Context(), user.ID.String())
+	if err != nil {
+		return err
+	}
+	sess, _ := s.getSession(r)
 
-	return render(r, w, settings.Index(user))
+	return render(r, w, settings.Index(user, settings.Security{
+		Sessions:         sessions,
+		CurrentSession:   session.Key(sess),
+		TwoFactorEnabled: factor.Enabled(),
+		Passkeys:         passkeys,
+		Activity:         activity,
+		Tokens:           tokens,
+	}, exports))
 }
 
 func (s *Server) HandleUpdateProfilePut(w http.ResponseWriter, r *http.Request) error {
@@ -22,23 +67,73 @@ func (s *Server) HandleUpdateProfilePut(w http.ResponseWriter, r *http.Request)
 		params = settings.ProfileParams{Username: r.FormValue("username")}
 		errors settings.ProfileErrors
 	)
-	if ok := validate.New(&params, validate.Fields{
-		"Username": validate.Rules(validate.Min(3), validate.Max(50)),
-	}).Validate(&errors); !ok {
+	if ok := validate.New(&params, usernameFields).Validate(&errors); !ok {
 		return render(r, w, settings.ProfileForm(params, errors))
 	}
+	if _, err := s.changeUsername(r, user, params.Username); err != nil {
+		return err
+	}
+
+	params.Success = true
+
+	return render(r, w, settings.ProfileForm(params, settings.ProfileErrors{}))
+}
 
-	user.Account.Username = params.Username
+// HandleEmailChangePost mails a confirmation link to the new address. The
+// email only changes once the link comes back through HandleAuthCallback.
+func (s *Server) HandleEmailChangePost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	params := settings.EmailParams{
+		Current:  user.Email,
+		Email:    strings.TrimSpace(r.FormValue("email")),
+		Password: r.FormValue("password"),
+	}
 
-	err := s.db.UpdateUsername(r.Context(), &user.Account)
+	var errors settings.EmailErrors
+	if ok := validate.New(&params, validate.Fields{
+		"Email": validate.Rules(validate.Email, validate.Required),
+	}).Validate(&errors); !ok {
+		return render(r, w, settings.EmailForm(params, errors))
+	}
+	if params.Email == user.Email {
+		return render(r, w, settings.EmailForm(params, settings.EmailErrors{
+			Email: "This is already your email.",
+		}))
+	}
+	msg, err := s.reauthenticate(w, r, user, params.Password)
 	if err != nil {
-		slog.Error("failed to update username", "username", params.Username)
 		return err
 	}
+	if len(msg) > 0 {
+		return render(r, w, settings.EmailForm(params, settings.EmailErrors{
+			Password: msg,
+		}))
+	}
 
+	opts, err := s.startEmailFlow(w, r, os.Getenv("EMAIL_CHANGE_CALLBACK_URL"), "/settings")
+	if err != nil {
+		return err
+	}
+	sess, _ := s.getSession(r)
+	token, _ := sess.Values[types.AccessTokenKey].(string)
+	if err := s.auth.ChangeEmail(r.Context(), token, params.Email, opts); err != nil {
+		slog.Error("email change failed", "user", user.ID, "err", err)
+		return render(r, w, settings.EmailForm(params, settings.EmailErrors{
+			Email: "This email cannot be used.",
+		}))
+	}
+	slog.Info("email change requested", "user", user.ID)
+	if err := s.mailer.Send(r.Context(), mail.Message{
+		To:      user.Email,
+		Subject: "Your dreampicai email is changing",
+		Body: fmt.Sprintf("We were asked to change the email of your dreampicai account to %s. It changes once the link we sent there is opened.\n\nIf this wasn't you, change your password and log out your other sessions.\n",
+			params.Email),
+	}); err != nil {
+		slog.Error("sending email change notice failed", "user", user.ID, "err", err)
+	}
 	params.Success = true
 
-	return render(r, w, settings.ProfileForm(params, settings.ProfileErrors{}))
+	return render(r, w, settings.EmailForm(params, settings.EmailErrors{}))
 }
 
 func (s *Server) HandleChangePasswordPut(w http.ResponseWriter, r *http.Request) error {
@@ -53,3 +148,113 @@ func (s *Server) HandleChangePasswordPut(w http.ResponseWriter, r *http.Request)
 
 	return render(r, w, auth.ResetPassword(auth.ResetPasswordParams{}, auth.ResetPasswordErrors{}))
 }
+
+// HandleSessionDelete revokes one of the user's other sessions, both here
+// and on the auth backend.
+func (s *Server) HandleSessionDelete(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	row, err := s.db.GetSession(r.Context(), chi.URLParam(r, "id"))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil && row.UserID == user.ID {
+		if values, err := session.Values(row); err == nil {
+			token, _ := values[types.AccessTokenKey].(string)
+			s.signOut(r, token, sb.ScopeLocal)
+		}
+		if err := s.db.DeleteSession(r.Context(), row.ID); err != nil {
+			return err
+		}
+	}
+
+	return s.renderSessions(w, r)
+}
+
+// HandleSessionsDelete logs the user out everywhere but on this device.
+func (s *Server) HandleSessionsDelete(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	sess, _ := s.getSession(r)
+	token, _ := sess.Values[types.AccessTokenKey].(string)
+	s.signOut(r, token, sb.ScopeOthers)
+	if err := s.db.DeleteSessionsByUserID(r.Context(), user.ID.String(), session.Key(sess)); err != nil {
+		return err
+	}
+
+	return s.renderSessions(w, r)
+}
+
+func (s *Server) renderSessions(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	sessions, err := s.db.GetSessionsByUserID(r.Context(), user.ID.String())
+	if err != nil {
+		return err
+	}
+	sess, _ := s.getSession(r)
+
+	return render(r, w, settings.Sessions(sessions, session.Key(sess)))
+}
+
+// checkPassword confirms the password of the user before a sensitive
+// change. It goes through the lockout of the login, so a stolen session
+// cannot guess at will, and failures are audited. It returns the message to
+// show when the password is refused.
+func (s *Server) checkPassword(r *http.Request, user types.AuthenticatedUser, password string) (string, error) {
+	details, wait, err := s.verifyPassword(r, supabase.UserCredentials{
+		Email:    user.Email,
+		Password: password,
+	})
+	if errors.Is(err, errLockedOut) || errors.Is(err, errInvalidCredentials) {
+		reason := "invalid_password"
+		if errors.Is(err, errLockedOut) {
+			reason = "locked"
+		}
+		s.recordAudit(r, types.AuditReauthFailed, user.ID, map[string]string{"path": r.URL.Path, "reason": reason})
+	}
+	if wait > 0 {
+		return tooManyAttempts(wait), nil
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		return "Invalid password.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	s.signOut(r, details.AccessToken, sb.ScopeLocal)
+	if err := s.logins.Succeed(r.Context(), user.Email); err != nil {
+		return "", err
+	}
+
+	return "", nil
+}
+
+// signOut revokes the backend sessions selected by scope. Failures are only
+// logged, the local session is what keeps the user signed in here.
+func (s *Server) signOut(r *http.Request, accessToken string, scope sb.SignOutScope) {
+	if len(accessToken) == 0 {
+		return
+	}
+	if err := s.auth.SignOut(r.Context(), accessToken, scope); err != nil {
+		slog.Error("auth backend sign out failed", "scope", scope, "err", err)
+	}
+}
+
+// logoutEverywhere ends every way the user is logged in: the sessions here,
+// the sessions of the auth backend, whose refresh tokens would get new
+// access tokens, and the personal access tokens.
+func (s *Server) logoutEverywhere(r *http.Request, userID uuid.UUID) error {
+	if err := s.db.DeleteSessionsByUserID(r.Context(), userID.String(), ""); err != nil {
+		return err
+	}
+	if err := s.db.DeletePersonalAccessTokensByUserID(r.Context(), userID.String()); err != nil {
+		return err
+	}
+	// Signing out needs a token of the user, a session is issued for that.
+	details, err := s.auth.SignInAsUser(r.Context(), userID.String())
+	if err != nil {
+		slog.Error("auth backend sign out failed", "user", userID, "err", err)
+		return nil
+	}
+	s.signOut(r, details.AccessToken, sb.ScopeGlobal)
+
+	return nil
+}
@@ -1,9 +1,13 @@
 package handler
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"log/slog"
 	"net/http"
 
+	"dreampicai/cmd/web/view/components"
 	"dreampicai/types"
 
 	"github.com/a-h/templ"
@@ -27,6 +31,22 @@ func hxRedirect(w http.ResponseWriter, r *http.Request, to string) error {
 	return nil
 }
 
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	return json.NewEncoder(w).Encode(v)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 func getAuthenticatedUser(r *http.Request) types.AuthenticatedUser {
 	user, ok := r.Context().Value(types.UserContextKey).(types.AuthenticatedUser)
 	if !ok {
@@ -38,11 +58,57 @@ func getAuthenticatedUser(r *http.Request) types.AuthenticatedUser {
 
 func MakeHandler(operation string, h func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
 	handler := func(w http.ResponseWriter, r *http.Request) {
+		// Personal access tokens only reach the routes opted in with
+		// AllowTokens.
+		if getAuthenticatedUser(r).ViaToken() && r.Context().Value(types.TokenScopeKey) == nil {
+			forbidden(w, r)
+			return
+		}
 		if err := h(w, r); err != nil {
 			slog.Error("internal server error", "err", err, "path", r.URL.Path)
-			w.WriteHeader(http.StatusInternalServerError)
+			internalError(w, r)
 		}
 	}
 
 	return otelhttp.NewHandler(http.HandlerFunc(handler), operation).ServeHTTP
 }
+
+// forbidden answers requests the user is not allowed to make.
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	if isAPI(r) {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "You are not allowed to do that.")
+		return
+	}
+	rejectWithToast(w, r, "You are not allowed to do that.")
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, msg string) {
+	if isAPI(r) {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", msg)
+		return
+	}
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+func internalError(w http.ResponseWriter, r *http.Request) {
+	if isAPI(r) {
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Something went wrong on our side.")
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// rejectWithToast answers with 403, shown as a toast to htmx requests.
+func rejectWithToast(w http.ResponseWriter, r *http.Request, msg string) {
+	if len(r.Header.Get("HX-Request")) == 0 {
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("HX-Retarget", "body")
+	w.Header().Set("HX-Reswap", "beforeend")
+	w.WriteHeader(http.StatusForbidden)
+	if err := render(r, w, components.ErrorToast(msg)); err != nil {
+		slog.Error("rendering error toast failed", "err", err)
+	}
+}
@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dreampicai/cmd/web/view/settings"
+	"dreampicai/pkg/kit/validate"
+	"dreampicai/pkg/sb"
+	"dreampicai/types"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// personalTokenPrefix starts every personal access token, so leaked ones
+	// are easy to spot.
+	personalTokenPrefix = "dpa_"
+	// tokenTouchInterval limits how often last_used_at is written for a
+	// token.
+	tokenTouchInterval = time.Minute
+	maxTokenDays       = 365
+	// identityTTL is how long the identity of a user is cached, so requests
+	// do not each ask the auth backend.
+	identityTTL = 5 * time.Minute
+)
+
+var (
+	errInvalidPersonalToken = errors.New("invalid or expired personal access token")
+	errAccountDisabled      = errors.New("account disabled")
+)
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+
+	return token, len(token) > 0
+}
+
+// userFromPersonalToken resolves a personal access token to its user, the
+// way userFromToken does for the access token of a browser session. Tokens
+// of disabled accounts are refused.
+func (s *Server) userFromPersonalToken(ctx context.Context, raw string) (types.AuthenticatedUser, error) {
+	if !strings.HasPrefix(raw, personalTokenPrefix) {
+		return types.AuthenticatedUser{}, errInvalidPersonalToken
+	}
+	token, err := s.db.GetPersonalAccessTokenByHash(ctx, hashToken(raw))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && token.Expired()) {
+		return types.AuthenticatedUser{}, errInvalidPersonalToken
+	}
+	if err != nil {
+		return types.AuthenticatedUser{}, err
+	}
+	// The account is missing until it is set up, which tokens may do.
+	account, err := s.db.GetAccountByUserID(ctx, token.UserID.String())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return types.AuthenticatedUser{}, err
+	}
+	if account.Disabled() {
+		return types.AuthenticatedUser{}, errAccountDisabled
+	}
+	identity, err := s.identities.get(ctx, s.auth, token.UserID.String())
+	if err != nil {
+		return types.AuthenticatedUser{}, err
+	}
+
+	if now := time.Now(); now.Sub(token.LastUsedAt) > tokenTouchInterval {
+		if err := s.db.TouchPersonalAccessToken(ctx, token.ID, now); err != nil {
+			slog.Error("updating token last use failed", "token", token.ID, "err", err)
+		}
+	}
+
+	return types.AuthenticatedUser{
+		ID:             token.UserID,
+		Email:          identity.Email,
+		IsLoggedIn:     true,
+		EmailConfirmed: identity.EmailConfirmed,
+		TokenID:        token.ID,
+		Scopes:         token.Scopes,
+	}, nil
+}
+
+// identityCache keeps what the auth backend knows of users for a while. The
+// state is kept per instance.
+type identityCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedIdentity
+}
+
+type cachedIdentity struct {
+	Email          string
+	EmailConfirmed bool
+	expiresAt      time.Time
+}
+
+func newIdentityCache(ttl time.Duration) *identityCache {
+	return &identityCache{ttl: ttl, entries: map[string]cachedIdentity{}}
+}
+
+// get returns the identity of the user, from the auth backend when it is
+// not cached.
+func (c *identityCache) get(ctx context.Context, auth sb.AuthProvider, userID string) (cachedIdentity, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[userID]
+	c.mu.Unlock()
+	now := time.Now()
+	if ok && now.Before(entry.expiresAt) {
+		return entry, nil
+	}
+
+	user, err := auth.GetUser(ctx, userID)
+	if err != nil {
+		return cachedIdentity{}, err
+	}
+	entry = cachedIdentity{
+		Email:          user.Email,
+		EmailConfirmed: !user.ConfirmedAt.IsZero(),
+		expiresAt:      now.Add(c.ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if !now.Before(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[userID] = entry
+
+	return entry, nil
+}
+
+// forget drops the cached identity of the user, after something the cache
+// would hide, e.g. confirming the email.
+func (c *identityCache) forget(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, userID)
+}
+
+// tokenRequest is a personal access token to create, from the settings
+// page or the API.
+type tokenRequest struct {
+	Name   string
+	Scopes []types.TokenScope
+	// ExpiresInDays is how long the token lasts, 0 never expires.
+	ExpiresInDays int
+}
+
+var tokenFields = validate.Fields{
+	"Name": validate.Rules(validate.Required, validate.Max(100)),
+}
+
+// validate checks the request, errs gets the messages keyed by field name.
+func (req tokenRequest) validate(errs map[string]string) bool {
+	ok := validate.New(&req, tokenFields).Validate(errs)
+	if len(req.Scopes) == 0 {
+		errs["Scopes"] = "Pick at least one scope."
+		ok = false
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(types.TokenScopes, scope) {
+			errs["Scopes"] = "Unknown scope " + string(scope) + "."
+			ok = false
+		}
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxTokenDays {
+		errs["ExpiresInDays"] = fmt.Sprintf("Tokens expire within %d days, or never.", maxTokenDays)
+		ok = false
+	}
+
+	return ok
+}
+
+// createPersonalToken creates the token of a validated request. The token
+// itself is only returned here, only its hash is kept.
+func (s *Server) createPersonalToken(r *http.Request, userID uuid.UUID, req tokenRequest) (string, types.PersonalAccessToken, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return "", types.PersonalAccessToken{}, err
+	}
+	raw := personalTokenPrefix + secret
+	token := types.PersonalAccessToken{
+		UserID:    userID,
+		Name:      req.Name,
+		TokenHash: hashToken(raw),
+		Prefix:    raw[:len(personalTokenPrefix)+4],
+		Scopes:    req.Scopes,
+	}
+	if req.ExpiresInDays > 0 {
+		token.ExpiresAt = time.Now().AddDate(0, 0, req.ExpiresInDays)
+	}
+	if err := s.db.CreatePersonalAccessToken(r.Context(), &token); err != nil {
+		return "", types.PersonalAccessToken{}, err
+	}
+	scopes := make([]string, len(token.Scopes))
+	for i, scope := range token.Scopes {
+		scopes[i] = string(scope)
+	}
+	s.recordAudit(r, types.AuditTokenCreated, userID, map[string]string{"name": token.Name, "scopes": strings.Join(scopes, " ")})
+
+	return raw, token, nil
+}
+
+func (s *Server) HandleTokenPost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	params := settings.TokenParams{
+		Name:      strings.TrimSpace(r.PostForm.Get("name")),
+		ExpiresIn: r.PostForm.Get("expires_in"),
+	}
+	for _, scope := range r.PostForm["scopes"] {
+		params.Scopes = append(params.Scopes, types.TokenScope(scope))
+	}
+	req := tokenRequest{Name: params.Name, Scopes: params.Scopes, ExpiresInDays: -1}
+	if days, err := strconv.Atoi(params.ExpiresIn); err == nil {
+		req.ExpiresInDays = days
+	}
+
+	errs := map[string]string{}
+	if !req.validate(errs) {
+		return s.renderTokens(w, r, params, settings.TokenErrors{
+			Name:      errs["Name"],
+			Scopes:    errs["Scopes"],
+			ExpiresIn: errs["ExpiresInDays"],
+		}, "")
+	}
+	raw, _, err := s.createPersonalToken(r, user.ID, req)
+	if err != nil {
+		return err
+	}
+
+	return s.renderTokens(w, r, settings.TokenParams{ExpiresIn: params.ExpiresIn}, settings.TokenErrors{}, raw)
+}
+
+func (s *Server) HandleTokenDelete(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	if err := s.db.DeletePersonalAccessToken(r.Context(), user.ID.String(), id); err != nil {
+		return err
+	}
+	s.recordAudit(r, types.AuditTokenRevoked, user.ID, map[string]string{"id": strconv.Itoa(id)})
+
+	return s.renderTokens(w, r, settings.TokenParams{ExpiresIn: "30"}, settings.TokenErrors{}, "")
+}
+
+func (s *Server) renderTokens(w http.ResponseWriter, r *http.Request, params settings.TokenParams, errs settings.TokenErrors, created string) error {
+	tokens, err := s.db.GetPersonalAccessTokensByUserID(r.Context(), getAuthenticatedUser(r).ID.String())
+	if err != nil {
+		return err
+	}
+
+	return render(r, w, settings.AccessTokens(tokens, params, errs, created))
+}
@@ -0,0 +1,320 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"dreampicai/cmd/web/view/auth"
+	"dreampicai/cmd/web/view/settings"
+	"dreampicai/internal/session"
+	"dreampicai/pkg/sb"
+	"dreampicai/pkg/totp"
+	"dreampicai/types"
+
+	"github.com/google/uuid"
+	"github.com/nedpals/supabase-go"
+)
+
+const (
+	totpIssuer = "dreampicai"
+	// twoFactorTTL is how long a login waits for its second factor.
+	twoFactorTTL         = 5 * time.Minute
+	twoFactorMaxAttempts = 5
+)
+
+var totpCode = regexp.MustCompile(`^[0-9]{6}$`)
+
+// pendingLogin is a login that passed the first factor and waits for the
+// second one. It only lives in the server side session.
+type pendingLogin struct {
+	UserID string
+	// Email keys the lockout, failed codes count against it.
+	Email        string
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int
+	Next         string
+	ExpiresAt    time.Time
+	Attempts     int
+}
+
+func init() {
+	gob.Register(pendingLogin{})
+}
+
+func (p pendingLogin) details() *supabase.AuthenticatedDetails {
+	return &supabase.AuthenticatedDetails{
+		AccessToken:  p.AccessToken,
+		RefreshToken: p.RefreshToken,
+		ExpiresIn:    p.ExpiresIn,
+		User:         supabase.User{ID: p.UserID},
+	}
+}
+
+// completeLogin grants the session once the first factor succeeded, or
+// sends the user to the second step when two-factor authentication is on.
+// The lockout of the email is only cleared once the login is complete.
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, details *supabase.AuthenticatedDetails, next string) error {
+	// The login may come from a link that just confirmed the email.
+	s.identities.forget(details.User.ID)
+	factor, err := s.db.GetTOTPFactor(r.Context(), details.User.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if !factor.Enabled() {
+		if err := s.logins.Succeed(r.Context(), details.User.Email); err != nil {
+			return err
+		}
+		if err := s.setAuthCookie(w, r, details); err != nil {
+			return err
+		}
+		return hxRedirect(w, r, next)
+	}
+
+	sess, _ := s.getSession(r)
+	sess.Values[types.TwoFactorPendingKey] = pendingLogin{
+		UserID:       details.User.ID,
+		Email:        details.User.Email,
+		AccessToken:  details.AccessToken,
+		RefreshToken: details.RefreshToken,
+		ExpiresIn:    details.ExpiresIn,
+		Next:         next,
+		ExpiresAt:    time.Now().Add(twoFactorTTL),
+	}
+	if err := sess.Save(r, w); err != nil {
+		return err
+	}
+
+	return hxRedirect(w, r, "/login/2fa")
+}
+
+func (s *Server) pendingLogin(r *http.Request) (pendingLogin, bool) {
+	sess, _ := s.getSession(r)
+	pending, ok := sess.Values[types.TwoFactorPendingKey].(pendingLogin)
+	if !ok || time.Now().After(pending.ExpiresAt) {
+		return pendingLogin{}, false
+	}
+
+	return pending, true
+}
+
+func (s *Server) HandleTwoFactorIndex(w http.ResponseWriter, r *http.Request) error {
+	if _, ok := s.pendingLogin(r); !ok {
+		return hxRedirect(w, r, "/login")
+	}
+
+	return render(r, w, auth.TwoFactorChallenge())
+}
+
+func (s *Server) HandleTwoFactorPost(w http.ResponseWriter, r *http.Request) error {
+	pending, ok := s.pendingLogin(r)
+	if !ok {
+		return hxRedirect(w, r, "/login")
+	}
+
+	sess, _ := s.getSession(r)
+	valid, err := s.verifySecondFactor(r.Context(), pending.UserID, r.FormValue("code"))
+	if err != nil {
+		return err
+	}
+	if !valid {
+		if id, err := uuid.Parse(pending.UserID); err == nil {
+			s.recordAudit(r, types.AuditLoginFailed, id, map[string]string{"reason": "invalid_second_factor"})
+		}
+		// Restarting the login does not start the count over, the lockout
+		// keeps counting across logins.
+		wait, err := s.logins.Fail(r.Context(), session.ClientIP(r), pending.Email)
+		if err != nil {
+			return err
+		}
+		pending.Attempts++
+		if pending.Attempts >= twoFactorMaxAttempts || wait > 0 {
+			slog.Warn("too many two-factor attempts", "user", pending.UserID)
+			delete(sess.Values, types.TwoFactorPendingKey)
+			s.signOut(r, pending.AccessToken, sb.ScopeLocal)
+			if err := sess.Save(r, w); err != nil {
+				return err
+			}
+			msg := "Too many attempts, please log in again."
+			if wait > 0 {
+				msg = tooManyAttempts(wait)
+			}
+			return render(r, w, auth.TwoFactorForm(auth.TwoFactorErrors{
+				Code: msg,
+			}))
+		}
+		sess.Values[types.TwoFactorPendingKey] = pending
+		if err := sess.Save(r, w); err != nil {
+			return err
+		}
+		return render(r, w, auth.TwoFactorForm(auth.TwoFactorErrors{
+			Code: "Invalid code.",
+		}))
+	}
+
+	delete(sess.Values, types.TwoFactorPendingKey)
+	if err := s.logins.Succeed(r.Context(), pending.Email); err != nil {
+		return err
+	}
+	if err := s.setAuthCookie(w, r, pending.details()); err != nil {
+		return err
+	}
+
+	return hxRedirect(w, r, pending.Next)
+}
+
+// verifySecondFactor accepts a code from the authenticator app or an unused
+// recovery code. Either can only be used once.
+func (s *Server) verifySecondFactor(ctx context.Context, userID string, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == 0 {
+		return false, nil
+	}
+
+	if !totpCode.MatchString(code) {
+		return s.db.UseRecoveryCode(ctx, userID, totp.HashRecoveryCode(code))
+	}
+
+	factor, err := s.db.GetTOTPFactor(ctx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	step, err := totp.Validate(factor.Secret, code, factor.LastUsedStep, time.Now())
+	if err != nil {
+		if errors.Is(err, totp.ErrInvalidCode) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return s.db.UseTOTPStep(ctx, userID, step)
+}
+
+// HandleTwoFactorSetupPost starts the enrollment with a new secret, which
+// only takes effect once confirmed with a code.
+func (s *Server) HandleTwoFactorSetupPost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	factor, err := s.db.GetTOTPFactor(r.Context(), user.ID.String())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if factor.Enabled() {
+		return render(r, w, settings.TwoFactor(true, settings.TwoFactorErrors{}))
+	}
+
+	key, err := totp.Generate(totpIssuer, user.Email)
+	if err != nil {
+		return err
+	}
+	if err := s.db.SaveTOTPFactor(r.Context(), &types.TOTPFactor{
+		UserID: user.ID,
+		Secret: key.Secret,
+	}); err != nil {
+		return err
+	}
+
+	params := settings.TwoFactorSetupParams{Secret: key.Secret, QRCode: key.QRCode}
+
+	return render(r, w, settings.TwoFactorSetup(params, settings.TwoFactorErrors{}))
+}
+
+func (s *Server) HandleTwoFactorConfirmPost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+	factor, err := s.db.GetTOTPFactor(r.Context(), user.ID.String())
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return render(r, w, settings.TwoFactor(false, settings.TwoFactorErrors{}))
+		}
+		return err
+	}
+	if factor.Enabled() {
+		return render(r, w, settings.TwoFactor(true, settings.TwoFactorErrors{}))
+	}
+
+	step, err := totp.Validate(factor.Secret, r.FormValue("code"), 0, time.Now())
+	if err != nil {
+		if !errors.Is(err, totp.ErrInvalidCode) {
+			return err
+		}
+		key, err := totp.FromSecret(totpIssuer, user.Email, factor.Secret)
+		if err != nil {
+			return err
+		}
+		params := settings.TwoFactorSetupParams{Secret: key.Secret, QRCode: key.QRCode}
+		return render(r, w, settings.TwoFactorSetup(params, settings.TwoFactorErrors{
+			Code: "Invalid code, please try again.",
+		}))
+	}
+
+	codes, err := totp.RecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err := s.db.ReplaceRecoveryCodes(r.Context(), user.ID.String(), recoveryCodes(user.ID, codes)); err != nil {
+		return err
+	}
+	factor.LastUsedStep = step
+	factor.ConfirmedAt = time.Now()
+	if err := s.db.SaveTOTPFactor(r.Context(), &factor); err != nil {
+		return err
+	}
+	slog.Info("two-factor authentication enabled", "user", user.ID)
+
+	return render(r, w, settings.RecoveryCodes(codes))
+}
+
+// HandleTwoFactorDisablePost turns two-factor authentication off after the
+// user proves both factors again, the first one by email for users without
+// a password.
+func (s *Server) HandleTwoFactorDisablePost(w http.ResponseWriter, r *http.Request) error {
+	user := getAuthenticatedUser(r)
+
+	msg, err := s.reauthenticate(w, r, user, r.FormValue("password"))
+	if err != nil {
+		return err
+	}
+	if len(msg) > 0 {
+		return render(r, w, settings.TwoFactor(true, settings.TwoFactorErrors{
+			Password: msg,
+		}))
+	}
+
+	valid, err := s.verifySecondFactor(r.Context(), user.ID.String(), r.FormValue("code"))
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return render(r, w, settings.TwoFactor(true, settings.TwoFactorErrors{
+			Code: "Invalid code.",
+		}))
+	}
+
+	if err := s.db.DeleteTOTPFactor(r.Context(), user.ID.String()); err != nil {
+		return err
+	}
+	slog.Info("two-factor authentication disabled", "user", user.ID)
+
+	return render(r, w, settings.TwoFactor(false, settings.TwoFactorErrors{}))
+}
+
+func recoveryCodes(userID uuid.UUID, codes []string) []types.RecoveryCode {
+	hashed := make([]types.RecoveryCode, len(codes))
+	for i, code := range codes {
+		hashed[i] = types.RecoveryCode{
+			UserID:   userID,
+			CodeHash: totp.HashRecoveryCode(code),
+		}
+	}
+
+	return hashed
+}
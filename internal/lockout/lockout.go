@@ -0,0 +1,146 @@
+package lockout
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"dreampicai/types"
+)
+
+const (
+	defaultEmailThreshold = 5
+	defaultIPThreshold    = 20
+	baseDelay             = 30 * time.Second
+	maxDelay              = time.Hour
+	// window is how long failures are remembered after the last one.
+	window = 24 * time.Hour
+)
+
+// Repository persists login attempts, it is implemented by database.Service.
+type Repository interface {
+	GetLoginAttempts(context.Context, ...string) ([]types.LoginAttempt, error)
+	RecordLoginFailure(context.Context, string, time.Time) (types.LoginAttempt, error)
+	LockLogin(context.Context, *types.LoginAttempt, *types.Lockout) error
+	ClearLoginAttempts(context.Context, string) error
+}
+
+// Limiter tracks failed logins per email and per IP address. Once a key
+// reaches its threshold it is locked out, for twice as long after every
+// further failure.
+type Limiter struct {
+	repo Repository
+
+	EmailThreshold int
+	IPThreshold    int
+}
+
+// NewLimiter configures the thresholds from LOGIN_LOCKOUT_EMAIL_THRESHOLD
+// and LOGIN_LOCKOUT_IP_THRESHOLD.
+func NewLimiter(repo Repository) *Limiter {
+	return &Limiter{
+		repo:           repo,
+		EmailThreshold: intFromEnv("LOGIN_LOCKOUT_EMAIL_THRESHOLD", defaultEmailThreshold),
+		IPThreshold:    intFromEnv("LOGIN_LOCKOUT_IP_THRESHOLD", defaultIPThreshold),
+	}
+}
+
+func intFromEnv(key string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return fallback
+	}
+
+	return n
+}
+
+// Check returns how long until a login for email from ip is allowed again,
+// zero when it is allowed now.
+func (l *Limiter) Check(ctx context.Context, ip string, email string) (time.Duration, error) {
+	attempts, err := l.repo.GetLoginAttempts(ctx, ipKey(ip), emailKey(email))
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, a := range attempts {
+		if a.Locked(now) && a.LockedUntil.Sub(now) > wait {
+			wait = a.LockedUntil.Sub(now)
+		}
+	}
+
+	return wait, nil
+}
+
+// Fail records a failed login and returns how long the resulting lockout
+// lasts, zero when there is none.
+func (l *Limiter) Fail(ctx context.Context, ip string, email string) (time.Duration, error) {
+	var wait time.Duration
+	for _, k := range []struct {
+		key       string
+		threshold int
+	}{
+		{ipKey(ip), l.IPThreshold},
+		{emailKey(email), l.EmailThreshold},
+	} {
+		attempt, err := l.repo.RecordLoginFailure(ctx, k.key, time.Now().Add(-window))
+		if err != nil {
+			return 0, err
+		}
+		if attempt.Failures < k.threshold {
+			continue
+		}
+
+		d := delay(attempt.Failures - k.threshold)
+		attempt.LockedUntil = time.Now().Add(d)
+		if err := l.repo.LockLogin(ctx, &attempt, &types.Lockout{
+			Key:         k.key,
+			IP:          ip,
+			Email:       NormalizeEmail(email),
+			Failures:    attempt.Failures,
+			LockedUntil: attempt.LockedUntil,
+		}); err != nil {
+			return 0, err
+		}
+		slog.Warn("login locked out", "key", k.key, "ip", ip, "failures", attempt.Failures, "until", attempt.LockedUntil)
+		if d > wait {
+			wait = d
+		}
+	}
+
+	return wait, nil
+}
+
+// Succeed forgets the failures for email. Failures from the IP address
+// are kept, one valid account must not unlock guessing others.
+func (l *Limiter) Succeed(ctx context.Context, email string) error {
+	return l.repo.ClearLoginAttempts(ctx, emailKey(email))
+}
+
+// delay doubles the lockout for every failure past the threshold.
+func delay(over int) time.Duration {
+	d := baseDelay
+	for i := 0; i < over && d < maxDelay; i++ {
+		d *= 2
+	}
+
+	return min(d, maxDelay)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func emailKey(email string) string {
+	return "email:" + NormalizeEmail(email)
+}
+
+// NormalizeEmail is how emails are stored with lockouts, and must be
+// looked up.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,318 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"dreampicai/types"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	defaultIdleTimeout     = 7 * 24 * time.Hour
+	defaultAbsoluteTimeout = 30 * 24 * time.Hour
+	// touchInterval limits how often last_seen_at is written for a session.
+	touchInterval = time.Minute
+)
+
+// Repository persists sessions, it is implemented by database.Service.
+type Repository interface {
+	CreateSession(context.Context, *types.Session) error
+	GetSession(context.Context, string) (types.Session, error)
+	UpdateSession(context.Context, *types.Session) error
+	DeleteSession(context.Context, string) error
+	DeleteExpiredSessions(context.Context, time.Time) (int64, error)
+}
+
+// Store is a gorilla sessions.Store keeping session data server side. The
+// cookie only carries an opaque id, rows are looked up by its hash.
+type Store struct {
+	repo    Repository
+	Options *sessions.Options
+
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+}
+
+// NewStore configures the timeouts from SESSION_IDLE_TIMEOUT and
+// SESSION_ABSOLUTE_TIMEOUT, both Go durations.
+func NewStore(repo Repository) *Store {
+	s := &Store{
+		repo:            repo,
+		IdleTimeout:     durationFromEnv("SESSION_IDLE_TIMEOUT", defaultIdleTimeout),
+		AbsoluteTimeout: durationFromEnv("SESSION_ABSOLUTE_TIMEOUT", defaultAbsoluteTimeout),
+	}
+	s.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(s.AbsoluteTimeout.Seconds()),
+		Secure:   os.Getenv("SESSION_SECURE_COOKIE") == "true",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	return s
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return fallback
+	}
+
+	return d
+}
+
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	opts := *s.Options
+	sess.Options = &opts
+	sess.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return sess, nil
+	}
+
+	row, err := s.repo.GetSession(r.Context(), hash(cookie.Value))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return sess, nil
+		}
+		return sess, err
+	}
+	if s.expired(row) {
+		if err := s.repo.DeleteSession(r.Context(), row.ID); err != nil {
+			slog.Error("deleting expired session failed", "err", err)
+		}
+		return sess, nil
+	}
+	if sess.Values, err = Values(row); err != nil {
+		return sess, err
+	}
+	sess.ID = cookie.Value
+	sess.IsNew = false
+
+	if time.Since(row.LastSeenAt) > touchInterval {
+		row.LastSeenAt = time.Now()
+		row.IP = ClientIP(r)
+		if err := s.repo.UpdateSession(r.Context(), &row); err != nil {
+			slog.Error("updating session last seen failed", "err", err)
+		}
+	}
+
+	return sess, nil
+}
+
+// Save persists the session and refreshes the cookie. A negative MaxAge
+// deletes the session.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	if sess.Options.MaxAge < 0 {
+		if len(sess.ID) > 0 {
+			if err := s.repo.DeleteSession(r.Context(), hash(sess.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(sess.Name(), "", sess.Options))
+		return nil
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(sess.Values); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	userID, _ := uuid.Parse(stringValue(sess.Values[types.UserIDKey]))
+	if len(sess.ID) == 0 {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		row := types.Session{
+			ID:         hash(id),
+			UserID:     userID,
+			Data:       data.Bytes(),
+			UserAgent:  r.UserAgent(),
+			IP:         ClientIP(r),
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  now.Add(s.AbsoluteTimeout),
+		}
+		if err := s.repo.CreateSession(r.Context(), &row); err != nil {
+			return err
+		}
+		sess.ID = id
+	} else {
+		row := types.Session{
+			ID:         hash(sess.ID),
+			UserID:     userID,
+			Data:       data.Bytes(),
+			LastSeenAt: now,
+			IP:         ClientIP(r),
+		}
+		if err := s.repo.UpdateSession(r.Context(), &row); err != nil {
+			return err
+		}
+	}
+
+	http.SetCookie(w, sessions.NewCookie(sess.Name(), sess.ID, sess.Options))
+
+	return nil
+}
+
+// Regenerate drops the stored session so the next Save issues a new id,
+// the values are kept. Used on login against session fixation.
+func (s *Store) Regenerate(ctx context.Context, sess *sessions.Session) error {
+	if len(sess.ID) > 0 {
+		if err := s.repo.DeleteSession(ctx, hash(sess.ID)); err != nil {
+			return err
+		}
+	}
+	sess.ID = ""
+	sess.IsNew = true
+
+	return nil
+}
+
+// Key returns the id the session is stored under.
+func Key(sess *sessions.Session) string {
+	if len(sess.ID) == 0 {
+		return ""
+	}
+
+	return hash(sess.ID)
+}
+
+// Values decodes the data of a stored session.
+func Values(row types.Session) (map[interface{}]interface{}, error) {
+	values := map[interface{}]interface{}{}
+	err := gob.NewDecoder(bytes.NewReader(row.Data)).Decode(&values)
+
+	return values, err
+}
+
+// Cleanup deletes expired sessions every interval until ctx is done.
+func (s *Store) Cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.repo.DeleteExpiredSessions(ctx, time.Now().Add(-s.IdleTimeout))
+			if err != nil {
+				slog.Error("session cleanup failed", "err", err)
+				continue
+			}
+			if n > 0 {
+				slog.Info("expired sessions deleted", "count", n)
+			}
+		}
+	}
+}
+
+func (s *Store) expired(row types.Session) bool {
+	now := time.Now()
+	return now.After(row.ExpiresAt) || now.After(row.LastSeenAt.Add(s.IdleTimeout))
+}
+
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClientIP returns the address the request came from, without the port.
+// X-Forwarded-For is only believed when the peer is one of the proxies in
+// TRUSTED_PROXIES, a comma separated list of CIDRs. It is read from the
+// right, the first hop that is not a trusted proxy is the client.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	proxies := trustedProxies()
+	if !trusted(proxies, host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !trusted(proxies, hop) {
+			break
+		}
+	}
+
+	return host
+}
+
+func trustedProxies() []*net.IPNet {
+	var proxies []*net.IPNet
+	for _, cidr := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			slog.Warn("ignoring invalid trusted proxy", "cidr", cidr, "err", err)
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies
+}
+
+func trusted(proxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,301 @@
+package takeout
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"dreampicai/types"
+
+	"github.com/google/uuid"
+	"github.com/nedpals/supabase-go"
+)
+
+// Repository is what an export reads, it is implemented by
+// database.Service.
+type Repository interface {
+	GetAccountByUserID(context.Context, string) (types.Account, error)
+	GetSessionsByUserID(context.Context, string) ([]types.Session, error)
+	GetKnownDevicesByUserID(context.Context, string) ([]types.KnownDevice, error)
+	GetPersonalAccessTokensByUserID(context.Context, string) ([]types.PersonalAccessToken, error)
+	GetPasskeysByAccountID(context.Context, int) ([]types.Passkey, error)
+	GetTOTPFactor(context.Context, string) (types.TOTPFactor, error)
+	GetRecoveryCodes(context.Context, string) ([]types.RecoveryCode, error)
+	GetAccountDeletions(context.Context, string) ([]types.AccountDeletion, error)
+	GetAuditEventsByUserID(context.Context, string, string, int) ([]types.AuditEvent, error)
+}
+
+const readme = `This archive holds the data dreampicai keeps about you.
+
+account.json            your profile
+identity.json           your login identity
+sessions.json           the devices you are logged in on
+known_devices.json      when the devices you logged in from were seen
+tokens.json             your personal access tokens, without the tokens
+passkeys.json           your passkeys, without their keys
+two_factor.json         whether two-factor authentication is on and the use
+                        of your recovery codes, without any secret
+account_deletions.json  your account deletion requests
+security_activity.json  logins and changes to your account
+`
+
+// Build returns a ZIP archive of everything stored about the user, as JSON
+// files. Secrets such as session tokens or the TOTP secret are left out.
+func Build(ctx context.Context, repo Repository, identity supabase.User) ([]byte, error) {
+	userID, err := uuid.Parse(identity.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]any{
+		"identity.json": exportIdentity(identity),
+	}
+
+	account, err := repo.GetAccountByUserID(ctx, userID.String())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	files["account.json"] = account
+
+	sessions, err := repo.GetSessionsByUserID(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	files["sessions.json"] = exportSessions(sessions)
+
+	knownDevices, err := repo.GetKnownDevicesByUserID(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	files["known_devices.json"] = exportKnownDevices(knownDevices)
+
+	tokens, err := repo.GetPersonalAccessTokensByUserID(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	files["tokens.json"] = exportTokens(tokens)
+
+	passkeys, err := repo.GetPasskeysByAccountID(ctx, account.ID)
+	if err != nil {
+		return nil, err
+	}
+	files["passkeys.json"] = exportPasskeys(passkeys)
+
+	factor, err := repo.GetTOTPFactor(ctx, userID.String())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	codes, err := repo.GetRecoveryCodes(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	files["two_factor.json"] = exportTwoFactor(factor, codes)
+
+	deletions, err := repo.GetAccountDeletions(ctx, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	files["account_deletions.json"] = deletions
+
+	events, err := repo.GetAuditEventsByUserID(ctx, userID.String(), identity.Email, 0)
+	if err != nil {
+		return nil, err
+	}
+	files["security_activity.json"] = exportActivity(userID, events)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if err := writeFile(zw, "README.txt", []byte(readme)); err != nil {
+		return nil, err
+	}
+	for name, v := range files {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFile(zw, name, data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeFile(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+
+	return err
+}
+
+type identity struct {
+	ID           string                 `json:"id"`
+	Email        string                 `json:"email"`
+	ConfirmedAt  time.Time              `json:"confirmed_at"`
+	CreatedAt    time.Time              `json:"created_at"`
+	UpdatedAt    time.Time              `json:"updated_at"`
+	UserMetadata map[string]interface{} `json:"user_metadata"`
+}
+
+func exportIdentity(u supabase.User) identity {
+	return identity{
+		ID:           u.ID,
+		Email:        u.Email,
+		ConfirmedAt:  u.ConfirmedAt,
+		CreatedAt:    u.CreatedAt,
+		UpdatedAt:    u.UpdatedAt,
+		UserMetadata: u.UserMetadata,
+	}
+}
+
+type session struct {
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+func exportSessions(sessions []types.Session) []session {
+	out := make([]session, len(sessions))
+	for i, s := range sessions {
+		out[i] = session{
+			UserAgent:  s.UserAgent,
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+		}
+	}
+
+	return out
+}
+
+// knownDevice leaves out the fingerprint, a hash of the browser and
+// address, and the token of the new device alert link.
+type knownDevice struct {
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+func exportKnownDevices(devices []types.KnownDevice) []knownDevice {
+	out := make([]knownDevice, len(devices))
+	for i, d := range devices {
+		out[i] = knownDevice{CreatedAt: d.CreatedAt, LastSeenAt: d.LastSeenAt}
+	}
+
+	return out
+}
+
+type token struct {
+	Name       string             `json:"name"`
+	Prefix     string             `json:"prefix"`
+	Scopes     []types.TokenScope `json:"scopes"`
+	CreatedAt  time.Time          `json:"created_at"`
+	ExpiresAt  time.Time          `json:"expires_at"`
+	LastUsedAt time.Time          `json:"last_used_at"`
+}
+
+func exportTokens(tokens []types.PersonalAccessToken) []token {
+	out := make([]token, len(tokens))
+	for i, t := range tokens {
+		out[i] = token{
+			Name:       t.Name,
+			Prefix:     t.Prefix,
+			Scopes:     t.Scopes,
+			CreatedAt:  t.CreatedAt,
+			ExpiresAt:  t.ExpiresAt,
+			LastUsedAt: t.LastUsedAt,
+		}
+	}
+
+	return out
+}
+
+type passkey struct {
+	Name       string    `json:"name"`
+	Transports []string  `json:"transports"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func exportPasskeys(passkeys []types.Passkey) []passkey {
+	out := make([]passkey, len(passkeys))
+	for i, p := range passkeys {
+		out[i] = passkey{
+			Name:       p.Name,
+			Transports: p.Transports,
+			CreatedAt:  p.CreatedAt,
+			LastUsedAt: p.LastUsedAt,
+		}
+	}
+
+	return out
+}
+
+type recoveryCode struct {
+	CreatedAt time.Time `json:"created_at"`
+	UsedAt    time.Time `json:"used_at"`
+}
+
+type twoFactor struct {
+	Enabled       bool           `json:"enabled"`
+	ConfirmedAt   time.Time      `json:"confirmed_at"`
+	RecoveryCodes []recoveryCode `json:"recovery_codes"`
+}
+
+func exportTwoFactor(factor types.TOTPFactor, codes []types.RecoveryCode) twoFactor {
+	out := twoFactor{
+		Enabled:       factor.Enabled(),
+		ConfirmedAt:   factor.ConfirmedAt,
+		RecoveryCodes: make([]recoveryCode, len(codes)),
+	}
+	for i, c := range codes {
+		out.RecoveryCodes[i] = recoveryCode{CreatedAt: c.CreatedAt, UsedAt: c.UsedAt}
+	}
+
+	return out
+}
+
+type activity struct {
+	Action    string            `json:"action"`
+	ByAdmin   bool              `json:"by_admin"`
+	IP        string            `json:"ip,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// exportActivity leaves out where admins acted from, only the user's own
+// devices are theirs to see.
+func exportActivity(userID uuid.UUID, events []types.AuditEvent) []activity {
+	out := make([]activity, len(events))
+	for i, e := range events {
+		out[i] = activity{
+			Action:    e.Action,
+			ByAdmin:   e.ActorID != uuid.Nil && e.ActorID != userID,
+			Details:   e.Metadata,
+			CreatedAt: e.CreatedAt,
+		}
+		if !out[i].ByAdmin {
+			out[i].IP = e.IP
+			out[i].UserAgent = e.UserAgent
+		}
+	}
+
+	return out
+}
@@ -13,6 +13,9 @@ var (
 	urlRegex   = regexp.MustCompile(`^(http(s)?://)?([\da-z\.-]+)\.([a-z\.]{2,6})([/\w \.-]*)*/?$`)
 )
 
+// MinPasswordLength is the shortest password Password accepts.
+const MinPasswordLength = 8
+
 type RuleFunc func() RuleSet
 
 type RuleSet struct {
@@ -105,7 +108,7 @@ func Email() RuleSet {
 func Equal(s string) RuleFunc {
 	return func() RuleSet {
 		return RuleSet{
-			Name:      "max",
+			Name:      "equal",
 			RuleValue: s,
 			ValidateFunc: func(set RuleSet) bool {
 				str, ok := set.FieldValue.(string)
@@ -191,16 +194,22 @@ func (v *Validator) Validate(target any) bool {
 			continue
 		}
 		fieldValue := getFieldValueByName(v.data, fieldName)
+		failed := false
 		for _, set := range ruleSets {
 			set.FieldValue = fieldValue
 			set.FieldName = fieldName
+			// A message replaces the one of the rules before it, when one
+			// of them failed.
 			if set.Name == "message" {
-				setErrorMessage(target, fieldName, set.RuleValue.(string))
+				if failed {
+					setErrorMessage(target, fieldName, set.RuleValue.(string))
+				}
 				continue
 			}
 			if !set.ValidateFunc(set) {
 				msg := set.MessageFunc(set)
 				setErrorMessage(target, fieldName, msg)
+				failed = true
 				ok = false
 			}
 		}
@@ -256,8 +265,8 @@ func ValidatePassword(password string) (string, bool) {
 		specialRunes = "!@#$%^&*"
 	)
 
-	if len(password) < 8 {
-		return "Password must contain at least 8 characters", false
+	if len(password) < MinPasswordLength {
+		return fmt.Sprintf("Password must contain at least %d characters", MinPasswordLength), false
 	}
 
 	for _, char := range password {
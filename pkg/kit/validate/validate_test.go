@@ -48,6 +48,18 @@ func TestCustomMessage(t *testing.T) {
 	asserteq(t, "name not good", errs["Name"])
 }
 
+func TestCustomMessageValid(t *testing.T) {
+	data := struct {
+		Name string
+	}{Name: "foo"}
+	errs := map[string]string{}
+	ok := New(data, Fields{
+		"Name": Rules(Required, Message("name not good")),
+	}).Validate(errs)
+	assertTrue(t, ok)
+	asserteq(t, 0, len(errs))
+}
+
 func TestRequired(t *testing.T) {
 	data := struct {
 		Name string
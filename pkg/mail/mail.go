@@ -0,0 +1,107 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers the emails the application sends itself. Auth emails
+// are sent by the auth backend.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns the sender selected by MAIL_PROVIDER. SMTP is the default,
+// configured from SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and
+// MAIL_FROM; "memory" keeps the emails in memory and logs them, for local
+// development.
+func New() (Sender, error) {
+	if os.Getenv("MAIL_PROVIDER") == "memory" {
+		slog.Warn("MAIL_PROVIDER is memory, emails are only logged")
+		return NewMemorySender(), nil
+	}
+
+	host := os.Getenv("SMTP_HOST")
+	if len(host) == 0 {
+		return nil, errors.New("smtp host is required")
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if len(port) == 0 {
+		port = "587"
+	}
+	s := &smtpSender{
+		addr: net.JoinHostPort(host, port),
+		from: os.Getenv("MAIL_FROM"),
+	}
+	if username := os.Getenv("SMTP_USERNAME"); len(username) > 0 {
+		s.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	return s, nil
+}
+
+type smtpSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (s *smtpSender) Send(_ context.Context, msg Message) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return fmt.Errorf("mail: invalid header in message to %q", msg.To)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, []byte(b.String()))
+}
+
+// MemorySender keeps the emails instead of sending them, for tests and
+// local development.
+type MemorySender struct {
+	mu     sync.Mutex
+	outbox []Message
+}
+
+func NewMemorySender() *MemorySender {
+	return &MemorySender{}
+}
+
+func (s *MemorySender) Send(_ context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slog.Info("mail", "to", msg.To, "subject", msg.Subject)
+	s.outbox = append(s.outbox, msg)
+
+	return nil
+}
+
+// Outbox returns the emails sent so far.
+func (s *MemorySender) Outbox() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Message(nil), s.outbox...)
+}
@@ -0,0 +1,138 @@
+package sb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testClaims(exp time.Time) Claims {
+	return Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "8f0c9a1e-4a53-4c5b-9c0e-4a0b3f1f2d11",
+			Audience:  jwt.ClaimStrings{"authenticated"},
+			ExpiresAt: jwt.NewNumericDate(exp),
+		},
+		Email: "foo@bar.com",
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if len(kid) > 0 {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestVerifyHS256(t *testing.T) {
+	v := NewVerifier("super-secret", "")
+	t.Run("valid", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, "", []byte("super-secret"), testClaims(time.Now().Add(time.Hour)))
+		claims, err := v.Verify(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Email != "foo@bar.com" {
+			t.Fatalf("expected email claim, got %q", claims.Email)
+		}
+	})
+	t.Run("wrong secret", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, "", []byte("other-secret"), testClaims(time.Now().Add(time.Hour)))
+		if _, err := v.Verify(context.Background(), token); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, "", []byte("super-secret"), testClaims(time.Now().Add(-time.Minute)))
+		if _, err := v.Verify(context.Background(), token); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("no secret", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodHS256, "", []byte("super-secret"), testClaims(time.Now().Add(time.Hour)))
+		if _, err := NewVerifier("", "").Verify(context.Background(), token); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestVerifyJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{
+				{
+					"kid": "rsa-1",
+					"kty": "RSA",
+					"n":   b64(rsaKey.N.Bytes()),
+					"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+				},
+				{
+					"kid": "ec-1",
+					"kty": "EC",
+					"crv": "P-256",
+					"x":   b64(ecKey.X.FillBytes(make([]byte, 32))),
+					"y":   b64(ecKey.Y.FillBytes(make([]byte, 32))),
+				},
+			},
+		})
+	}))
+	defer srv.Close()
+
+	v := NewVerifier("", srv.URL)
+	exp := time.Now().Add(time.Hour)
+
+	t.Run("RS256", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, testClaims(exp))
+		if _, err := v.Verify(context.Background(), token); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("ES256", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodES256, "ec-1", ecKey, testClaims(exp))
+		if _, err := v.Verify(context.Background(), token); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("unknown kid", func(t *testing.T) {
+		token := sign(t, jwt.SigningMethodRS256, "rsa-2", rsaKey, testClaims(exp))
+		if _, err := v.Verify(context.Background(), token); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected jwks to be fetched once, got %d", n)
+	}
+}
@@ -0,0 +1,611 @@
+package sb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/nedpals/supabase-go"
+)
+
+var (
+	ErrUserExists         = errors.New("user already registered")
+	ErrInvalidCredentials = errors.New("invalid login credentials")
+	ErrInvalidToken       = errors.New("invalid token")
+	ErrUserNotFound       = errors.New("user not found")
+)
+
+type memoryUser struct {
+	user     supabase.User
+	password string
+}
+
+// Mail is an email the memory provider would have sent.
+type Mail struct {
+	To   string
+	Type string
+	Link string
+	Code string
+}
+
+type memoryOTP struct {
+	code      string
+	expiresAt time.Time
+}
+
+type memoryCode struct {
+	email     string
+	challenge string
+	// newEmail is set for an email change, which applies once the code is
+	// exchanged.
+	newEmail string
+	// confirm is set for codes mailed to the user, exchanging one proves
+	// they own the address.
+	confirm bool
+}
+
+type memoryToken struct {
+	email     string
+	session   string
+	expiresAt time.Time
+}
+
+// MemoryProvider is an in-memory AuthProvider for tests and local
+// development. Users are confirmed as soon as they sign up, unless
+// RequireConfirmation is set.
+type MemoryProvider struct {
+	mu            sync.Mutex
+	secret        []byte
+	verifier      *Verifier
+	users         map[string]*memoryUser
+	tokens        map[string]memoryToken
+	refreshTokens map[string]memoryToken
+	otps          map[string]memoryOTP
+	codes         map[string]memoryCode
+
+	// TokenTTL is the lifetime of issued access tokens.
+	TokenTTL time.Duration
+	// ProviderUser is the email of the user OAuth logins authenticate as.
+	ProviderUser string
+	// RequireConfirmation leaves new users unconfirmed until they open a
+	// link mailed to them. They can still sign in, like with Supabase when
+	// unconfirmed sign ins are allowed.
+	RequireConfirmation bool
+
+	outbox []Mail
+}
+
+func NewMemoryProvider() *MemoryProvider {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+
+	return &MemoryProvider{
+		secret:        secret,
+		verifier:      NewVerifier(string(secret), ""),
+		users:         map[string]*memoryUser{},
+		tokens:        map[string]memoryToken{},
+		refreshTokens: map[string]memoryToken{},
+		otps:          map[string]memoryOTP{},
+		codes:         map[string]memoryCode{},
+		TokenTTL:      time.Hour,
+	}
+}
+
+func (p *MemoryProvider) SignUp(_ context.Context, credentials supabase.UserCredentials) (*supabase.User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.users[credentials.Email]; ok {
+		return nil, ErrUserExists
+	}
+
+	now := time.Now()
+	u := &memoryUser{
+		user: supabase.User{
+			ID:        uuid.NewString(),
+			Aud:       "authenticated",
+			Role:      "authenticated",
+			Email:     credentials.Email,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		password: credentials.Password,
+	}
+	p.users[credentials.Email] = u
+	if p.RequireConfirmation {
+		// SignUp takes no redirect, so the mail has no link that would
+		// work here. ResendConfirmation sends one.
+		u.user.ConfirmationSentAt = now
+		p.outbox = append(p.outbox, Mail{To: u.user.Email, Type: "signup"})
+	} else {
+		u.user.ConfirmedAt = now
+	}
+
+	user := u.user
+	return &user, nil
+}
+
+func (p *MemoryProvider) SignIn(_ context.Context, credentials supabase.UserCredentials) (*supabase.AuthenticatedDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, ok := p.users[credentials.Email]
+	if !ok || u.password != credentials.Password {
+		return nil, ErrInvalidCredentials
+	}
+
+	return p.issueTokens(u, "")
+}
+
+// RefreshUser rotates the refresh token, so each one can only be used once.
+func (p *MemoryProvider) RefreshUser(_ context.Context, _ string, refreshToken string) (*supabase.AuthenticatedDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.refreshTokens[refreshToken]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	delete(p.refreshTokens, refreshToken)
+
+	u, ok := p.users[t.email]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	return p.issueTokens(u, t.session)
+}
+
+func (p *MemoryProvider) User(_ context.Context, userToken string) (*supabase.User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, err := p.userByToken(userToken)
+	if err != nil {
+		return nil, err
+	}
+
+	user := u.user
+	return &user, nil
+}
+
+func (p *MemoryProvider) UpdateUser(_ context.Context, userToken string, updateData map[string]interface{}) (*supabase.User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, err := p.userByToken(userToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if password, ok := updateData["password"].(string); ok {
+		u.password = password
+	}
+	if data, ok := updateData["data"].(map[string]interface{}); ok {
+		if u.user.UserMetadata == nil {
+			u.user.UserMetadata = map[string]interface{}{}
+		}
+		for k, v := range data {
+			u.user.UserMetadata[k] = v
+		}
+	}
+	u.user.UpdatedAt = time.Now()
+
+	user := u.user
+	return &user, nil
+}
+
+// SignInWithProvider sends the user straight back to RedirectTo, there is no
+// third party to authenticate against. With the PKCE flow the redirect
+// carries a code for ProviderUser, when set.
+func (p *MemoryProvider) SignInWithProvider(opts supabase.ProviderSignInOptions) (*supabase.ProviderSignInDetails, error) {
+	if _, err := url.Parse(opts.RedirectTo); err != nil {
+		return nil, err
+	}
+
+	details := &supabase.ProviderSignInDetails{
+		URL:      opts.RedirectTo,
+		Provider: opts.Provider,
+	}
+	if opts.FlowType != supabase.PKCE {
+		return details, nil
+	}
+
+	pkce, err := NewPKCEParams()
+	if err != nil {
+		return nil, err
+	}
+	details.CodeVerifier = pkce.Verifier
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if u, ok := p.users[p.ProviderUser]; ok {
+		details.URL, err = p.codeLink(memoryCode{email: u.user.Email, challenge: pkce.Challenge}, opts.RedirectTo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return details, nil
+}
+
+func (p *MemoryProvider) ExchangeCode(_ context.Context, opts supabase.ExchangeCodeOpts) (*supabase.AuthenticatedDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	code, ok := p.codes[opts.AuthCode]
+	if !ok || code.challenge != codeChallenge(opts.CodeVerifier) {
+		return nil, ErrInvalidToken
+	}
+	delete(p.codes, opts.AuthCode)
+
+	u, ok := p.users[code.email]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	if len(code.newEmail) > 0 {
+		if err := p.changeEmail(u, code.newEmail); err != nil {
+			return nil, err
+		}
+	}
+	if code.confirm {
+		confirm(u)
+	}
+
+	return p.issueTokens(u, "")
+}
+
+// ChangeEmail only supports the PKCE flow. The confirmation link carries a
+// code, exchanging it applies the change.
+func (p *MemoryProvider) ChangeEmail(_ context.Context, userToken string, email string, opts EmailLinkOptions) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, err := p.userByToken(userToken)
+	if err != nil {
+		return err
+	}
+	if _, ok := p.users[email]; ok {
+		return ErrUserExists
+	}
+
+	link, err := p.codeLink(memoryCode{email: u.user.Email, challenge: opts.CodeChallenge, newEmail: email}, opts.RedirectTo)
+	if err != nil {
+		return err
+	}
+	p.outbox = append(p.outbox, Mail{To: email, Type: "email_change", Link: link})
+
+	return nil
+}
+
+func (p *MemoryProvider) changeEmail(u *memoryUser, email string) error {
+	if _, ok := p.users[email]; ok {
+		return ErrUserExists
+	}
+
+	old := u.user.Email
+	delete(p.users, old)
+	u.user.Email = email
+	u.user.UpdatedAt = time.Now()
+	p.users[email] = u
+
+	for token, t := range p.tokens {
+		if t.email == old {
+			t.email = email
+			p.tokens[token] = t
+		}
+	}
+	for token, t := range p.refreshTokens {
+		if t.email == old {
+			t.email = email
+			p.refreshTokens[token] = t
+		}
+	}
+
+	return nil
+}
+
+// ResetPasswordForEmail mails a recovery link to known users, unknown emails
+// are silently ignored like Supabase does.
+func (p *MemoryProvider) ResetPasswordForEmail(_ context.Context, email string, opts EmailLinkOptions) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, ok := p.users[email]
+	if !ok {
+		return nil
+	}
+
+	return p.sendLink(u, "recovery", opts)
+}
+
+func (p *MemoryProvider) SendOTP(_ context.Context, email string, opts EmailLinkOptions) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, ok := p.users[email]
+	if !ok {
+		return nil
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	p.otps[email] = memoryOTP{code: code, expiresAt: time.Now().Add(time.Hour)}
+
+	if err := p.sendLink(u, "magiclink", opts); err != nil {
+		return err
+	}
+	p.outbox[len(p.outbox)-1].Code = code
+
+	return nil
+}
+
+func (p *MemoryProvider) VerifyOTP(_ context.Context, email string, token string) (*supabase.AuthenticatedDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	otp, ok := p.otps[email]
+	if !ok || otp.code != token || time.Now().After(otp.expiresAt) {
+		return nil, ErrInvalidToken
+	}
+	delete(p.otps, email)
+	confirm(p.users[email])
+
+	return p.issueTokens(p.users[email], "")
+}
+
+func (p *MemoryProvider) ResendConfirmation(_ context.Context, email string, opts EmailLinkOptions) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u, ok := p.users[email]
+	if !ok || !u.user.ConfirmedAt.IsZero() {
+		return nil
+	}
+	u.user.ConfirmationSentAt = time.Now()
+
+	return p.sendLink(u, "signup", opts)
+}
+
+func (p *MemoryProvider) SignInAsUser(_ context.Context, userID string) (*supabase.AuthenticatedDetails, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, u := range p.users {
+		if u.user.ID == userID {
+			return p.issueTokens(u, "")
+		}
+	}
+
+	return nil, ErrUserNotFound
+}
+
+func (p *MemoryProvider) GetUser(_ context.Context, userID string) (*supabase.User, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, u := range p.users {
+		if u.user.ID == userID {
+			user := u.user
+			return &user, nil
+		}
+	}
+
+	return nil, ErrUserNotFound
+}
+
+func (p *MemoryProvider) DeleteUser(_ context.Context, userID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for email, u := range p.users {
+		if u.user.ID != userID {
+			continue
+		}
+		delete(p.users, email)
+		for token, t := range p.tokens {
+			if t.email == email {
+				delete(p.tokens, token)
+			}
+		}
+		for token, t := range p.refreshTokens {
+			if t.email == email {
+				delete(p.refreshTokens, token)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *MemoryProvider) SignOut(_ context.Context, userToken string, scope SignOutScope) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current, ok := p.tokens[userToken]
+	if !ok {
+		return ErrInvalidToken
+	}
+	revoke := func(t memoryToken) bool {
+		if t.email != current.email {
+			return false
+		}
+		switch scope {
+		case ScopeLocal:
+			return t.session == current.session
+		case ScopeOthers:
+			return t.session != current.session
+		default:
+			return true
+		}
+	}
+	for token, t := range p.tokens {
+		if revoke(t) {
+			delete(p.tokens, token)
+		}
+	}
+	for token, t := range p.refreshTokens {
+		if revoke(t) {
+			delete(p.refreshTokens, token)
+		}
+	}
+
+	return nil
+}
+
+func (p *MemoryProvider) VerifyToken(ctx context.Context, userToken string) (*Claims, error) {
+	return p.verifier.Verify(ctx, userToken)
+}
+
+// Outbox returns the emails sent so far.
+func (p *MemoryProvider) Outbox() []Mail {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]Mail(nil), p.outbox...)
+}
+
+// sendLink mails a link the way Supabase redirects after verifying an email
+// link: with a code for the PKCE flow, or with the session in the fragment.
+func (p *MemoryProvider) sendLink(u *memoryUser, linkType string, opts EmailLinkOptions) error {
+	mail := Mail{To: u.user.Email, Type: linkType}
+	if len(opts.CodeChallenge) > 0 {
+		link, err := p.codeLink(memoryCode{email: u.user.Email, challenge: opts.CodeChallenge, confirm: true}, opts.RedirectTo)
+		if err != nil {
+			return err
+		}
+		mail.Link = link
+	} else {
+		details, err := p.issueTokens(u, "")
+		if err != nil {
+			return err
+		}
+		fragment := url.Values{
+			"access_token":  {details.AccessToken},
+			"refresh_token": {details.RefreshToken},
+			"expires_in":    {strconv.Itoa(details.ExpiresIn)},
+			"token_type":    {details.TokenType},
+			"type":          {linkType},
+		}
+		mail.Link = opts.RedirectTo + "#" + fragment.Encode()
+	}
+	p.outbox = append(p.outbox, mail)
+
+	return nil
+}
+
+func (p *MemoryProvider) codeLink(c memoryCode, redirectTo string) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	p.codes[code] = c
+
+	link, err := url.Parse(redirectTo)
+	if err != nil {
+		return "", err
+	}
+	query := link.Query()
+	query.Set("code", code)
+	link.RawQuery = query.Encode()
+
+	return link.String(), nil
+}
+
+// issueTokens starts a new session unless sessionID is set, as on refresh.
+func (p *MemoryProvider) issueTokens(u *memoryUser, sessionID string) (*supabase.AuthenticatedDetails, error) {
+	now := time.Now()
+	expiresAt := now.Add(p.TokenTTL)
+	if len(sessionID) == 0 {
+		var err error
+		if sessionID, err = randomToken(); err != nil {
+			return nil, err
+		}
+	}
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   u.user.ID,
+			Audience:  jwt.ClaimStrings{"authenticated"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		Email:        u.user.Email,
+		Role:         u.user.Role,
+		SessionID:    sessionID,
+		UserMetadata: userMetadata(u.user),
+	}
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(p.secret)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	p.tokens[accessToken] = memoryToken{email: u.user.Email, session: sessionID, expiresAt: expiresAt}
+	p.refreshTokens[refreshToken] = memoryToken{email: u.user.Email, session: sessionID}
+
+	return &supabase.AuthenticatedDetails{
+		AccessToken:  accessToken,
+		TokenType:    "bearer",
+		ExpiresIn:    int(p.TokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		User:         u.user,
+	}, nil
+}
+
+// confirm marks the email of the user as confirmed.
+func confirm(u *memoryUser) {
+	if u.user.ConfirmedAt.IsZero() {
+		u.user.ConfirmedAt = time.Now()
+	}
+}
+
+// userMetadata is what Supabase puts in the token, a copy of the metadata
+// of the user. Users write it themselves, whether their email is confirmed
+// is only known from the user.
+func userMetadata(u supabase.User) map[string]interface{} {
+	metadata := map[string]interface{}{}
+	for k, v := range u.UserMetadata {
+		metadata[k] = v
+	}
+
+	return metadata
+}
+
+func (p *MemoryProvider) userByToken(token string) (*memoryUser, error) {
+	t, ok := p.tokens[token]
+	if !ok || time.Now().After(t.expiresAt) {
+		return nil, ErrInvalidToken
+	}
+	u, ok := p.users[t.email]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	return u, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,58 @@
+package sb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+
+	"github.com/nedpals/supabase-go"
+)
+
+// EmailLinkOptions configure the links mailed by ResetPasswordForEmail,
+// SendOTP, ResendConfirmation and ChangeEmail.
+type EmailLinkOptions struct {
+	RedirectTo string
+	// CodeChallenge makes the link carry an authorization code for the PKCE
+	// flow instead of the session itself.
+	CodeChallenge string
+}
+
+func (o EmailLinkOptions) query() url.Values {
+	query := url.Values{}
+	if len(o.RedirectTo) > 0 {
+		query.Set("redirect_to", o.RedirectTo)
+	}
+
+	return query
+}
+
+func (o EmailLinkOptions) body(body map[string]interface{}) map[string]interface{} {
+	if len(o.CodeChallenge) > 0 {
+		body["code_challenge"] = o.CodeChallenge
+		body["code_challenge_method"] = "s256"
+	}
+
+	return body
+}
+
+// NewPKCEParams generates a code verifier and its S256 challenge.
+func NewPKCEParams() (*supabase.PKCEParams, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+
+	verifier := base64.RawURLEncoding.EncodeToString(data)
+
+	return &supabase.PKCEParams{
+		Challenge:       codeChallenge(verifier),
+		ChallengeMethod: "S256",
+		Verifier:        verifier,
+	}, nil
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
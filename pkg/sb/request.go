@@ -0,0 +1,80 @@
+package sb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nedpals/supabase-go"
+)
+
+// APIError is returned when the auth backend answers with a non 2xx status.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("supabase: %d: %s", e.StatusCode, e.Message)
+}
+
+// request calls the GoTrue endpoints the supabase client does not cover.
+// token authorizes the call as a user, the api key is used when it is empty.
+func (p *supabaseProvider) request(ctx context.Context, method, path string, query url.Values, body any, token string, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	reqURL := fmt.Sprintf("%s/%s/%s", p.client.BaseURL, supabase.AuthEndpoint, strings.TrimPrefix(path, "/"))
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reader)
+	if err != nil {
+		return err
+	}
+	if len(token) == 0 {
+		token = p.apiKey
+	}
+	req.Header.Set("apikey", p.apiKey)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errRes struct {
+			Msg              string `json:"msg"`
+			Message          string `json:"message"`
+			ErrorDescription string `json:"error_description"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&errRes)
+		msg := errRes.Msg
+		if len(msg) == 0 {
+			msg = errRes.Message
+		}
+		if len(msg) == 0 {
+			msg = errRes.ErrorDescription
+		}
+		return &APIError{StatusCode: resp.StatusCode, Message: msg}
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -1,29 +1,243 @@
 package sb
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 
 	"github.com/nedpals/supabase-go"
 )
 
-var (
-	Client   *supabase.Client
-	sbHost   string
-	sbSecret string
+// AuthProvider is the identity backend used by the handlers. It mirrors the
+// subset of the Supabase auth API the application relies on, so other
+// backends (or test doubles) can be swapped in.
+type AuthProvider interface {
+	SignUp(ctx context.Context, credentials supabase.UserCredentials) (*supabase.User, error)
+	SignIn(ctx context.Context, credentials supabase.UserCredentials) (*supabase.AuthenticatedDetails, error)
+	RefreshUser(ctx context.Context, userToken string, refreshToken string) (*supabase.AuthenticatedDetails, error)
+	User(ctx context.Context, userToken string) (*supabase.User, error)
+	UpdateUser(ctx context.Context, userToken string, updateData map[string]interface{}) (*supabase.User, error)
+	SignInWithProvider(opts supabase.ProviderSignInOptions) (*supabase.ProviderSignInDetails, error)
+	ExchangeCode(ctx context.Context, opts supabase.ExchangeCodeOpts) (*supabase.AuthenticatedDetails, error)
+	ResetPasswordForEmail(ctx context.Context, email string, opts EmailLinkOptions) error
+	// SendOTP mails a magic link together with a one-time code that can be
+	// checked with VerifyOTP.
+	SendOTP(ctx context.Context, email string, opts EmailLinkOptions) error
+	VerifyOTP(ctx context.Context, email string, token string) (*supabase.AuthenticatedDetails, error)
+	// ResendConfirmation mails the signup confirmation link again, to users
+	// who did not confirm their email yet.
+	ResendConfirmation(ctx context.Context, email string, opts EmailLinkOptions) error
+	// ChangeEmail mails a confirmation link to the new address. The email
+	// only changes once the link is opened. Whether the current address is
+	// told depends on the backend, callers notify it themselves.
+	ChangeEmail(ctx context.Context, userToken string, email string, opts EmailLinkOptions) error
+	// SignInAsUser issues a session for a user the application authenticated
+	// itself, e.g. with a passkey. It needs the service role key.
+	SignInAsUser(ctx context.Context, userID string) (*supabase.AuthenticatedDetails, error)
+	// GetUser looks a user up by ID, it needs the service role key.
+	GetUser(ctx context.Context, userID string) (*supabase.User, error)
+	// DeleteUser removes the user for good, it needs the service role key.
+	// Deleting a user that does not exist is not an error.
+	DeleteUser(ctx context.Context, userID string) error
+	// SignOut revokes the refresh tokens of the sessions selected by scope.
+	SignOut(ctx context.Context, userToken string, scope SignOutScope) error
+	// VerifyToken validates an access token without a round trip to the
+	// backend.
+	VerifyToken(ctx context.Context, userToken string) (*Claims, error)
+}
+
+// SignOutScope selects which of the user's sessions a sign out revokes.
+type SignOutScope string
+
+const (
+	// ScopeLocal revokes the session the token belongs to.
+	ScopeLocal SignOutScope = "local"
+	// ScopeOthers revokes every session but the one the token belongs to.
+	ScopeOthers SignOutScope = "others"
+	// ScopeGlobal revokes every session of the user.
+	ScopeGlobal SignOutScope = "global"
 )
 
-func Init() error {
-	sbHost = os.Getenv("SUPABASE_URL")
+// New returns the provider selected by AUTH_PROVIDER. Supabase is the
+// default; "memory" selects the in-memory provider for local development.
+func New() (AuthProvider, error) {
+	if os.Getenv("AUTH_PROVIDER") == "memory" {
+		return NewMemoryProvider(), nil
+	}
+
+	sbHost := os.Getenv("SUPABASE_URL")
 	if sbHost == "" {
-		return errors.New("supabase host is required")
+		return nil, errors.New("supabase host is required")
 	}
-	sbSecret = os.Getenv("SUPABASE_SECRET")
+	sbSecret := os.Getenv("SUPABASE_SECRET")
 	if sbSecret == "" {
-		return errors.New("supabase secret is required")
+		return nil, errors.New("supabase secret is required")
+	}
+
+	jwksURL := os.Getenv("SUPABASE_JWKS_URL")
+	if jwksURL == "" {
+		jwksURL = fmt.Sprintf("%s/%s/.well-known/jwks.json", sbHost, supabase.AuthEndpoint)
+	}
+	verifier := NewVerifier(os.Getenv("SUPABASE_JWT_SECRET"), jwksURL)
+
+	return NewSupabaseProvider(sbHost, sbSecret, verifier), nil
+}
+
+type supabaseProvider struct {
+	client   *supabase.Client
+	apiKey   string
+	verifier *Verifier
+}
+
+func NewSupabaseProvider(host string, apiKey string, verifier *Verifier) AuthProvider {
+	return &supabaseProvider{
+		client:   supabase.CreateClient(host, apiKey),
+		apiKey:   apiKey,
+		verifier: verifier,
+	}
+}
+
+func (p *supabaseProvider) SignUp(ctx context.Context, credentials supabase.UserCredentials) (*supabase.User, error) {
+	return p.client.Auth.SignUp(ctx, credentials)
+}
+
+func (p *supabaseProvider) SignIn(ctx context.Context, credentials supabase.UserCredentials) (*supabase.AuthenticatedDetails, error) {
+	return p.client.Auth.SignIn(ctx, credentials)
+}
+
+func (p *supabaseProvider) RefreshUser(ctx context.Context, userToken string, refreshToken string) (*supabase.AuthenticatedDetails, error) {
+	return p.client.Auth.RefreshUser(ctx, userToken, refreshToken)
+}
+
+func (p *supabaseProvider) User(ctx context.Context, userToken string) (*supabase.User, error) {
+	return p.client.Auth.User(ctx, userToken)
+}
+
+func (p *supabaseProvider) UpdateUser(ctx context.Context, userToken string, updateData map[string]interface{}) (*supabase.User, error) {
+	return p.client.Auth.UpdateUser(ctx, userToken, updateData)
+}
+
+func (p *supabaseProvider) SignInWithProvider(opts supabase.ProviderSignInOptions) (*supabase.ProviderSignInDetails, error) {
+	return p.client.Auth.SignInWithProvider(opts)
+}
+
+func (p *supabaseProvider) ExchangeCode(ctx context.Context, opts supabase.ExchangeCodeOpts) (*supabase.AuthenticatedDetails, error) {
+	return p.client.Auth.ExchangeCode(ctx, opts)
+}
+
+// ResetPasswordForEmail is not delegated to the client, which cannot pass a
+// redirect URL nor a code challenge for the recovery link.
+func (p *supabaseProvider) ResetPasswordForEmail(ctx context.Context, email string, opts EmailLinkOptions) error {
+	body := map[string]interface{}{
+		"email": email,
+	}
+
+	return p.request(ctx, http.MethodPost, "recover", opts.query(), opts.body(body), "", nil)
+}
+
+func (p *supabaseProvider) SendOTP(ctx context.Context, email string, opts EmailLinkOptions) error {
+	body := map[string]interface{}{
+		"email":       email,
+		"create_user": false,
+	}
+
+	return p.request(ctx, http.MethodPost, "otp", opts.query(), opts.body(body), "", nil)
+}
+
+func (p *supabaseProvider) VerifyOTP(ctx context.Context, email string, token string) (*supabase.AuthenticatedDetails, error) {
+	body := map[string]string{
+		"type":  "email",
+		"email": email,
+		"token": token,
+	}
+	var details supabase.AuthenticatedDetails
+	if err := p.request(ctx, http.MethodPost, "verify", nil, body, "", &details); err != nil {
+		return nil, err
+	}
+
+	return &details, nil
+}
+
+func (p *supabaseProvider) ResendConfirmation(ctx context.Context, email string, opts EmailLinkOptions) error {
+	body := map[string]interface{}{
+		"type":  "signup",
+		"email": email,
+	}
+
+	return p.request(ctx, http.MethodPost, "resend", opts.query(), opts.body(body), "", nil)
+}
+
+// ChangeEmail is not delegated to the client, which cannot pass a redirect
+// URL nor a code challenge for the confirmation link. Supabase only mails
+// the current address when secure email change is on.
+func (p *supabaseProvider) ChangeEmail(ctx context.Context, userToken string, email string, opts EmailLinkOptions) error {
+	body := map[string]interface{}{
+		"email": email,
 	}
 
-	Client = supabase.CreateClient(sbHost, sbSecret)
+	return p.request(ctx, http.MethodPut, "user", opts.query(), opts.body(body), userToken, nil)
+}
+
+// SignInAsUser generates a magic link for the user through the admin API
+// and redeems it right away, nothing is mailed.
+func (p *supabaseProvider) SignInAsUser(ctx context.Context, userID string) (*supabase.AuthenticatedDetails, error) {
+	user, err := p.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var link struct {
+		HashedToken string `json:"hashed_token"`
+	}
+	body := map[string]string{
+		"type":  "magiclink",
+		"email": user.Email,
+	}
+	if err := p.request(ctx, http.MethodPost, "admin/generate_link", nil, body, "", &link); err != nil {
+		return nil, err
+	}
+
+	var details supabase.AuthenticatedDetails
+	body = map[string]string{
+		"type":       "magiclink",
+		"token_hash": link.HashedToken,
+	}
+	if err := p.request(ctx, http.MethodPost, "verify", nil, body, "", &details); err != nil {
+		return nil, err
+	}
+
+	return &details, nil
+}
+
+func (p *supabaseProvider) GetUser(ctx context.Context, userID string) (*supabase.User, error) {
+	var user supabase.User
+	if err := p.request(ctx, http.MethodGet, "admin/users/"+url.PathEscape(userID), nil, nil, "", &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (p *supabaseProvider) DeleteUser(ctx context.Context, userID string) error {
+	err := p.request(ctx, http.MethodDelete, "admin/users/"+url.PathEscape(userID), nil, nil, "", nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// SignOut is not delegated to the client, which always signs out globally.
+func (p *supabaseProvider) SignOut(ctx context.Context, userToken string, scope SignOutScope) error {
+	query := url.Values{"scope": {string(scope)}}
+
+	return p.request(ctx, http.MethodPost, "logout", query, nil, userToken, nil)
+}
 
-	return nil
+func (p *supabaseProvider) VerifyToken(ctx context.Context, userToken string) (*Claims, error) {
+	return p.verifier.Verify(ctx, userToken)
 }
@@ -0,0 +1,145 @@
+package totp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	period = 30
+	// skew is the number of periods accepted on each side of the current
+	// one, to make up for clock drift.
+	skew = 1
+
+	recoveryCodeCount = 10
+	qrCodeSize        = 200
+)
+
+var ErrInvalidCode = errors.New("invalid authentication code")
+
+var opts = totp.ValidateOpts{
+	Period:    period,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// Key is a freshly generated secret waiting to be confirmed by the user.
+type Key struct {
+	Secret string
+	URL    string
+	// QRCode is a data URI of a PNG encoding URL.
+	QRCode string
+}
+
+func Generate(issuer string, account string) (Key, error) {
+	k, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: account,
+		Period:      period,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return Key{}, err
+	}
+
+	return newKey(k)
+}
+
+// FromSecret rebuilds the key of a secret generated earlier, e.g. to show
+// the QR code again.
+func FromSecret(issuer string, account string, secret string) (Key, error) {
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return Key{}, err
+	}
+	k, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: account,
+		Period:      period,
+		Secret:      raw,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return Key{}, err
+	}
+
+	return newKey(k)
+}
+
+func newKey(k *otp.Key) (Key, error) {
+	img, err := k.Image(qrCodeSize, qrCodeSize)
+	if err != nil {
+		return Key{}, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return Key{}, err
+	}
+
+	return Key{
+		Secret: k.Secret(),
+		URL:    k.URL(),
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}, nil
+}
+
+// Validate checks code against secret and returns the time step it was
+// generated for. Codes for a step at or before lastStep are rejected, so a
+// code cannot be replayed.
+func Validate(secret string, code string, lastStep int64, now time.Time) (int64, error) {
+	code = strings.TrimSpace(code)
+	current := now.Unix() / period
+	for offset := int64(-skew); offset <= skew; offset++ {
+		step := current + offset
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*period, 0), opts)
+		if err != nil {
+			return 0, err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+
+	return 0, ErrInvalidCode
+}
+
+// RecoveryCodes returns one-time codes in the xxxxx-xxxxx form.
+func RecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := hex.EncodeToString(b)
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+
+	return codes, nil
+}
+
+// HashRecoveryCode returns the form recovery codes are stored in. The codes
+// are random, so a plain digest is enough.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+
+	return hex.EncodeToString(sum[:])
+}
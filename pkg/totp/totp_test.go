@@ -0,0 +1,74 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestValidate(t *testing.T) {
+	key, err := Generate("dreampicai", "foo@bar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key.QRCode, "data:image/png;base64,") {
+		t.Fatalf("expected png data uri; got %.30s", key.QRCode)
+	}
+
+	again, err := FromSecret("dreampicai", "foo@bar.com", key.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.URL != key.URL {
+		t.Fatalf("expected same key url; got %v and %v", again.URL, key.URL)
+	}
+
+	now := time.Now()
+	code, err := totp.GenerateCode(key.Secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, err := Validate(key.Secret, code, 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("skew", func(t *testing.T) {
+		if _, err := Validate(key.Secret, code, 0, now.Add(period*time.Second)); err != nil {
+			t.Errorf("expected code from previous period to be accepted; got %v", err)
+		}
+		if _, err := Validate(key.Secret, code, 0, now.Add(3*period*time.Second)); err == nil {
+			t.Errorf("expected stale code to be rejected")
+		}
+	})
+	t.Run("replay", func(t *testing.T) {
+		if _, err := Validate(key.Secret, code, step, now); err == nil {
+			t.Errorf("expected used code to be rejected")
+		}
+	})
+	t.Run("wrong code", func(t *testing.T) {
+		if _, err := Validate(key.Secret, "000000x", 0, now); err == nil {
+			t.Errorf("expected wrong code to be rejected")
+		}
+	})
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := RecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		hash := HashRecoveryCode(code)
+		if seen[hash] {
+			t.Fatalf("duplicate recovery code %v", code)
+		}
+		seen[hash] = true
+	}
+	if HashRecoveryCode(" "+strings.ToUpper(codes[0])+" ") != HashRecoveryCode(codes[0]) {
+		t.Errorf("expected recovery code hash to ignore case and spaces")
+	}
+}
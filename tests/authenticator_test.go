@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// authenticator is a software passkey holding a single ES256 credential,
+// enough to drive the WebAuthn ceremonies the way a browser would.
+type authenticator struct {
+	rpID       string
+	origin     string
+	key        *ecdsa.PrivateKey
+	credential []byte
+	userHandle []byte
+	signCount  uint32
+}
+
+func newAuthenticator(t *testing.T, rpID, origin string) *authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential := make([]byte, 16)
+	if _, err := rand.Read(credential); err != nil {
+		t.Fatal(err)
+	}
+
+	return &authenticator{rpID: rpID, origin: origin, key: key, credential: credential}
+}
+
+var b64 = base64.RawURLEncoding
+
+// options is the part of the creation and request options the
+// authenticator looks at.
+type options struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+func parseOptions(t *testing.T, body string) options {
+	t.Helper()
+	var opts options
+	if err := json.Unmarshal([]byte(body), &opts); err != nil {
+		t.Fatalf("expected webauthn options; got %v", body)
+	}
+	if len(opts.PublicKey.Challenge) == 0 {
+		t.Fatalf("expected challenge in options; got %v", body)
+	}
+
+	return opts
+}
+
+// create answers navigator.credentials.create.
+func (a *authenticator) create(t *testing.T, body string) []byte {
+	t.Helper()
+	opts := parseOptions(t, body)
+	handle, err := b64.DecodeString(opts.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = handle
+
+	x := a.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := a.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	coseKey, err := cbor.Marshal(map[int]interface{}{1: 2, 3: -7, -1: 1, -2: x, -3: y})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authData := a.authData(flagUserPresent | flagUserVerified | flagAttested)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credential)))
+	authData = append(authData, a.credential...)
+	authData = append(authData, coseKey...)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credentialJSON(t, map[string]interface{}{
+		"attestationObject": b64.EncodeToString(attestation),
+		"clientDataJSON":    b64.EncodeToString(a.clientData(t, "webauthn.create", opts.PublicKey.Challenge)),
+		"transports":        []string{"internal"},
+	})
+}
+
+// get answers navigator.credentials.get.
+func (a *authenticator) get(t *testing.T, body string) []byte {
+	t.Helper()
+	opts := parseOptions(t, body)
+	authData := a.authData(flagUserPresent | flagUserVerified)
+	clientData := a.clientData(t, "webauthn.get", opts.PublicKey.Challenge)
+	sum := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), sum[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.credentialJSON(t, map[string]interface{}{
+		"authenticatorData": b64.EncodeToString(authData),
+		"clientDataJSON":    b64.EncodeToString(clientData),
+		"signature":         b64.EncodeToString(signature),
+		"userHandle":        b64.EncodeToString(a.userHandle),
+	})
+}
+
+// authData bumps the sign counter, as a real authenticator does on every use.
+func (a *authenticator) authData(flags byte) []byte {
+	a.signCount++
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append(rpIDHash[:], flags)
+
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+func (a *authenticator) clientData(t *testing.T, typ, challenge string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": challenge,
+		"origin":    a.origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func (a *authenticator) credentialJSON(t *testing.T, response map[string]interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{
+		"id":       b64.EncodeToString(a.credential),
+		"rawId":    b64.EncodeToString(a.credential),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
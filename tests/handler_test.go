@@ -1,32 +1,2974 @@
 package tests
 
 import (
-	"dreampicai/internal/server"
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"dreampicai/internal/handler"
+	"dreampicai/internal/lockout"
+	"dreampicai/internal/session"
+	"dreampicai/pkg/mail"
+	"dreampicai/pkg/sb"
+	"dreampicai/types"
+
+	"github.com/google/uuid"
+	"github.com/nedpals/supabase-go"
+	otptotp "github.com/pquerna/otp/totp"
 )
 
-func TestHandler(t *testing.T) {
-	s := &server.Server{}
-	server := httptest.NewServer(http.HandlerFunc(s.HelloWorldHandler))
-	defer server.Close()
-	resp, err := http.Get(server.URL)
+type memoryDB struct {
+	mu            sync.Mutex
+	accounts      map[string]types.Account
+	sessions      map[string]types.Session
+	totpFactors   map[string]types.TOTPFactor
+	recoveryCodes map[string][]types.RecoveryCode
+	passkeys      map[int]types.Passkey
+	loginAttempts map[string]types.LoginAttempt
+	lockouts      []types.Lockout
+	deletions     []types.AccountDeletion
+	exports       map[string]types.DataExport
+	roles         map[string]types.Role
+	auditEvents   []types.AuditEvent
+	knownDevices  []types.KnownDevice
+	tokens        []types.PersonalAccessToken
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		accounts:      map[string]types.Account{},
+		sessions:      map[string]types.Session{},
+		totpFactors:   map[string]types.TOTPFactor{},
+		recoveryCodes: map[string][]types.RecoveryCode{},
+		passkeys:      map[int]types.Passkey{},
+		loginAttempts: map[string]types.LoginAttempt{},
+		exports:       map[string]types.DataExport{},
+		// The roles seeded by the migration.
+		roles: map[string]types.Role{
+			types.RoleUser: {Name: types.RoleUser, BuiltIn: true},
+			types.RoleModerator: {Name: types.RoleModerator, BuiltIn: true, Permissions: []types.Permission{
+				types.PermissionContentModerate, types.PermissionUsersRead,
+			}},
+			types.RoleAdmin: {Name: types.RoleAdmin, BuiltIn: true, Permissions: []types.Permission{
+				types.PermissionAdminAccess, types.PermissionUsersRead, types.PermissionUsersManage,
+				types.PermissionRolesManage, types.PermissionContentModerate, types.PermissionUsersImpersonate,
+				types.PermissionAuditRead,
+			}},
+		},
+	}
+}
+
+func (db *memoryDB) Health() map[string]string {
+	return map[string]string{"message": "It's healthy"}
+}
+
+func (db *memoryDB) CreateAccount(_ context.Context, account *types.Account) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	account.ID = len(db.accounts) + 1
+	if len(account.Role) == 0 {
+		account.Role = types.RoleUser
+	}
+	db.accounts[account.UserID.String()] = *account
+	return nil
+}
+
+func (db *memoryDB) GetAccountByUserID(_ context.Context, id string) (types.Account, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	account, ok := db.accounts[id]
+	if !ok {
+		return types.Account{}, sql.ErrNoRows
+	}
+	return account, nil
+}
+
+func (db *memoryDB) UpdateUsername(_ context.Context, account *types.Account) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.accounts[account.UserID.String()] = *account
+	return nil
+}
+
+func (db *memoryDB) CreateSession(_ context.Context, session *types.Session) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.sessions[session.ID] = *session
+	return nil
+}
+
+func (db *memoryDB) GetSession(_ context.Context, id string) (types.Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	session, ok := db.sessions[id]
+	if !ok {
+		return types.Session{}, sql.ErrNoRows
+	}
+	return session, nil
+}
+
+func (db *memoryDB) UpdateSession(_ context.Context, session *types.Session) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored, ok := db.sessions[session.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.UserID = session.UserID
+	stored.Data = session.Data
+	stored.LastSeenAt = session.LastSeenAt
+	stored.IP = session.IP
+	db.sessions[session.ID] = stored
+	return nil
+}
+
+func (db *memoryDB) DeleteSession(_ context.Context, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.sessions, id)
+	return nil
+}
+
+func (db *memoryDB) GetSessionsByUserID(_ context.Context, userID string) ([]types.Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var sessions []types.Session
+	for _, session := range db.sessions {
+		if session.UserID.String() == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (db *memoryDB) DeleteSessionsByUserID(_ context.Context, userID string, keep string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for id, session := range db.sessions {
+		if session.UserID.String() == userID && id != keep {
+			delete(db.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (db *memoryDB) DeleteExpiredSessions(_ context.Context, idleSince time.Time) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var n int64
+	for id, session := range db.sessions {
+		if time.Now().After(session.ExpiresAt) || session.LastSeenAt.Before(idleSince) {
+			delete(db.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (db *memoryDB) GetTOTPFactor(_ context.Context, userID string) (types.TOTPFactor, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	factor, ok := db.totpFactors[userID]
+	if !ok {
+		return types.TOTPFactor{}, sql.ErrNoRows
+	}
+	return factor, nil
+}
+
+func (db *memoryDB) SaveTOTPFactor(_ context.Context, factor *types.TOTPFactor) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.totpFactors[factor.UserID.String()] = *factor
+	return nil
+}
+
+func (db *memoryDB) UseTOTPStep(_ context.Context, userID string, step int64) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	factor, ok := db.totpFactors[userID]
+	if !ok || factor.LastUsedStep >= step {
+		return false, nil
+	}
+	factor.LastUsedStep = step
+	db.totpFactors[userID] = factor
+	return true, nil
+}
+
+func (db *memoryDB) DeleteTOTPFactor(_ context.Context, userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.totpFactors, userID)
+	delete(db.recoveryCodes, userID)
+	return nil
+}
+
+func (db *memoryDB) ReplaceRecoveryCodes(_ context.Context, userID string, codes []types.RecoveryCode) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.recoveryCodes[userID] = append([]types.RecoveryCode(nil), codes...)
+	return nil
+}
+
+func (db *memoryDB) UseRecoveryCode(_ context.Context, userID string, codeHash string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, code := range db.recoveryCodes[userID] {
+		if code.CodeHash == codeHash && code.UsedAt.IsZero() {
+			db.recoveryCodes[userID][i].UsedAt = time.Now()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (db *memoryDB) CreatePasskey(_ context.Context, passkey *types.Passkey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	passkey.ID = len(db.passkeys) + 1
+	passkey.CreatedAt = time.Now()
+	db.passkeys[passkey.ID] = *passkey
+	return nil
+}
+
+func (db *memoryDB) GetPasskeysByAccountID(_ context.Context, accountID int) ([]types.Passkey, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var passkeys []types.Passkey
+	for _, p := range db.passkeys {
+		if p.AccountID == accountID {
+			passkeys = append(passkeys, p)
+		}
+	}
+	return passkeys, nil
+}
+
+func (db *memoryDB) UpdatePasskey(_ context.Context, passkey *types.Passkey) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.passkeys[passkey.ID] = *passkey
+	return nil
+}
+
+func (db *memoryDB) DeletePasskey(_ context.Context, accountID int, id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if p, ok := db.passkeys[id]; ok && p.AccountID == accountID {
+		delete(db.passkeys, id)
+	}
+	return nil
+}
+
+func (db *memoryDB) GetLoginAttempts(_ context.Context, keys ...string) ([]types.LoginAttempt, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var attempts []types.LoginAttempt
+	for _, key := range keys {
+		if a, ok := db.loginAttempts[key]; ok {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts, nil
+}
+
+func (db *memoryDB) RecordLoginFailure(_ context.Context, key string, resetBefore time.Time) (types.LoginAttempt, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	a := db.loginAttempts[key]
+	if a.LastFailedAt.Before(resetBefore) {
+		a.Failures = 0
+	}
+	a.Key = key
+	a.Failures++
+	a.LastFailedAt = time.Now()
+	db.loginAttempts[key] = a
+	return a, nil
+}
+
+func (db *memoryDB) LockLogin(_ context.Context, attempt *types.LoginAttempt, lockout *types.Lockout) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	a := db.loginAttempts[attempt.Key]
+	a.LockedUntil = attempt.LockedUntil
+	db.loginAttempts[attempt.Key] = a
+	lockout.ID = len(db.lockouts) + 1
+	db.lockouts = append(db.lockouts, *lockout)
+	return nil
+}
+
+func (db *memoryDB) ClearLoginAttempts(_ context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.loginAttempts, key)
+	return nil
+}
+
+func (db *memoryDB) CreateAccountDeletion(_ context.Context, deletion *types.AccountDeletion) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	deletion.ID = len(db.deletions) + 1
+	deletion.RequestedAt = time.Now()
+	db.deletions = append(db.deletions, *deletion)
+	return nil
+}
+
+func (db *memoryDB) CancelAccountDeletion(_ context.Context, userID string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	cancelled := false
+	for i, d := range db.deletions {
+		if d.UserID.String() == userID && d.Pending() {
+			db.deletions[i].CancelledAt = time.Now()
+			cancelled = true
+		}
+	}
+	return cancelled, nil
+}
+
+func (db *memoryDB) GetDueAccountDeletions(_ context.Context, now time.Time) ([]types.AccountDeletion, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var due []types.AccountDeletion
+	for _, d := range db.deletions {
+		if d.Pending() && !d.DeleteAfter.After(now) {
+			due = append(due, d)
+		}
+	}
+	return due, nil
+}
+
+func (db *memoryDB) DeleteAccount(_ context.Context, deletion *types.AccountDeletion) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	userID := deletion.UserID.String()
+	account := db.accounts[userID]
+	for id, p := range db.passkeys {
+		if p.AccountID == account.ID {
+			delete(db.passkeys, id)
+		}
+	}
+	delete(db.accounts, userID)
+	for id, sess := range db.sessions {
+		if sess.UserID == deletion.UserID {
+			delete(db.sessions, id)
+		}
+	}
+	delete(db.recoveryCodes, userID)
+	delete(db.totpFactors, userID)
+	db.knownDevices = slices.DeleteFunc(db.knownDevices, func(d types.KnownDevice) bool { return d.UserID == deletion.UserID })
+	db.tokens = slices.DeleteFunc(db.tokens, func(t types.PersonalAccessToken) bool { return t.UserID == deletion.UserID })
+	deletion.DeletedAt = time.Now()
+	for i, d := range db.deletions {
+		if d.ID == deletion.ID {
+			db.deletions[i] = *deletion
+		}
+	}
+	return nil
+}
+
+func (db *memoryDB) GetAccountDeletions(_ context.Context, userID string) ([]types.AccountDeletion, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var deletions []types.AccountDeletion
+	for _, d := range db.deletions {
+		if d.UserID.String() == userID {
+			deletions = append(deletions, d)
+		}
+	}
+	return deletions, nil
+}
+
+func (db *memoryDB) GetRecoveryCodes(_ context.Context, userID string) ([]types.RecoveryCode, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]types.RecoveryCode(nil), db.recoveryCodes[userID]...), nil
+}
+
+func (db *memoryDB) CreateDataExport(_ context.Context, export *types.DataExport) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	export.ID = len(db.exports) + 1
+	export.CreatedAt = time.Now()
+	db.exports[export.Token] = *export
+	return nil
+}
+
+func (db *memoryDB) UpdateDataExport(_ context.Context, export *types.DataExport) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.exports[export.Token] = *export
+	return nil
+}
+
+func (db *memoryDB) GetDataExportsByUserID(_ context.Context, userID string) ([]types.DataExport, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var exports []types.DataExport
+	for _, e := range db.exports {
+		if e.UserID.String() == userID {
+			e.Archive = nil
+			exports = append(exports, e)
+		}
+	}
+	return exports, nil
+}
+
+func (db *memoryDB) GetDataExport(_ context.Context, token string) (types.DataExport, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	export, ok := db.exports[token]
+	if !ok {
+		return types.DataExport{}, sql.ErrNoRows
+	}
+	return export, nil
+}
+
+func (db *memoryDB) DeleteExpiredDataExports(_ context.Context, now time.Time) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var n int64
+	for token, e := range db.exports {
+		if e.ExpiresAt.Before(now) {
+			delete(db.exports, token)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (db *memoryDB) GetRole(_ context.Context, name string) (types.Role, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	role, ok := db.roles[name]
+	if !ok {
+		return types.Role{}, sql.ErrNoRows
+	}
+	return role, nil
+}
+
+// SearchAccounts only matches usernames, emails live with the auth
+// provider.
+func (db *memoryDB) SearchAccounts(_ context.Context, query string, limit, offset int) ([]types.AccountSummary, int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var matches []types.AccountSummary
+	for _, account := range db.accounts {
+		if strings.Contains(strings.ToLower(account.Username), strings.ToLower(query)) {
+			matches = append(matches, types.AccountSummary{Account: account})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	total := len(matches)
+	matches = matches[min(offset, total):min(offset+limit, total)]
+	return matches, total, nil
+}
+
+func (db *memoryDB) GetAccountByID(_ context.Context, id int) (types.Account, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, account := range db.accounts {
+		if account.ID == id {
+			return account, nil
+		}
+	}
+	return types.Account{}, sql.ErrNoRows
+}
+
+func (db *memoryDB) SetAccountDisabled(_ context.Context, id int, disabled bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for userID, account := range db.accounts {
+		if account.ID != id {
+			continue
+		}
+		account.DisabledAt = time.Time{}
+		if disabled {
+			account.DisabledAt = time.Now()
+		}
+		db.accounts[userID] = account
+	}
+	return nil
+}
+
+func (db *memoryDB) GetLockoutsByEmail(_ context.Context, email string, limit int) ([]types.Lockout, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var lockouts []types.Lockout
+	for i := len(db.lockouts) - 1; i >= 0 && len(lockouts) < limit; i-- {
+		if db.lockouts[i].Email == email {
+			lockouts = append(lockouts, db.lockouts[i])
+		}
+	}
+	return lockouts, nil
+}
+
+func (db *memoryDB) CreateAuditEvent(_ context.Context, event *types.AuditEvent) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	event.ID = len(db.auditEvents) + 1
+	event.CreatedAt = time.Now()
+	db.auditEvents = append(db.auditEvents, *event)
+	return nil
+}
+
+func (db *memoryDB) GetAuditEventsByUserID(_ context.Context, userID string, email string, limit int) ([]types.AuditEvent, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var events []types.AuditEvent
+	for i := len(db.auditEvents) - 1; i >= 0 && (limit == 0 || len(events) < limit); i-- {
+		event := db.auditEvents[i]
+		if event.UserID.String() == userID || (event.UserID == uuid.Nil && event.Metadata["email"] == email) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (db *memoryDB) SearchAuditEvents(_ context.Context, filter types.AuditFilter, limit, offset int) ([]types.AuditEvent, int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	events := []types.AuditEvent{}
+	for i := len(db.auditEvents) - 1; i >= 0; i-- {
+		event := db.auditEvents[i]
+		switch {
+		case len(filter.Action) > 0 && event.Action != filter.Action,
+			filter.UserID != uuid.Nil && event.UserID != filter.UserID && event.ActorID != filter.UserID,
+			!filter.Since.IsZero() && event.CreatedAt.Before(filter.Since),
+			!filter.Until.IsZero() && !event.CreatedAt.Before(filter.Until),
+			filter.BeforeID > 0 && event.ID >= filter.BeforeID:
+			continue
+		}
+		events = append(events, event)
+	}
+	total := len(events)
+	return events[min(offset, total):min(offset+limit, total)], total, nil
+}
+
+func (db *memoryDB) ListAuditEvents(ctx context.Context, filter types.AuditFilter, limit int) ([]types.AuditEvent, error) {
+	events, _, err := db.SearchAuditEvents(ctx, filter, limit, 0)
+	return events, err
+}
+
+func (db *memoryDB) CountKnownDevices(_ context.Context, userID string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	count := 0
+	for _, d := range db.knownDevices {
+		if d.UserID.String() == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (db *memoryDB) GetKnownDevicesByUserID(_ context.Context, userID string) ([]types.KnownDevice, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var devices []types.KnownDevice
+	for _, d := range db.knownDevices {
+		if d.UserID.String() == userID {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func (db *memoryDB) RememberDevice(_ context.Context, device *types.KnownDevice) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, d := range db.knownDevices {
+		if d.UserID == device.UserID && d.Fingerprint == device.Fingerprint {
+			db.knownDevices[i].LastSeenAt = device.LastSeenAt
+			return false, nil
+		}
+	}
+	device.ID = 1
+	if n := len(db.knownDevices); n > 0 {
+		device.ID = db.knownDevices[n-1].ID + 1
+	}
+	device.CreatedAt = time.Now()
+	db.knownDevices = append(db.knownDevices, *device)
+	return true, nil
+}
+
+func (db *memoryDB) GetKnownDeviceByRevokeToken(_ context.Context, token string) (types.KnownDevice, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, d := range db.knownDevices {
+		if len(d.RevokeToken) > 0 && d.RevokeToken == token {
+			return d, nil
+		}
+	}
+	return types.KnownDevice{}, sql.ErrNoRows
+}
+
+func (db *memoryDB) DeleteKnownDevice(_ context.Context, id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.knownDevices = slices.DeleteFunc(db.knownDevices, func(d types.KnownDevice) bool { return d.ID == id })
+	return nil
+}
+
+func (db *memoryDB) CreatePersonalAccessToken(_ context.Context, token *types.PersonalAccessToken) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	token.ID = 1
+	if n := len(db.tokens); n > 0 {
+		token.ID = db.tokens[n-1].ID + 1
+	}
+	token.CreatedAt = time.Now()
+	db.tokens = append(db.tokens, *token)
+	return nil
+}
+
+func (db *memoryDB) GetPersonalAccessTokensByUserID(_ context.Context, userID string) ([]types.PersonalAccessToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var tokens []types.PersonalAccessToken
+	for i := len(db.tokens) - 1; i >= 0; i-- {
+		if db.tokens[i].UserID.String() == userID {
+			tokens = append(tokens, db.tokens[i])
+		}
+	}
+	return tokens, nil
+}
+
+func (db *memoryDB) GetPersonalAccessTokenByHash(_ context.Context, hash string) (types.PersonalAccessToken, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, t := range db.tokens {
+		if t.TokenHash == hash {
+			return t, nil
+		}
+	}
+	return types.PersonalAccessToken{}, sql.ErrNoRows
+}
+
+func (db *memoryDB) TouchPersonalAccessToken(_ context.Context, id int, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i, t := range db.tokens {
+		if t.ID == id {
+			db.tokens[i].LastUsedAt = at
+		}
+	}
+	return nil
+}
+
+func (db *memoryDB) DeletePersonalAccessToken(_ context.Context, userID string, id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tokens = slices.DeleteFunc(db.tokens, func(t types.PersonalAccessToken) bool {
+		return t.ID == id && t.UserID.String() == userID
+	})
+	return nil
+}
+
+func (db *memoryDB) DeletePersonalAccessTokensByUserID(_ context.Context, userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tokens = slices.DeleteFunc(db.tokens, func(t types.PersonalAccessToken) bool {
+		return t.UserID.String() == userID
+	})
+	return nil
+}
+
+// setRole gives the account of the user the named role, which is created
+// with perms when it does not exist yet.
+func (db *memoryDB) setRole(userID, name string, perms ...types.Permission) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.roles[name]; !ok {
+		db.roles[name] = types.Role{Name: name, Permissions: perms}
+	}
+	account := db.accounts[userID]
+	account.Role = name
+	db.accounts[userID] = account
+}
+
+type testApp struct {
+	*httptest.Server
+	auth *sb.MemoryProvider
+	mail *mail.MemorySender
+	db   *memoryDB
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	app := &testApp{
+		auth: sb.NewMemoryProvider(),
+		mail: mail.NewMemorySender(),
+		db:   newMemoryDB(),
+	}
+	app.Server = httptest.NewServer(handler.New(app.db, app.auth, app.mail).RegisterRoutes())
+	t.Cleanup(app.Close)
+
+	return app
+}
+
+func (app *testApp) client() *http.Client {
+	return &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (app *testApp) signUp(t *testing.T, email, password string) {
+	t.Helper()
+	_, err := app.auth.SignUp(context.Background(), supabase.UserCredentials{Email: email, Password: password})
+	if err != nil {
+		t.Fatalf("sign up failed. Err: %v", err)
+	}
+}
+
+func (app *testApp) login(t *testing.T, email, password string) []*http.Cookie {
+	t.Helper()
+	resp, _ := app.post(t, "/login", url.Values{
+		"email":    {email},
+		"password": {password},
+	}, nil)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status See Other; got %v", resp.Status)
+	}
+
+	return resp.Cookies()
+}
+
+var csrfMeta = regexp.MustCompile(`<meta name="csrf-token" content="([^"]+)">`)
+
+// csrf loads a page the way a browser would before submitting a form, and
+// returns the session cookies along with the CSRF token.
+func (app *testApp) csrf(t *testing.T, cookies []*http.Cookie) ([]*http.Cookie, string) {
+	t.Helper()
+	resp, body := app.get(t, "/login", cookies)
+	match := csrfMeta.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("expected csrf token in page")
+	}
+
+	return append(cookies, resp.Cookies()...), match[1]
+}
+
+func (app *testApp) get(t *testing.T, path string, cookies []*http.Cookie) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, app.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app.do(t, req, cookies)
+}
+
+func (app *testApp) post(t *testing.T, path string, form url.Values, cookies []*http.Cookie) (*http.Response, string) {
+	t.Helper()
+
+	return app.send(t, http.MethodPost, path, form, cookies)
+}
+
+// send submits the form along with the CSRF token, as htmx would.
+func (app *testApp) send(t *testing.T, method, path string, form url.Values, cookies []*http.Cookie) (*http.Response, string) {
+	t.Helper()
+	cookies, token := app.csrf(t, cookies)
+	req, err := http.NewRequest(method, app.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-CSRF-Token", token)
+
+	return app.do(t, req, cookies)
+}
+
+// sendJSON posts body with the CSRF token, as the passkey script does.
+func (app *testApp) sendJSON(t *testing.T, path string, body []byte, cookies []*http.Cookie) (*http.Response, string) {
+	t.Helper()
+	cookies, token := app.csrf(t, cookies)
+	req, err := http.NewRequest(http.MethodPost, app.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", token)
+
+	return app.do(t, req, cookies)
+}
+
+func (app *testApp) do(t *testing.T, req *http.Request, cookies []*http.Cookie) (*http.Response, string) {
+	t.Helper()
+	// Like a browser, the last cookie set under a name wins.
+	latest := map[string]*http.Cookie{}
+	for _, c := range cookies {
+		latest[c.Name] = c
+	}
+	for _, c := range latest {
+		req.AddCookie(c)
+	}
+	resp, err := app.client().Do(req)
 	if err != nil {
 		t.Fatalf("error making request to server. Err: %v", err)
 	}
 	defer resp.Body.Close()
-	// Assertions
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading response body. Err: %v", err)
+	}
+
+	return resp, string(body)
+}
+
+func TestLoginInvalidCredentials(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(t, "foo@bar.com", "Secret#123")
+
+	resp, body := app.post(t, "/login", url.Values{
+		"email":    {"foo@bar.com"},
+		"password": {"Wrong#1234"},
+	}, nil)
 	if resp.StatusCode != http.StatusOK {
 		t.Errorf("expected status OK; got %v", resp.Status)
 	}
-	expected := "{\"message\":\"Hello World\"}"
-	body, err := io.ReadAll(resp.Body)
+	if !strings.Contains(body, "Invalid credentials.") {
+		t.Errorf("expected invalid credentials error; got %v", body)
+	}
+}
+
+func TestLoginRequiresAccountSetup(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(t, "foo@bar.com", "Secret#123")
+	cookies := app.login(t, "foo@bar.com", "Secret#123")
+
+	resp, _ := app.get(t, "/settings", cookies)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status See Other; got %v", resp.Status)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/account/setup" {
+		t.Errorf("expected redirect to /account/setup; got %v", loc)
+	}
+}
+
+func TestSettingsWithAccount(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(t, "foo@bar.com", "Secret#123")
+	cookies := app.login(t, "foo@bar.com", "Secret#123")
+
+	resp, _ := app.get(t, "/account/setup", cookies)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+
+	user, err := app.auth.SignIn(context.Background(), supabase.UserCredentials{Email: "foo@bar.com", Password: "Secret#123"})
 	if err != nil {
-		t.Fatalf("error reading response body. Err: %v", err)
+		t.Fatal(err)
+	}
+	account := types.Account{UserID: uuid.MustParse(user.User.ID), Username: "foobar"}
+	if err := app.db.CreateAccount(context.Background(), &account); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := app.get(t, "/settings", cookies)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	if !strings.Contains(body, "foobar") {
+		t.Errorf("expected settings page to contain username; got %v", body)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	request := func(remoteAddr string, forwardedFor ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		for _, v := range forwardedFor {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		return r
+	}
+
+	if ip := session.ClientIP(request("10.0.0.2:1234", "1.2.3.4")); ip != "10.0.0.2" {
+		t.Errorf("expected X-Forwarded-For to be ignored without trusted proxies; got %v", ip)
+	}
+
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1/32")
+	for _, tc := range []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"trusted proxy", "10.0.0.2:1234", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"untrusted peer", "5.6.7.8:1234", []string{"1.2.3.4"}, "5.6.7.8"},
+		{"spoofed hop", "10.0.0.2:1234", []string{"9.9.9.9, 1.2.3.4"}, "1.2.3.4"},
+		{"chained proxies", "10.0.0.2:1234", []string{"1.2.3.4, 192.168.1.1", "10.0.0.3"}, "1.2.3.4"},
+		{"invalid hop", "10.0.0.2:1234", []string{"1.2.3.4, garbage"}, "10.0.0.2"},
+		{"no header", "10.0.0.2:1234", nil, "10.0.0.2"},
+	} {
+		if ip := session.ClientIP(request(tc.remoteAddr, tc.forwardedFor...)); ip != tc.want {
+			t.Errorf("%v: expected %v; got %v", tc.name, tc.want, ip)
+		}
+	}
+}
+
+func TestUnauthenticatedRedirectsToLogin(t *testing.T) {
+	app := newTestApp(t)
+
+	resp, _ := app.get(t, "/settings", nil)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status See Other; got %v", resp.Status)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/login" {
+		t.Errorf("expected redirect to /login; got %v", loc)
+	}
+}
+
+func TestExpiringTokenIsRefreshedOnce(t *testing.T) {
+	app := newTestApp(t)
+	app.auth.TokenTTL = 30 * time.Second
+	app.signUp(t, "foo@bar.com", "Secret#123")
+	cookies := app.login(t, "foo@bar.com", "Secret#123")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, _ := app.get(t, "/settings", cookies)
+			if loc := resp.Header.Get("Location"); loc != "/account/setup" {
+				t.Errorf("expected redirect to /account/setup; got %v", loc)
+			}
+			if len(resp.Cookies()) == 0 {
+				t.Errorf("expected refreshed session cookie")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestForgotPasswordRecovery(t *testing.T) {
+	app := newTestApp(t)
+	t.Setenv("PASSWORD_RECOVERY_CALLBACK_URL", app.URL+"/auth/callback")
+	app.signUp(t, "foo@bar.com", "Secret#123")
+
+	resp, _ := app.post(t, "/forgot-password", url.Values{"email": {"foo@bar.com"}}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	cookies := resp.Cookies()
+
+	outbox := app.auth.Outbox()
+	if len(outbox) != 1 || outbox[0].Type != "recovery" {
+		t.Fatalf("expected a recovery email; got %v", outbox)
+	}
+
+	resp, _ = app.get(t, strings.TrimPrefix(outbox[0].Link, app.URL), cookies)
+	if loc := resp.Header.Get("Location"); loc != "/settings/account/reset-password" {
+		t.Fatalf("expected redirect to /settings/account/reset-password; got %v", loc)
 	}
-	if expected != string(body) {
-		t.Errorf("expected response body to be %v; got %v", expected, string(body))
+	if len(resp.Cookies()) == 0 {
+		t.Fatalf("expected session cookie")
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	app := newTestApp(t)
+
+	_, body := app.post(t, "/forgot-password", url.Values{"email": {"nobody@bar.com"}}, nil)
+	if !strings.Contains(body, "a password reset link has been sent") {
+		t.Errorf("expected generic success message; got %v", body)
+	}
+	if len(app.auth.Outbox()) != 0 {
+		t.Errorf("expected no email to be sent")
+	}
+}
+
+func TestOTPLogin(t *testing.T) {
+	app := newTestApp(t)
+	t.Setenv("MAGIC_LINK_CALLBACK_URL", app.URL+"/auth/callback")
+	app.signUp(t, "foo@bar.com", "Secret#123")
+
+	resp, _ := app.post(t, "/login/otp", url.Values{"email": {"foo@bar.com"}}, nil)
+	cookies := resp.Cookies()
+
+	outbox := app.auth.Outbox()
+	if len(outbox) != 1 || len(outbox[0].Code) != 6 {
+		t.Fatalf("expected an email with a login code; got %v", outbox)
+	}
+
+	t.Run("wrong code", func(t *testing.T) {
+		_, body := app.post(t, "/login/otp/verify", url.Values{
+			"email": {"foo@bar.com"},
+			"token": {"abcdef"},
+		}, nil)
+		if !strings.Contains(body, "Invalid or expired code.") {
+			t.Errorf("expected invalid code error; got %v", body)
+		}
+	})
+
+	t.Run("valid code", func(t *testing.T) {
+		resp, _ := app.post(t, "/login/otp/verify", url.Values{
+			"email": {"foo@bar.com"},
+			"token": {outbox[0].Code},
+		}, nil)
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("expected status See Other; got %v", resp.Status)
+		}
+		resp, _ = app.get(t, "/settings", resp.Cookies())
+		if loc := resp.Header.Get("Location"); loc != "/account/setup" {
+			t.Errorf("expected redirect to /account/setup; got %v", loc)
+		}
+	})
+
+	t.Run("magic link", func(t *testing.T) {
+		resp, _ := app.get(t, strings.TrimPrefix(outbox[0].Link, app.URL), cookies)
+		if loc := resp.Header.Get("Location"); loc != "/" {
+			t.Fatalf("expected redirect to /; got %v", loc)
+		}
+		if len(resp.Cookies()) == 0 {
+			t.Fatalf("expected session cookie")
+		}
+	})
+
+	t.Run("magic link in another browser", func(t *testing.T) {
+		resp, body := app.get(t, strings.TrimPrefix(outbox[0].Link, app.URL), nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status Bad Request; got %v", resp.Status)
+		}
+		if !strings.Contains(body, "opened in a different browser") {
+			t.Errorf("expected callback error; got %v", body)
+		}
+	})
+}
+
+func TestOAuthProviders(t *testing.T) {
+	t.Setenv("OAUTH_PROVIDERS", "github, discord")
+	t.Setenv("OAUTH_GITHUB_REDIRECT_URL", "http://localhost/auth/callback?from=github")
+	app := newTestApp(t)
+
+	_, body := app.get(t, "/login", nil)
+	for _, label := range []string{"Login with GitHub", "Login with Discord"} {
+		if !strings.Contains(body, label) {
+			t.Errorf("expected login page to contain %q", label)
+		}
+	}
+	if strings.Contains(body, "Login with Google") {
+		t.Errorf("expected google to be disabled")
+	}
+
+	resp, _ := app.get(t, "/login/provider/github", nil)
+	if loc := resp.Header.Get("Location"); !strings.HasPrefix(loc, "http://localhost/auth/callback?from=github&state=") {
+		t.Errorf("expected redirect to the github callback; got %v", loc)
+	}
+
+	resp, _ = app.get(t, "/login/provider/google", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status Not Found; got %v", resp.Status)
+	}
+}
+
+func TestOAuthPKCE(t *testing.T) {
+	t.Setenv("GOOGLE_LOGIN_CALLBACK_URL", "http://localhost/auth/callback")
+	app := newTestApp(t)
+	app.signUp(t, "foo@bar.com", "Secret#123")
+	app.auth.ProviderUser = "foo@bar.com"
+
+	// The pending flow lives server side and is consumed by any callback, so
+	// each case starts its own.
+	start := func(t *testing.T) (*url.URL, []*http.Cookie) {
+		t.Helper()
+		resp, _ := app.get(t, "/login/provider/google", nil)
+		callback, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(callback.Query().Get("code")) == 0 || len(callback.Query().Get("state")) == 0 {
+			t.Fatalf("expected code and state in callback; got %v", callback)
+		}
+		return callback, resp.Cookies()
+	}
+
+	t.Run("state mismatch", func(t *testing.T) {
+		callback, cookies := start(t)
+		query := callback.Query()
+		query.Set("state", "forged")
+		resp, _ := app.get(t, "/auth/callback?"+query.Encode(), cookies)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status Bad Request; got %v", resp.Status)
+		}
+	})
+
+	t.Run("token in url is ignored", func(t *testing.T) {
+		resp, _ := app.get(t, "/auth/callback?access_token=foo&refresh_token=bar", nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status Bad Request; got %v", resp.Status)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		callback, cookies := start(t)
+		resp, _ := app.get(t, callback.RequestURI(), cookies)
+		if loc := resp.Header.Get("Location"); loc != "/" {
+			t.Fatalf("expected redirect to /; got %v", loc)
+		}
+		resp, _ = app.get(t, "/settings", resp.Cookies())
+		if loc := resp.Header.Get("Location"); loc != "/account/setup" {
+			t.Errorf("expected redirect to /account/setup; got %v", loc)
+		}
+	})
+}
+
+func TestCSRF(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(t, "foo@bar.com", "Secret#123")
+	cookies := app.login(t, "foo@bar.com", "Secret#123")
+
+	t.Run("missing token", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, app.URL+"/logout", nil)
+		resp, _ := app.do(t, req, cookies)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected status Forbidden; got %v", resp.Status)
+		}
+	})
+
+	t.Run("htmx request with wrong token", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPut, app.URL+"/settings/account/profile", strings.NewReader("username=foobar"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("HX-Request", "true")
+		req.Header.Set("X-CSRF-Token", "forged")
+		resp, body := app.do(t, req, cookies)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected status Forbidden; got %v", resp.Status)
+		}
+		if resp.Header.Get("HX-Retarget") != "body" {
+			t.Errorf("expected htmx retarget header")
+		}
+		if !strings.Contains(body, "alert-error") {
+			t.Errorf("expected error toast; got %v", body)
+		}
+	})
+
+	t.Run("form field", func(t *testing.T) {
+		cookies, token := app.csrf(t, cookies)
+		form := url.Values{"csrf_token": {token}}
+		req, _ := http.NewRequest(http.MethodPost, app.URL+"/logout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, _ := app.do(t, req, cookies)
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("expected status See Other; got %v", resp.Status)
+		}
+	})
+}
+
+func TestCSRFSessionIsLazy(t *testing.T) {
+	app := newTestApp(t)
+	sessions := func() int {
+		app.db.mu.Lock()
+		defer app.db.mu.Unlock()
+		return len(app.db.sessions)
+	}
+
+	for _, path := range []string{"/", "/settings", "/public/styles.css"} {
+		resp, _ := app.get(t, path, nil)
+		if len(resp.Cookies()) != 0 {
+			t.Errorf("expected no cookie for %v; got %v", path, resp.Cookies())
+		}
+	}
+	if n := sessions(); n != 0 {
+		t.Fatalf("expected no session without a form; got %v", n)
+	}
+
+	resp, body := app.get(t, "/login", nil)
+	if sessionCookie(resp.Cookies()) == nil || !csrfMeta.MatchString(body) {
+		t.Fatalf("expected a session along with the login form; got %v", resp.Cookies())
+	}
+	if n := sessions(); n != 1 {
+		t.Errorf("expected one session; got %v", n)
+	}
+}
+
+func sessionCookie(cookies []*http.Cookie) *http.Cookie {
+	var found *http.Cookie
+	for _, c := range cookies {
+		if c.Name == types.UserContextKey {
+			found = c
+		}
+	}
+	return found
+}
+
+func TestSessionRotatesOnLogin(t *testing.T) {
+	app := newTestApp(t)
+	app.signUp(t, "foo@bar.com", "Secret#123")
+
+	before, _ := app.csrf(t, nil)
+	planted := sessionCookie(before)
+	if planted == nil {
+		t.Fatalf("expected session cookie before login")
+	}
+
+	after := app.login(t, "foo@bar.com", "Secret#123")
+	current := sessionCookie(after)
+	if current == nil || current.Value == planted.Value {
+		t.Fatalf("expected session id to change on login")
+	}
+	if strings.Contains(current.Value, ".") {
+		t.Errorf("expected opaque session id; got %v", current.Value)
+	}
+
+	resp, _ := app.get(t, "/settings", []*http.Cookie{planted})
+	if loc := resp.Header.Get("Location"); loc != "/login" {
+		t.Errorf("expected pre-login session to stay anonymous; got redirect to %q", loc)
+	}
+	resp, _ = app.get(t, "/settings", []*http.Cookie{current})
+	if loc := resp.Header.Get("Location"); loc != "/account/setup" {
+		t.Errorf("expected redirect to /account/setup; got %v", loc)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	t.Setenv("SESSION_IDLE_TIMEOUT", "1h")
+	app := newTestApp(t)
+	app.signUp(t, "foo@bar.com", "Secret#123")
+	cookies := app.login(t, "foo@bar.com", "Secret#123")
+
+	app.db.mu.Lock()
+	for id, session := range app.db.sessions {
+		session.LastSeenAt = time.Now().Add(-2 * time.Hour)
+		app.db.sessions[id] = session
+	}
+	app.db.mu.Unlock()
+
+	resp, _ := app.get(t, "/settings", cookies)
+	if loc := resp.Header.Get("Location"); loc != "/login" {
+		t.Errorf("expected idle session to be expired; got redirect to %q", loc)
+	}
+}
+
+// withAccount signs the user up, logs in on each device and sets up the
+// account, returning the session cookies of every device.
+func (app *testApp) withAccount(t *testing.T, email string, devices int) [][]*http.Cookie {
+	t.Helper()
+	app.signUp(t, email, "Secret#123")
+	var all [][]*http.Cookie
+	for i := 0; i < devices; i++ {
+		all = append(all, app.login(t, email, "Secret#123"))
+	}
+	resp, _ := app.post(t, "/account/setup", url.Values{"username": {"foobar"}}, all[0])
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status See Other; got %v", resp.Status)
+	}
+
+	return all
+}
+
+func (app *testApp) userID(t *testing.T, email string) string {
+	t.Helper()
+	details, err := app.auth.SignIn(context.Background(), supabase.UserCredentials{Email: email, Password: "Secret#123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return details.User.ID
+}
+
+var revokeButton = regexp.MustCompile(`hx-delete="/settings/sessions/([0-9a-f]+)"`)
+
+func TestActiveSessions(t *testing.T) {
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 3)
+
+	_, body := app.get(t, "/settings", devices[0])
+	if n := strings.Count(body, "This device"); n != 1 {
+		t.Fatalf("expected current session marker once; got %d", n)
+	}
+	revoke := revokeButton.FindAllStringSubmatch(body, -1)
+	if len(revoke) != 2 {
+		t.Fatalf("expected 2 other sessions; got %d", len(revoke))
+	}
+
+	t.Run("revoke one", func(t *testing.T) {
+		resp, body := app.send(t, http.MethodDelete, "/settings/sessions/"+revoke[0][1], nil, devices[0])
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status OK; got %v", resp.Status)
+		}
+		if n := len(revokeButton.FindAllString(body, -1)); n != 1 {
+			t.Errorf("expected 1 other session left; got %d", n)
+		}
+	})
+
+	t.Run("log out everywhere else", func(t *testing.T) {
+		resp, body := app.send(t, http.MethodDelete, "/settings/sessions", nil, devices[0])
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status OK; got %v", resp.Status)
+		}
+		if revokeButton.MatchString(body) {
+			t.Errorf("expected no other sessions; got %v", body)
+		}
+		for _, cookies := range devices[1:] {
+			resp, _ := app.get(t, "/settings", cookies)
+			if loc := resp.Header.Get("Location"); loc != "/login" {
+				t.Errorf("expected revoked device to be logged out; got redirect to %q", loc)
+			}
+		}
+		resp, _ = app.get(t, "/settings", devices[0])
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected current device to stay logged in; got %v", resp.Status)
+		}
+	})
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 1)
+
+	resp, _ := app.post(t, "/logout", nil, devices[0])
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status See Other; got %v", resp.Status)
+	}
+	app.db.mu.Lock()
+	left := len(app.db.sessions)
+	app.db.mu.Unlock()
+	if left != 0 {
+		t.Errorf("expected the logged out session to be deleted; %d sessions left", left)
+	}
+
+	resp, _ = app.get(t, "/settings", devices[0])
+	if loc := resp.Header.Get("Location"); loc != "/login" {
+		t.Errorf("expected logged out session to be rejected; got redirect to %q", loc)
+	}
+}
+
+var (
+	totpSecret   = regexp.MustCompile(`<code class="font-mono">([A-Z2-7]+)</code>`)
+	recoveryCode = regexp.MustCompile(`<li>([0-9a-f]{5}-[0-9a-f]{5})</li>`)
+)
+
+func TestTwoFactor(t *testing.T) {
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 1)
+
+	_, body := app.post(t, "/settings/2fa/setup", nil, devices[0])
+	match := totpSecret.FindStringSubmatch(body)
+	if match == nil || !strings.Contains(body, "data:image/png;base64,") {
+		t.Fatalf("expected secret and qr code; got %v", body)
+	}
+	secret := match[1]
+
+	_, body = app.post(t, "/settings/2fa/confirm", url.Values{"code": {"000000"}}, devices[0])
+	if !strings.Contains(body, "Invalid code") {
+		t.Fatalf("expected invalid code error; got %v", body)
+	}
+	code, _ := otptotp.GenerateCode(secret, time.Now())
+	_, body = app.post(t, "/settings/2fa/confirm", url.Values{"code": {code}}, devices[0])
+	codes := recoveryCode.FindAllStringSubmatch(body, -1)
+	if len(codes) != 10 {
+		t.Fatalf("expected 10 recovery codes; got %v", body)
+	}
+
+	// challenge logs in with the password and returns the session waiting
+	// for its second factor.
+	challenge := func(t *testing.T) []*http.Cookie {
+		t.Helper()
+		cookies := app.login(t, "foo@bar.com", "Secret#123")
+		resp, _ := app.get(t, "/settings", cookies)
+		if loc := resp.Header.Get("Location"); loc != "/login" {
+			t.Fatalf("expected no session before second factor; got redirect to %q", loc)
+		}
+		resp, _ = app.get(t, "/login/2fa", cookies)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected two-factor challenge; got %v", resp.Status)
+		}
+		return cookies
+	}
+
+	t.Run("login requires second factor", func(t *testing.T) {
+		cookies := challenge(t)
+		_, body := app.post(t, "/login/2fa", url.Values{"code": {"000000"}}, cookies)
+		if !strings.Contains(body, "Invalid code") {
+			t.Fatalf("expected invalid code error; got %v", body)
+		}
+		// The code used to confirm the setup cannot be replayed.
+		_, body = app.post(t, "/login/2fa", url.Values{"code": {code}}, cookies)
+		if !strings.Contains(body, "Invalid code") {
+			t.Fatalf("expected replayed code to be rejected; got %v", body)
+		}
+
+		next, _ := otptotp.GenerateCode(secret, time.Now().Add(30*time.Second))
+		resp, _ := app.post(t, "/login/2fa", url.Values{"code": {next}}, cookies)
+		if loc := resp.Header.Get("Location"); loc != "/" {
+			t.Fatalf("expected redirect to /; got %v", loc)
+		}
+		resp, _ = app.get(t, "/settings", append(cookies, resp.Cookies()...))
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected logged in session; got %v", resp.Status)
+		}
+	})
+
+	t.Run("recovery code works once", func(t *testing.T) {
+		cookies := challenge(t)
+		resp, _ := app.post(t, "/login/2fa", url.Values{"code": {codes[0][1]}}, cookies)
+		if loc := resp.Header.Get("Location"); loc != "/" {
+			t.Fatalf("expected redirect to /; got %v", loc)
+		}
+
+		cookies = challenge(t)
+		_, body := app.post(t, "/login/2fa", url.Values{"code": {codes[0][1]}}, cookies)
+		if !strings.Contains(body, "Invalid code") {
+			t.Errorf("expected used recovery code to be rejected; got %v", body)
+		}
+	})
+
+	t.Run("disable requires password and code", func(t *testing.T) {
+		_, body := app.post(t, "/settings/2fa/disable", url.Values{
+			"password": {"Wrong#1234"},
+			"code":     {codes[1][1]},
+		}, devices[0])
+		if !strings.Contains(body, "Invalid password") {
+			t.Fatalf("expected invalid password error; got %v", body)
+		}
+
+		_, body = app.post(t, "/settings/2fa/disable", url.Values{
+			"password": {"Secret#123"},
+			"code":     {codes[1][1]},
+		}, devices[0])
+		if !strings.Contains(body, "Set up") {
+			t.Fatalf("expected two-factor to be disabled; got %v", body)
+		}
+		cookies := app.login(t, "foo@bar.com", "Secret#123")
+		resp, _ := app.get(t, "/settings", cookies)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected login without second factor; got %v", resp.Status)
+		}
+	})
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	t.Setenv("LOGIN_LOCKOUT_EMAIL_THRESHOLD", "3")
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 1)
+	_, body := app.post(t, "/settings/2fa/setup", nil, devices[0])
+	match := totpSecret.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("expected a secret; got %v", body)
+	}
+	code, _ := otptotp.GenerateCode(match[1], time.Now())
+	app.post(t, "/settings/2fa/confirm", url.Values{"code": {code}}, devices[0])
+
+	// Each login is restarted with the right password, the bad codes still
+	// add up.
+	for i, want := range []string{"Invalid code", "Invalid code", "Too many failed attempts"} {
+		cookies := app.login(t, "foo@bar.com", "Secret#123")
+		_, body := app.post(t, "/login/2fa", url.Values{"code": {"000000"}}, cookies)
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q after %d bad codes; got %v", want, i+1, body)
+		}
+	}
+	_, body = app.post(t, "/login", url.Values{"email": {"foo@bar.com"}, "password": {"Secret#123"}}, nil)
+	if !strings.Contains(body, "Too many failed attempts") {
+		t.Errorf("expected the email to be locked out; got %v", body)
+	}
+}
+
+var removePasskey = regexp.MustCompile(`hx-delete="/settings/passkeys/([0-9]+)"`)
+
+func TestPasskeys(t *testing.T) {
+	t.Setenv("WEBAUTHN_RP_ID", "localhost")
+	t.Setenv("WEBAUTHN_RP_ORIGINS", "http://localhost")
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 1)
+	key := newAuthenticator(t, "localhost", "http://localhost")
+
+	resp, _ := app.post(t, "/settings/passkeys/begin", nil, devices[0])
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected adding a passkey without the password to be refused; got %v", resp.Status)
+	}
+	resp, _ = app.post(t, "/settings/passkeys/begin", url.Values{"password": {"Wrong#123"}}, devices[0])
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected adding a passkey with a wrong password to be refused; got %v", resp.Status)
+	}
+	resp, body := app.post(t, "/settings/passkeys/begin", url.Values{"password": {"Secret#123"}}, devices[0])
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	resp, body = app.sendJSON(t, "/settings/passkeys/finish?name=Test+key", key.create(t, body), devices[0])
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Test key") {
+		t.Fatalf("expected passkey to be registered; got %v %v", resp.Status, body)
+	}
+
+	// login runs a passkey login from a new browser.
+	login := func(t *testing.T, a *authenticator) (*http.Response, []*http.Cookie) {
+		t.Helper()
+		cookies, _ := app.csrf(t, nil)
+		_, body := app.sendJSON(t, "/login/passkey/begin", nil, cookies)
+		resp, _ := app.sendJSON(t, "/login/passkey/finish", a.get(t, body), cookies)
+		return resp, append(cookies, resp.Cookies()...)
+	}
+
+	t.Run("login", func(t *testing.T) {
+		resp, cookies := login(t, key)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status OK; got %v", resp.Status)
+		}
+		resp, body := app.get(t, "/settings", cookies)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected logged in session; got %v", resp.Status)
+		}
+		if !strings.Contains(body, "Last used") {
+			t.Errorf("expected passkey last use to be shown; got %v", body)
+		}
+	})
+
+	t.Run("replayed challenge is rejected", func(t *testing.T) {
+		cookies, _ := app.csrf(t, nil)
+		_, body := app.sendJSON(t, "/login/passkey/begin", nil, cookies)
+		assertion := key.get(t, body)
+		app.sendJSON(t, "/login/passkey/finish", assertion, cookies)
+		resp, _ := app.sendJSON(t, "/login/passkey/finish", assertion, cookies)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status Bad Request; got %v", resp.Status)
+		}
+	})
+
+	t.Run("cloned passkey is disabled", func(t *testing.T) {
+		clone := *key
+		clone.signCount = 1
+		resp, _ := login(t, &clone)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status Unauthorized; got %v", resp.Status)
+		}
+		resp, _ = login(t, key)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected disabled passkey to be rejected; got %v", resp.Status)
+		}
+		_, body := app.get(t, "/settings", devices[0])
+		if !strings.Contains(body, "Disabled") {
+			t.Errorf("expected passkey to be shown as disabled; got %v", body)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		_, body := app.get(t, "/settings", devices[0])
+		match := removePasskey.FindStringSubmatch(body)
+		if match == nil {
+			t.Fatalf("expected remove button; got %v", body)
+		}
+		_, body = app.send(t, http.MethodDelete, "/settings/passkeys/"+match[1], nil, devices[0])
+		if strings.Contains(body, "Test key") {
+			t.Errorf("expected passkey to be removed; got %v", body)
+		}
+
+		app.db.mu.Lock()
+		defer app.db.mu.Unlock()
+		for _, action := range []string{types.AuditPasskeyAdded, types.AuditPasskeyRemoved} {
+			if !slices.ContainsFunc(app.db.auditEvents, func(e types.AuditEvent) bool { return e.Action == action }) {
+				t.Errorf("expected %v to be audited", action)
+			}
+		}
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	t.Setenv("LOGIN_LOCKOUT_EMAIL_THRESHOLD", "3")
+	t.Setenv("LOGIN_LOCKOUT_IP_THRESHOLD", "6")
+	app := newTestApp(t)
+	app.signUp(t, "foo@bar.com", "Secret#123")
+
+	attempt := func(email, password string) string {
+		_, body := app.post(t, "/login", url.Values{
+			"email":    {email},
+			"password": {password},
+		}, nil)
+		return body
+	}
+
+	t.Run("email", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if body := attempt("foo@bar.com", "Wrong#1234"); !strings.Contains(body, "Invalid credentials") {
+				t.Fatalf("expected invalid credentials error; got %v", body)
+			}
+		}
+		if body := attempt("foo@bar.com", "Wrong#1234"); !strings.Contains(body, "Too many failed attempts") {
+			t.Fatalf("expected lockout; got %v", body)
+		}
+		if body := attempt("foo@bar.com", "Secret#123"); !strings.Contains(body, "Too many failed attempts") {
+			t.Errorf("expected the right password to be refused while locked out; got %v", body)
+		}
+
+		app.db.mu.Lock()
+		lockouts := append([]types.Lockout(nil), app.db.lockouts...)
+		app.db.mu.Unlock()
+		if len(lockouts) != 1 || lockouts[0].Key != "email:foo@bar.com" || lockouts[0].Email != "foo@bar.com" || lockouts[0].Failures != 3 {
+			t.Errorf("expected lockout of the email to be recorded; got %+v", lockouts)
+		}
+	})
+
+	t.Run("mixed case", func(t *testing.T) {
+		limiter := lockout.NewLimiter(app.db)
+		limiter.EmailThreshold = 1
+		if _, err := limiter.Fail(context.Background(), "10.0.0.1", " Bar@Foo.com"); err != nil {
+			t.Fatal(err)
+		}
+		lockouts, err := app.db.GetLockoutsByEmail(context.Background(), "bar@foo.com", 10)
+		if err != nil || len(lockouts) != 1 {
+			t.Errorf("expected the lockout under the normalized email; got %+v %v", lockouts, err)
+		}
+	})
+
+	t.Run("ip", func(t *testing.T) {
+		// Together with the earlier failures this reaches the IP threshold,
+		// even though every email is different.
+		for i := 0; i < 2; i++ {
+			attempt(fmt.Sprintf("user%d@bar.com", i), "Wrong#1234")
+		}
+		if body := attempt("user9@bar.com", "Wrong#1234"); !strings.Contains(body, "Too many failed attempts") {
+			t.Errorf("expected lockout of the address; got %v", body)
+		}
+	})
+}
+
+func TestReauthenticationLockout(t *testing.T) {
+	t.Setenv("LOGIN_LOCKOUT_EMAIL_THRESHOLD", "2")
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 1)
+	userID := app.userID(t, "foo@bar.com")
+
+	_, body := app.post(t, "/settings/account/delete", url.Values{"username": {"foobar"}, "password": {"Wrong#1234"}}, devices[0])
+	if !strings.Contains(body, "Invalid password.") {
+		t.Fatalf("expected invalid password error; got %v", body)
+	}
+	_, body = app.post(t, "/settings/account/delete", url.Values{"username": {"foobar"}, "password": {"Wrong#1234"}}, devices[0])
+	if !strings.Contains(body, "Too many failed attempts") {
+		t.Fatalf("expected lockout; got %v", body)
+	}
+	// The lockout is shared by every form asking for the password, and the
+	// login.
+	_, body = app.post(t, "/settings/2fa/disable", url.Values{"password": {"Secret#123"}}, devices[0])
+	if !strings.Contains(body, "Too many failed attempts") {
+		t.Errorf("expected the right password to be refused while locked out; got %v", body)
+	}
+	_, body = app.post(t, "/login", url.Values{"email": {"foo@bar.com"}, "password": {"Secret#123"}}, nil)
+	if !strings.Contains(body, "Too many failed attempts") {
+		t.Errorf("expected the login to be locked out too; got %v", body)
+	}
+	if deletions, _ := app.db.GetAccountDeletions(context.Background(), userID); len(deletions) != 0 {
+		t.Errorf("expected no deletion; got %+v", deletions)
+	}
+
+	app.db.mu.Lock()
+	var failures []types.AuditEvent
+	for _, event := range app.db.auditEvents {
+		if event.Action == types.AuditReauthFailed {
+			failures = append(failures, event)
+		}
+	}
+	app.db.mu.Unlock()
+	if len(failures) != 3 || failures[0].UserID.String() != userID || failures[0].Metadata["path"] != "/settings/account/delete" || failures[2].Metadata["reason"] != "locked" {
+		t.Errorf("expected the failures to be audited; got %+v", failures)
+	}
+}
+
+func TestEmailChange(t *testing.T) {
+	app := newTestApp(t)
+	t.Setenv("EMAIL_CHANGE_CALLBACK_URL", app.URL+"/auth/callback")
+	devices := app.withAccount(t, "foo@bar.com", 1)
+
+	_, body := app.post(t, "/settings/account/email", url.Values{
+		"email":    {"new@bar.com"},
+		"password": {"Wrong#1234"},
+	}, devices[0])
+	if !strings.Contains(body, "Invalid password") {
+		t.Fatalf("expected invalid password error; got %v", body)
+	}
+	if len(app.auth.Outbox()) != 0 {
+		t.Fatalf("expected no email to be sent")
+	}
+
+	resp, body := app.post(t, "/settings/account/email", url.Values{
+		"email":    {"new@bar.com"},
+		"password": {"Secret#123"},
+	}, devices[0])
+	if !strings.Contains(body, "We sent a confirmation link to new@bar.com") {
+		t.Fatalf("expected confirmation message; got %v", body)
+	}
+	cookies := append(devices[0], resp.Cookies()...)
+
+	outbox := app.auth.Outbox()
+	if len(outbox) != 1 || outbox[0].To != "new@bar.com" {
+		t.Fatalf("expected a confirmation to the new address; got %v", outbox)
+	}
+	notices := app.mail.Outbox()
+	if len(notices) != 1 || notices[0].To != "foo@bar.com" || !strings.Contains(notices[0].Body, "new@bar.com") {
+		t.Fatalf("expected a notice to the old address; got %v", notices)
+	}
+
+	// Nothing changes until the link is opened.
+	app.login(t, "foo@bar.com", "Secret#123")
+
+	resp, _ = app.get(t, strings.TrimPrefix(outbox[0].Link, app.URL), cookies)
+	if loc := resp.Header.Get("Location"); loc != "/settings" {
+		t.Fatalf("expected redirect to /settings; got %v", loc)
+	}
+	_, body = app.get(t, "/settings", append(cookies, resp.Cookies()...))
+	if !strings.Contains(body, "new@bar.com") {
+		t.Errorf("expected the new email on the settings page; got %v", body)
+	}
+
+	app.login(t, "new@bar.com", "Secret#123")
+	_, body = app.post(t, "/login", url.Values{
+		"email":    {"foo@bar.com"},
+		"password": {"Secret#123"},
+	}, nil)
+	if !strings.Contains(body, "Invalid credentials") {
+		t.Errorf("expected the old email to be gone; got %v", body)
+	}
+}
+
+func TestAccountDeletion(t *testing.T) {
+	deletions := func(app *testApp) []types.AccountDeletion {
+		app.db.mu.Lock()
+		defer app.db.mu.Unlock()
+		return append([]types.AccountDeletion(nil), app.db.deletions...)
+	}
+	audited := func(app *testApp, action string) bool {
+		app.db.mu.Lock()
+		defer app.db.mu.Unlock()
+		return slices.ContainsFunc(app.db.auditEvents, func(e types.AuditEvent) bool { return e.Action == action })
+	}
+
+	t.Run("grace period", func(t *testing.T) {
+		t.Setenv("ACCOUNT_DELETION_GRACE_PERIOD", "24h")
+		app := newTestApp(t)
+		devices := app.withAccount(t, "foo@bar.com", 2)
+		token := app.createToken(t, devices[0])
+
+		_, body := app.post(t, "/settings/account/delete", url.Values{
+			"username": {"someone"},
+			"password": {"Secret#123"},
+		}, devices[0])
+		if !strings.Contains(body, "Type your username") {
+			t.Fatalf("expected username confirmation error; got %v", body)
+		}
+		_, body = app.post(t, "/settings/account/delete", url.Values{
+			"username": {"foobar"},
+			"password": {"Wrong#1234"},
+		}, devices[0])
+		if !strings.Contains(body, "Invalid password") {
+			t.Fatalf("expected invalid password error; got %v", body)
+		}
+
+		_, body = app.post(t, "/settings/account/delete", url.Values{
+			"username": {"foobar"},
+			"password": {"Secret#123"},
+		}, devices[0])
+		if !strings.Contains(body, "Log in again before then") {
+			t.Fatalf("expected scheduled deletion; got %v", body)
+		}
+		if d := deletions(app); len(d) != 1 || !d[0].Pending() {
+			t.Fatalf("expected a pending deletion to be recorded; got %+v", d)
+		}
+		for _, cookies := range devices {
+			resp, _ := app.get(t, "/settings", cookies)
+			if loc := resp.Header.Get("Location"); loc != "/login" {
+				t.Errorf("expected every session to be logged out; got redirect to %q", loc)
+			}
+		}
+		if resp := app.getWithToken(t, "/settings", token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected the personal access token to be revoked; got %v", resp.Status)
+		}
+
+		cookies := app.login(t, "foo@bar.com", "Secret#123")
+		if d := deletions(app); d[0].CancelledAt.IsZero() {
+			t.Errorf("expected login to cancel the deletion")
+		}
+		resp, _ := app.get(t, "/settings", cookies)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected the account to be kept; got %v", resp.Status)
+		}
+		for _, action := range []string{types.AuditAccountDeletionRequested, types.AuditAccountDeletionCancelled} {
+			if !audited(app, action) {
+				t.Errorf("expected %v to be audited", action)
+			}
+		}
+	})
+
+	t.Run("immediate", func(t *testing.T) {
+		t.Setenv("ACCOUNT_DELETION_GRACE_PERIOD", "0s")
+		app := newTestApp(t)
+		devices := app.withAccount(t, "foo@bar.com", 1)
+
+		_, body := app.post(t, "/settings/account/delete", url.Values{
+			"username": {"foobar"},
+			"password": {"Secret#123"},
+		}, devices[0])
+		if !strings.Contains(body, "Your account has been deleted") {
+			t.Fatalf("expected deleted account; got %v", body)
+		}
+		if d := deletions(app); len(d) != 1 || d[0].DeletedAt.IsZero() {
+			t.Errorf("expected the deletion to be recorded as done; got %+v", d)
+		}
+		app.db.mu.Lock()
+		accounts, sessions := len(app.db.accounts), len(app.db.sessions)
+		app.db.mu.Unlock()
+		if accounts != 0 || sessions != 0 {
+			t.Errorf("expected account data to be deleted; %d accounts and %d sessions left", accounts, sessions)
+		}
+		_, body = app.post(t, "/login", url.Values{
+			"email":    {"foo@bar.com"},
+			"password": {"Secret#123"},
+		}, nil)
+		if !strings.Contains(body, "Invalid credentials") {
+			t.Errorf("expected the auth user to be deleted; got %v", body)
+		}
+		if !audited(app, types.AuditAccountDeletionPurged) {
+			t.Errorf("expected the purge to be audited")
+		}
+	})
+}
+
+var downloadLink = regexp.MustCompile(`/settings/exports/[A-Za-z0-9_-]+`)
+
+func TestReauthenticationByEmail(t *testing.T) {
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 2)
+	form := url.Values{"username": {"foobar"}, "password": {""}}
+
+	_, body := app.post(t, "/settings/account/delete", form, devices[0])
+	if !strings.Contains(body, "Enter your password, or confirm by email") {
+		t.Fatalf("expected to be asked for the password; got %v", body)
+	}
+
+	_, body = app.post(t, "/settings/reauth", nil, devices[0])
+	if !strings.Contains(body, "We sent a confirmation link to foo@bar.com") {
+		t.Fatalf("expected the link to be sent; got %v", body)
+	}
+	outbox := app.mail.Outbox()
+	if len(outbox) != 1 || outbox[0].To != "foo@bar.com" {
+		t.Fatalf("expected a confirmation email; got %+v", outbox)
+	}
+	link := regexp.MustCompile(`/settings/reauth/[A-Za-z0-9_-]+`).FindString(outbox[0].Body)
+	if len(link) == 0 {
+		t.Fatalf("expected a link in the email; got %v", outbox[0].Body)
+	}
+
+	resp, _ := app.get(t, link, devices[1])
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the link to be refused in another session; got %v", resp.Status)
+	}
+	_, body = app.post(t, "/settings/account/delete", form, devices[1])
+	if !strings.Contains(body, "Enter your password, or confirm by email") {
+		t.Fatalf("expected another session to still need the password; got %v", body)
+	}
+
+	resp, body = app.get(t, link, devices[0])
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "without your password") {
+		t.Fatalf("expected the link to confirm the session; got %v %v", resp.Status, body)
+	}
+	resp, _ = app.get(t, link, devices[0])
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the link to work once; got %v", resp.Status)
+	}
+
+	_, body = app.post(t, "/settings/account/delete", form, devices[0])
+	if !strings.Contains(body, "Log in again before then") {
+		t.Fatalf("expected the deletion to be scheduled; got %v", body)
+	}
+	app.db.mu.Lock()
+	defer app.db.mu.Unlock()
+	if len(app.db.deletions) != 1 {
+		t.Errorf("expected a deletion to be recorded; got %+v", app.db.deletions)
+	}
+}
+
+func TestDataExport(t *testing.T) {
+	app := newTestApp(t)
+	t.Setenv("APP_URL", app.URL)
+	devices := app.withAccount(t, "foo@bar.com", 1)
+	app.createToken(t, devices[0])
+	app.db.mu.Lock()
+	hash := app.db.tokens[0].TokenHash
+	app.db.mu.Unlock()
+
+	_, body := app.post(t, "/settings/exports", nil, devices[0])
+	if !strings.Contains(body, "Preparing") && !downloadLink.MatchString(body) {
+		t.Fatalf("expected export to be started; got %v", body)
+	}
+
+	// The archive is built in the background, the page polls until the
+	// user is mailed.
+	deadline := time.Now().Add(5 * time.Second)
+	outbox := app.mail.Outbox()
+	for !downloadLink.MatchString(body) || len(outbox) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected export to be ready; got %v", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+		_, body = app.get(t, "/settings/exports", devices[0])
+		outbox = app.mail.Outbox()
+	}
+	if len(outbox) != 1 || outbox[0].To != "foo@bar.com" {
+		t.Fatalf("expected the user to be mailed; got %v", outbox)
+	}
+	link := downloadLink.FindString(outbox[0].Body)
+	if len(link) == 0 || !strings.Contains(body, link) {
+		t.Fatalf("expected the same download link in the email and on the page; got %v", outbox[0].Body)
+	}
+
+	resp, archive := app.get(t, link, devices[0])
+	if ct := resp.Header.Get("Content-Type"); ct != "application/zip" {
+		t.Fatalf("expected zip archive; got %v", ct)
+	}
+	zr, err := zip.NewReader(strings.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(data)
+	}
+	for _, name := range []string{"README.txt", "account.json", "identity.json", "sessions.json", "known_devices.json", "tokens.json", "passkeys.json", "two_factor.json", "security_activity.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected %v in the archive", name)
+		}
+	}
+	if !strings.Contains(files["account.json"], "foobar") || !strings.Contains(files["identity.json"], "foo@bar.com") {
+		t.Errorf("expected account and identity in the archive; got %v", files)
+	}
+	if !strings.Contains(files["known_devices.json"], "last_seen_at") {
+		t.Errorf("expected the known devices in the archive; got %v", files["known_devices.json"])
+	}
+	if !strings.Contains(files["tokens.json"], `"name": "script"`) || !strings.Contains(files["tokens.json"], `"prefix": "dpa_`) {
+		t.Errorf("expected the access tokens in the archive; got %v", files["tokens.json"])
+	}
+	if strings.Contains(files["tokens.json"], hash) {
+		t.Errorf("expected the token hashes to be left out; got %v", files["tokens.json"])
+	}
+
+	t.Run("other users cannot download", func(t *testing.T) {
+		other := app.withAccount(t, "bar@bar.com", 1)
+		resp, _ := app.get(t, link, other[0])
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status Not Found; got %v", resp.Status)
+		}
+	})
+
+	t.Run("link expires", func(t *testing.T) {
+		app.db.mu.Lock()
+		for token, e := range app.db.exports {
+			e.ExpiresAt = time.Now().Add(-time.Minute)
+			app.db.exports[token] = e
+		}
+		app.db.mu.Unlock()
+		resp, _ := app.get(t, link, devices[0])
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status Not Found; got %v", resp.Status)
+		}
+	})
+
+	t.Run("lost exports fail", func(t *testing.T) {
+		stale := types.DataExport{
+			UserID:    uuid.MustParse(app.userID(t, "foo@bar.com")),
+			Token:     "stale",
+			Status:    types.ExportPending,
+			CreatedAt: time.Now().Add(-time.Hour),
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		app.db.mu.Lock()
+		app.db.exports[stale.Token] = stale
+		app.db.mu.Unlock()
+
+		_, body := app.get(t, "/settings/exports", devices[0])
+		if strings.Contains(body, "Preparing") || !strings.Contains(body, "Failed") || !strings.Contains(body, "Export my data") {
+			t.Fatalf("expected the lost export to fail; got %v", body)
+		}
+		app.db.mu.Lock()
+		status := app.db.exports[stale.Token].Status
+		app.db.mu.Unlock()
+		if status != types.ExportFailed {
+			t.Errorf("expected the lost export to be marked failed; got %v", status)
+		}
+	})
+}
+
+func TestEmailConfirmation(t *testing.T) {
+	app := newTestApp(t)
+	app.auth.RequireConfirmation = true
+	t.Setenv("SIGNUP_CALLBACK_URL", app.URL+"/auth/callback")
+	app.signUp(t, "foo@bar.com", "Secret#123")
+	cookies := app.login(t, "foo@bar.com", "Secret#123")
+
+	for _, path := range []string{"/", "/settings", "/account/setup"} {
+		resp, _ := app.get(t, path, cookies)
+		if loc := resp.Header.Get("Location"); loc != "/confirm-email" {
+			t.Fatalf("expected %v to redirect to /confirm-email; got %v", path, loc)
+		}
+	}
+	_, body := app.get(t, "/confirm-email", cookies)
+	if !strings.Contains(body, "Check your inbox") {
+		t.Fatalf("expected check your inbox page; got %v", body)
+	}
+
+	resp, body := app.post(t, "/confirm-email/resend", nil, cookies)
+	if !strings.Contains(body, "We sent the email again") {
+		t.Fatalf("expected resend confirmation; got %v", body)
+	}
+	cookies = append(cookies, resp.Cookies()...)
+	_, body = app.post(t, "/confirm-email/resend", nil, cookies)
+	if !strings.Contains(body, "Please wait") {
+		t.Fatalf("expected resend to be throttled; got %v", body)
+	}
+
+	var link string
+	for _, m := range app.auth.Outbox() {
+		if m.Type == "signup" && m.Link != "" {
+			link = m.Link
+		}
+	}
+	if len(link) == 0 {
+		t.Fatalf("expected a confirmation link; got %v", app.auth.Outbox())
+	}
+
+	resp, _ = app.get(t, strings.TrimPrefix(link, app.URL), cookies)
+	if loc := resp.Header.Get("Location"); loc != "/" {
+		t.Fatalf("expected redirect to /; got %v", loc)
+	}
+	resp, _ = app.get(t, "/account/setup", append(cookies, resp.Cookies()...))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected account setup once confirmed; got %v", resp.Status)
+	}
+}
+
+func TestEmailConfirmationIgnoresUserMetadata(t *testing.T) {
+	app := newTestApp(t)
+	app.auth.RequireConfirmation = true
+	app.signUp(t, "foo@bar.com", "Secret#123")
+
+	// Users can write their metadata themselves, as with PUT /user.
+	details, err := app.auth.SignIn(context.Background(), supabase.UserCredentials{Email: "foo@bar.com", Password: "Secret#123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.auth.UpdateUser(context.Background(), details.AccessToken, map[string]interface{}{
+		"data": map[string]interface{}{"email_verified": true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := app.login(t, "foo@bar.com", "Secret#123")
+	resp, _ := app.get(t, "/account/setup", cookies)
+	if loc := resp.Header.Get("Location"); loc != "/confirm-email" {
+		t.Errorf("expected the unconfirmed user to be sent to /confirm-email; got %v %v", resp.Status, loc)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 1)
+	userID := app.userID(t, "foo@bar.com")
+
+	resp, _ := app.get(t, "/admin", devices[0])
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status Forbidden for a user; got %v", resp.Status)
+	}
+	_, body := app.get(t, "/settings", devices[0])
+	if strings.Contains(body, `href="/admin"`) {
+		t.Errorf("expected no admin link for a user")
+	}
+
+	app.db.setRole(userID, types.RoleModerator)
+	resp, _ = app.get(t, "/admin", devices[0])
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status Forbidden for a moderator; got %v", resp.Status)
+	}
+
+	app.db.setRole(userID, "support", types.PermissionAdminAccess, types.PermissionUsersRead)
+	resp, body = app.get(t, "/admin", devices[0])
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK for a custom role with admin access; got %v", resp.Status)
+	}
+	if !strings.Contains(body, "support") {
+		t.Errorf("expected the role on the admin page; got %v", body)
+	}
+	_, body = app.get(t, "/settings", devices[0])
+	if !strings.Contains(body, `href="/admin"`) {
+		t.Errorf("expected an admin link; got %v", body)
+	}
+}
+
+func TestAdminConsole(t *testing.T) {
+	app := newTestApp(t)
+	t.Setenv("APP_URL", app.URL)
+	admin := app.withAccount(t, "admin@bar.com", 1)[0]
+	adminID := app.userID(t, "admin@bar.com")
+	app.db.setRole(adminID, types.RoleAdmin)
+
+	app.signUp(t, "bob@bar.com", "Secret#123")
+	bob := app.login(t, "bob@bar.com", "Secret#123")
+	resp, _ := app.post(t, "/account/setup", url.Values{"username": {"bobby"}}, bob)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected status See Other; got %v", resp.Status)
+	}
+	bobAccount, err := app.db.GetAccountByUserID(context.Background(), app.userID(t, "bob@bar.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		account := types.Account{UserID: uuid.New(), Username: fmt.Sprintf("user%02d", i)}
+		if err := app.db.CreateAccount(context.Background(), &account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accountURL := fmt.Sprintf("/admin/accounts/%d", bobAccount.ID)
+
+	t.Run("requires permission", func(t *testing.T) {
+		resp, _ := app.get(t, "/admin", bob)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status Forbidden; got %v", resp.Status)
+		}
+		resp, _ = app.post(t, accountURL+"/disable", nil, bob)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected status Forbidden; got %v", resp.Status)
+		}
+	})
+
+	t.Run("search and paginate", func(t *testing.T) {
+		_, body := app.get(t, "/admin", admin)
+		if !strings.Contains(body, "27 accounts") || !strings.Contains(body, "Page 1 of 2") {
+			t.Errorf("expected the first page of accounts; got %v", body)
+		}
+		_, body = app.get(t, "/admin/accounts?page=2", admin)
+		if !strings.Contains(body, "Page 2 of 2") || !strings.Contains(body, "user24") || strings.Contains(body, "user00") {
+			t.Errorf("expected the second page of accounts; got %v", body)
+		}
+		_, body = app.get(t, "/admin/accounts?q=bob", admin)
+		if !strings.Contains(body, "1 accounts") || !strings.Contains(body, accountURL) {
+			t.Errorf("expected bob to be found; got %v", body)
+		}
+	})
+
+	t.Run("details", func(t *testing.T) {
+		_, body := app.get(t, accountURL, admin)
+		if !strings.Contains(body, "bob@bar.com") || !strings.Contains(body, "bobby") {
+			t.Errorf("expected the identity and account; got %v", body)
+		}
+		resp, _ := app.get(t, "/admin/accounts/999", admin)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status Not Found; got %v", resp.Status)
+		}
+	})
+
+	t.Run("reset username", func(t *testing.T) {
+		_, body := app.post(t, accountURL+"/username", url.Values{"username": {"b"}}, admin)
+		if !strings.Contains(body, "alert-error") {
+			t.Errorf("expected a validation error; got %v", body)
+		}
+		_, body = app.post(t, accountURL+"/username", url.Values{"username": {"robert"}}, admin)
+		if !strings.Contains(body, "The username was changed to robert") {
+			t.Errorf("expected the username to change; got %v", body)
+		}
+	})
+
+	t.Run("password reset email", func(t *testing.T) {
+		_, body := app.post(t, accountURL+"/password-reset", nil, admin)
+		if !strings.Contains(body, "A password reset email was sent") {
+			t.Fatalf("expected a password reset email; got %v", body)
+		}
+		outbox := app.mail.Outbox()
+		if len(outbox) != 1 || outbox[0].To != "bob@bar.com" {
+			t.Fatalf("expected an email to bob; got %v", outbox)
+		}
+		link := app.URL + "/forgot-password?email=bob%40bar.com"
+		if !strings.Contains(outbox[0].Body, link) {
+			t.Fatalf("expected a link to the forgot password form; got %v", outbox[0].Body)
+		}
+		_, body = app.get(t, strings.TrimPrefix(link, app.URL), nil)
+		if !strings.Contains(body, `value="bob@bar.com"`) {
+			t.Errorf("expected the email to be filled in; got %v", body)
+		}
+	})
+
+	t.Run("disable and enable", func(t *testing.T) {
+		_, body := app.post(t, fmt.Sprintf("/admin/accounts/%d/disable", 1), nil, admin)
+		if !strings.Contains(body, "You cannot disable your own account") {
+			t.Errorf("expected admins not to disable themselves; got %v", body)
+		}
+
+		_, body = app.post(t, accountURL+"/disable", nil, admin)
+		if !strings.Contains(body, "The account was disabled") {
+			t.Fatalf("expected the account to be disabled; got %v", body)
+		}
+		resp, _ := app.get(t, "/settings", bob)
+		if loc := resp.Header.Get("Location"); loc != "/login" {
+			t.Errorf("expected bob to be logged out; got %v", loc)
+		}
+		cookies := app.login(t, "bob@bar.com", "Secret#123")
+		resp, _ = app.get(t, "/settings", cookies)
+		if loc := resp.Header.Get("Location"); loc != "/account/disabled" {
+			t.Errorf("expected redirect to /account/disabled; got %v", loc)
+		}
+
+		_, body = app.post(t, accountURL+"/enable", nil, admin)
+		if !strings.Contains(body, "The account was enabled") {
+			t.Fatalf("expected the account to be enabled; got %v", body)
+		}
+		resp, _ = app.get(t, "/settings", cookies)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status OK; got %v", resp.Status)
+		}
+	})
+
+	t.Run("force logout", func(t *testing.T) {
+		cookies := app.login(t, "bob@bar.com", "Secret#123")
+		token := app.createToken(t, cookies)
+		backend, err := app.auth.SignIn(context.Background(), supabase.UserCredentials{Email: "bob@bar.com", Password: "Secret#123"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, body := app.post(t, accountURL+"/logout", nil, admin)
+		if !strings.Contains(body, "The user was logged out everywhere") {
+			t.Fatalf("expected the user to be logged out; got %v", body)
+		}
+		resp, _ := app.get(t, "/settings", cookies)
+		if loc := resp.Header.Get("Location"); loc != "/login" {
+			t.Errorf("expected redirect to /login; got %v", loc)
+		}
+		if resp := app.getWithToken(t, "/settings", token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected the personal access token to be revoked; got %v", resp.Status)
+		}
+		if _, err := app.auth.RefreshUser(context.Background(), backend.AccessToken, backend.RefreshToken); err == nil {
+			t.Errorf("expected the backend refresh token to be revoked")
+		}
+	})
+
+	t.Run("audited", func(t *testing.T) {
+		app.db.mu.Lock()
+		defer app.db.mu.Unlock()
+		actions := map[string]bool{}
+		for _, e := range app.db.auditEvents {
+			if e.ActorID.String() == adminID && e.UserID == bobAccount.UserID {
+				actions[e.Action] = true
+			}
+		}
+		for _, action := range []string{types.AuditAccountDisabled, types.AuditAccountEnabled, types.AuditAccountLoggedOut, types.AuditUsernameReset, types.AuditPasswordReset} {
+			if !actions[action] {
+				t.Errorf("expected %v by the admin to be audited; got %v", action, actions)
+			}
+		}
+	})
+}
+
+func TestImpersonation(t *testing.T) {
+	app := newTestApp(t)
+	admin := app.withAccount(t, "admin@bar.com", 1)[0]
+	adminID := app.userID(t, "admin@bar.com")
+	app.db.setRole(adminID, types.RoleAdmin)
+
+	app.signUp(t, "bob@bar.com", "Secret#123")
+	bob := app.login(t, "bob@bar.com", "Secret#123")
+	app.post(t, "/account/setup", url.Values{"username": {"bobby"}}, bob)
+	bobID := app.userID(t, "bob@bar.com")
+	bobAccount, err := app.db.GetAccountByUserID(context.Background(), bobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accountURL := fmt.Sprintf("/admin/accounts/%d", bobAccount.ID)
+	export := types.DataExport{
+		UserID:    bobAccount.UserID,
+		Token:     "bobs-export",
+		Status:    types.ExportReady,
+		Archive:   []byte("archive"),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if err := app.db.CreateDataExport(context.Background(), &export); err != nil {
+		t.Fatal(err)
+	}
+	auditEvents := func() []types.AuditEvent {
+		app.db.mu.Lock()
+		defer app.db.mu.Unlock()
+		var events []types.AuditEvent
+		for _, event := range app.db.auditEvents {
+			if strings.HasPrefix(event.Action, "impersonation.") {
+				events = append(events, event)
+			}
+		}
+		return events
+	}
+
+	_, body := app.post(t, "/admin/accounts/1/impersonate", nil, admin)
+	if !strings.Contains(body, "You cannot impersonate yourself") {
+		t.Errorf("expected admins not to impersonate themselves; got %v", body)
+	}
+	resp, _ := app.post(t, accountURL+"/impersonate", nil, bob)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status Forbidden for a user; got %v", resp.Status)
+	}
+
+	resp, _ = app.post(t, accountURL+"/impersonate", nil, admin)
+	if loc := resp.Header.Get("Location"); loc != "/" {
+		t.Fatalf("expected redirect to /; got %v", loc)
+	}
+	cookies := append(admin, resp.Cookies()...)
+	if events := auditEvents(); len(events) != 1 || events[0].Action != types.AuditImpersonationStart ||
+		events[0].ActorID.String() != adminID || events[0].UserID.String() != bobID {
+		t.Fatalf("expected the start to be audited; got %v", events)
+	}
+
+	_, body = app.get(t, "/settings", cookies)
+	if !strings.Contains(body, "You are acting as") || !strings.Contains(body, "bobby") || !strings.Contains(body, "admin@bar.com") {
+		t.Fatalf("expected bob's settings with the impersonation banner; got %v", body)
+	}
+	resp, _ = app.get(t, "/admin", cookies)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected bob's permissions while impersonating; got %v", resp.Status)
+	}
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodPost, "/settings/account/email"},
+		{http.MethodPut, "/settings/account/reset-password"},
+		{http.MethodPost, "/settings/account/delete"},
+		{http.MethodPost, "/settings/2fa/setup"},
+		{http.MethodPost, "/settings/exports"},
+		{http.MethodGet, "/settings/exports/" + export.Token},
+	} {
+		resp, body := app.send(t, req.method, req.path, url.Values{"email": {"evil@bar.com"}, "password": {"Secret#123"}}, cookies)
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "not available while impersonating") {
+			t.Errorf("expected %v %v to be denied; got %v %v", req.method, req.path, resp.Status, body)
+		}
+	}
+	if len(app.auth.Outbox()) != 0 {
+		t.Errorf("expected no email change; got %v", app.auth.Outbox())
+	}
+	if exports, _ := app.db.GetDataExportsByUserID(context.Background(), bobID); len(exports) != 1 {
+		t.Errorf("expected no export to be started; got %v", exports)
+	}
+
+	resp, _ = app.post(t, "/impersonation/stop", nil, cookies)
+	if loc := resp.Header.Get("Location"); loc != accountURL {
+		t.Fatalf("expected redirect to %v; got %v", accountURL, loc)
+	}
+	cookies = append(cookies, resp.Cookies()...)
+	resp, body = app.get(t, "/admin", cookies)
+	if resp.StatusCode != http.StatusOK || strings.Contains(body, "You are acting as") {
+		t.Errorf("expected the admin back; got %v %v", resp.Status, body)
+	}
+	if events := auditEvents(); len(events) != 2 || events[1].Action != types.AuditImpersonationStop || events[1].ActorID.String() != adminID ||
+		events[1].Metadata["admin"] != "admin@bar.com" {
+		t.Errorf("expected the stop to be audited; got %v", events)
+	}
+
+	// Logging out or in as someone else ends the impersonation too.
+	for _, end := range []struct {
+		name string
+		end  func(cookies []*http.Cookie)
+	}{
+		{"logout", func(cookies []*http.Cookie) { app.post(t, "/logout", nil, cookies) }},
+		{"login", func(cookies []*http.Cookie) {
+			app.post(t, "/login", url.Values{"email": {"admin@bar.com"}, "password": {"Secret#123"}}, cookies)
+		}},
+	} {
+		admin := app.login(t, "admin@bar.com", "Secret#123")
+		resp, _ := app.post(t, accountURL+"/impersonate", nil, admin)
+		end.end(append(admin, resp.Cookies()...))
+		events := auditEvents()
+		if last := events[len(events)-1]; last.Action != types.AuditImpersonationStop || last.Metadata["ended"] != end.name ||
+			last.Metadata["admin"] != "admin@bar.com" {
+			t.Errorf("expected the %v to end the impersonation in the audit log; got %v", end.name, events)
+		}
+	}
+
+	app.signUp(t, "other@bar.com", "Secret#123")
+	other := app.login(t, "other@bar.com", "Secret#123")
+	app.post(t, "/account/setup", url.Values{"username": {"other"}}, other)
+	otherID := app.userID(t, "other@bar.com")
+	app.db.setRole(otherID, types.RoleAdmin)
+	otherAccount, _ := app.db.GetAccountByUserID(context.Background(), otherID)
+	_, body = app.post(t, fmt.Sprintf("/admin/accounts/%d/impersonate", otherAccount.ID), nil, cookies)
+	if !strings.Contains(body, "Admins cannot be impersonated") {
+		t.Errorf("expected admins not to be impersonated; got %v", body)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	app := newTestApp(t)
+	resp, _ := app.post(t, "/signup", url.Values{
+		"email":           {"foo@bar.com"},
+		"password":        {"Secret#123"},
+		"confirmPassword": {"Secret#123"},
+	}, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK; got %v", resp.Status)
+	}
+	app.post(t, "/login", url.Values{"email": {"foo@bar.com"}, "password": {"Wrong#1234"}}, nil)
+	cookies := app.login(t, "foo@bar.com", "Secret#123")
+	app.post(t, "/account/setup", url.Values{"username": {"foobar"}}, cookies)
+	app.send(t, http.MethodPut, "/settings/account/profile", url.Values{"username": {"foobaz"}}, cookies)
+	app.post(t, "/logout", nil, cookies)
+	userID := app.userID(t, "foo@bar.com")
+
+	app.db.mu.Lock()
+	var actions []string
+	for _, event := range app.db.auditEvents {
+		actions = append(actions, event.Action)
+		if event.IP == "" || event.UserAgent == "" {
+			t.Errorf("expected the request to be recorded; got %+v", event)
+		}
+	}
+	app.db.mu.Unlock()
+	want := []string{
+		types.AuditSignup, types.AuditLoginFailed, types.AuditLoginSucceeded, types.AuditAccountSetup,
+		types.AuditUsernameChanged, types.AuditLogout,
+	}
+	if !slices.Equal(actions[:len(want)], want) {
+		t.Fatalf("expected %v; got %v", want, actions)
+	}
+
+	cookies = app.login(t, "foo@bar.com", "Secret#123")
+	_, body := app.get(t, "/settings", cookies)
+	for _, s := range []string{"Recent security activity", "Failed login", "Changed the username", "Signed up"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected %q in the settings; got %v", s, body)
+		}
+	}
+
+	resp, _ = app.get(t, "/admin/audit", cookies)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status Forbidden for a user; got %v", resp.Status)
+	}
+
+	admin := app.withAccount(t, "admin@bar.com", 1)[0]
+	app.db.setRole(app.userID(t, "admin@bar.com"), types.RoleAdmin)
+	resp, body = app.get(t, "/admin/audit", admin)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, userID) {
+		t.Fatalf("expected the audit log; got %v %v", resp.Status, body)
+	}
+	_, body = app.get(t, "/admin/audit/events?action="+types.AuditLoginFailed, admin)
+	if !strings.Contains(body, "foo@bar.com") || strings.Contains(body, "Changed the username") {
+		t.Errorf("expected only failed logins; got %v", body)
+	}
+	_, body = app.get(t, "/admin/audit/events?user=nope", admin)
+	if !strings.Contains(body, "The user must be a user ID.") {
+		t.Errorf("expected the filter to be validated; got %v", body)
+	}
+
+	if err := app.db.CreateAuditEvent(context.Background(), &types.AuditEvent{
+		Action:    types.AuditLoginFailed,
+		UserID:    uuid.MustParse(userID),
+		UserAgent: "=HYPERLINK(\"http://evil\")",
+		Metadata:  map[string]string{"email": "@SUM(1)", "reason": "invalid_credentials"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, body = app.get(t, "/admin/audit.csv?user="+userID, admin)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("expected a CSV; got %v", ct)
+	}
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) < 2 || records[0][0] != "id" {
+		t.Fatalf("expected a header and events; got %v", records)
+	}
+	for _, record := range records[1:] {
+		if record[4] != userID {
+			t.Errorf("expected only events about the user; got %v", record)
+		}
+	}
+	if latest := records[1]; latest[6] != `'=HYPERLINK("http://evil")` || !strings.Contains(latest[8], `"email":"@SUM(1)"`) {
+		t.Errorf("expected formulas to be escaped in standalone cells only; got %v", latest)
+	}
+}
+
+var secureLink = regexp.MustCompile(`/account/secure/[A-Za-z0-9_-]+`)
+
+func TestNewDeviceAlert(t *testing.T) {
+	app := newTestApp(t)
+	t.Setenv("APP_URL", app.URL)
+	t.Setenv("LOCATION_HEADERS", "X-City,X-Country")
+	t.Setenv("PASSWORD_RECOVERY_CALLBACK_URL", app.URL+"/auth/callback")
+	devices := app.withAccount(t, "foo@bar.com", 2)
+	token := app.createToken(t, devices[0])
+
+	loginFrom := func(userAgent string) []*http.Cookie {
+		cookies, token := app.csrf(t, nil)
+		form := url.Values{"email": {"foo@bar.com"}, "password": {"Secret#123"}}
+		req, _ := http.NewRequest(http.MethodPost, app.URL+"/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-CSRF-Token", token)
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("X-City", "Lisbon")
+		req.Header.Set("X-Country", "PT")
+		resp, _ := app.do(t, req, cookies)
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("expected status See Other; got %v", resp.Status)
+		}
+		return append(cookies, resp.Cookies()...)
+	}
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+	loginFrom(firefox)
+
+	// The alert is mailed in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(app.mail.Outbox()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a new device alert")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	loginFrom(firefox)
+	outbox := app.mail.Outbox()
+	if len(outbox) != 1 || outbox[0].To != "foo@bar.com" {
+		t.Fatalf("expected a single alert for the new device only; got %v", outbox)
+	}
+	for _, s := range []string{"Lisbon, PT", "Firefox on Linux", "127.0.0.1"} {
+		if !strings.Contains(outbox[0].Body, s) {
+			t.Errorf("expected %q in the alert; got %v", s, outbox[0].Body)
+		}
+	}
+	link := secureLink.FindString(outbox[0].Body)
+	if len(link) == 0 {
+		t.Fatalf("expected a secure link in the alert; got %v", outbox[0].Body)
+	}
+
+	_, body := app.get(t, link, nil)
+	if !strings.Contains(body, "Secure your account") {
+		t.Fatalf("expected a confirmation before securing; got %v", body)
+	}
+	_, body = app.post(t, link, nil, nil)
+	if !strings.Contains(body, "Your account is secured") {
+		t.Fatalf("expected the account to be secured; got %v", body)
+	}
+	if _, err := app.auth.SignIn(context.Background(), supabase.UserCredentials{Email: "foo@bar.com", Password: "Secret#123"}); err == nil {
+		t.Errorf("expected the password to be replaced")
+	}
+	resp, _ := app.get(t, "/settings", devices[0])
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("expected the sessions to be logged out; got %v", resp.Status)
+	}
+	if resp := app.getWithToken(t, "/settings", token); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the personal access token to be revoked; got %v", resp.Status)
+	}
+	mails := app.auth.Outbox()
+	if len(mails) != 1 || mails[0].To != "foo@bar.com" {
+		t.Errorf("expected a password reset email; got %v", mails)
+	}
+
+	resp, _ = app.post(t, link, nil, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the link to work once; got %v", resp.Status)
+	}
+}
+
+var personalToken = regexp.MustCompile(`dpa_[A-Za-z0-9_-]+`)
+
+// createToken creates a personal access token reading the account from the
+// settings of the session.
+func (app *testApp) createToken(t *testing.T, cookies []*http.Cookie) string {
+	t.Helper()
+	_, body := app.post(t, "/settings/tokens", url.Values{"name": {"script"}, "scopes": {"account:read"}, "expires_in": {"30"}}, cookies)
+	token := personalToken.FindString(body)
+	if len(token) == 0 {
+		t.Fatalf("expected a personal access token; got %v", body)
+	}
+	return token
+}
+
+// getWithToken requests path with a personal access token instead of the
+// session cookie.
+func (app *testApp) getWithToken(t *testing.T, path, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, app.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, _ := app.do(t, req, nil)
+	return resp
+}
+
+func TestPersonalAccessTokens(t *testing.T) {
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 1)
+	withToken := func(method, path, token string, form url.Values) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, app.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		return app.do(t, req, nil)
+	}
+	create := func(form url.Values) string {
+		t.Helper()
+		_, body := app.post(t, "/settings/tokens", form, devices[0])
+		token := personalToken.FindString(body)
+		if len(token) == 0 {
+			t.Fatalf("expected the new token to be shown; got %v", body)
+		}
+		return token
+	}
+
+	_, body := app.post(t, "/settings/tokens", url.Values{"expires_in": {"30"}}, devices[0])
+	if !strings.Contains(body, "Pick at least one scope.") || personalToken.MatchString(body) {
+		t.Errorf("expected validation errors; got %v", body)
+	}
+
+	reader := create(url.Values{"name": {"backup"}, "scopes": {"account:read", "exports"}, "expires_in": {"30"}})
+	app.db.mu.Lock()
+	stored := app.db.tokens[0]
+	app.db.mu.Unlock()
+	if stored.TokenHash == reader || strings.Contains(stored.TokenHash, reader) || stored.ExpiresAt.IsZero() {
+		t.Errorf("expected only a hash of the token to be kept, expiring; got %+v", stored)
+	}
+
+	resp, body := withToken(http.MethodGet, "/settings", reader, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "foobar") {
+		t.Fatalf("expected the settings with the token; got %v %v", resp.Status, body)
+	}
+	if len(resp.Cookies()) != 0 {
+		t.Errorf("expected no session for token requests; got %v", resp.Cookies())
+	}
+	app.db.mu.Lock()
+	lastUsed := app.db.tokens[0].LastUsedAt
+	app.db.mu.Unlock()
+	if lastUsed.IsZero() {
+		t.Errorf("expected the token use to be recorded")
+	}
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodPut, "/settings/account/profile"},
+		{http.MethodGet, "/"},
+		{http.MethodPost, "/settings/tokens"},
+		{http.MethodPost, "/settings/account/delete"},
+	} {
+		resp, _ := withToken(req.method, req.path, reader, url.Values{"username": {"hacked"}, "name": {"more"}})
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected %v %v to be denied to the token; got %v", req.method, req.path, resp.Status)
+		}
+	}
+	resp, _ = withToken(http.MethodGet, "/settings", "dpa_nope", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status Unauthorized for an unknown token; got %v", resp.Status)
+	}
+
+	writer := create(url.Values{"name": {"profile"}, "scopes": {"account:write"}, "expires_in": {"0"}})
+	resp, body = withToken(http.MethodPut, "/settings/account/profile", writer, url.Values{"username": {"scripted"}})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Username updated successfully.") {
+		t.Fatalf("expected the profile to be updated with the token; got %v %v", resp.Status, body)
+	}
+	account, _ := app.db.GetAccountByUserID(context.Background(), app.userID(t, "foo@bar.com"))
+	if account.Username != "scripted" {
+		t.Errorf("expected username scripted; got %v", account.Username)
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		app.db.mu.Lock()
+		app.db.tokens[1].ExpiresAt = time.Now().Add(-time.Minute)
+		app.db.mu.Unlock()
+		resp, _ := withToken(http.MethodPut, "/settings/account/profile", writer, url.Values{"username": {"again"}})
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status Unauthorized for an expired token; got %v", resp.Status)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		app.db.mu.Lock()
+		id := app.db.tokens[0].ID
+		app.db.mu.Unlock()
+		app.send(t, http.MethodDelete, fmt.Sprintf("/settings/tokens/%d", id), nil, devices[0])
+		resp, _ := withToken(http.MethodGet, "/settings", reader, nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status Unauthorized for a revoked token; got %v", resp.Status)
+		}
+	})
+}
+
+// apiError is the error envelope of the JSON API.
+type apiError struct {
+	Error struct {
+		Code    string            `json:"code"`
+		Message string            `json:"message"`
+		Fields  map[string]string `json:"fields"`
+	} `json:"error"`
+}
+
+func TestJSONAPI(t *testing.T) {
+	app := newTestApp(t)
+	call := func(method, path, token string, body any, cookies []*http.Cookie) (*http.Response, string) {
+		t.Helper()
+		var r io.Reader
+		if body != nil {
+			b, err := json.Marshal(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = bytes.NewReader(b)
+		}
+		req, err := http.NewRequest(method, app.URL+"/api/v1"+path, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return app.do(t, req, cookies)
+	}
+	expectError := func(resp *http.Response, body string, status int, code string) apiError {
+		t.Helper()
+		var e apiError
+		if err := json.Unmarshal([]byte(body), &e); err != nil || resp.StatusCode != status || e.Error.Code != code {
+			t.Errorf("expected %v %v; got %v %v", status, code, resp.Status, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected a JSON error; got %v", ct)
+		}
+		return e
+	}
+
+	resp, body := call(http.MethodPost, "/auth/signup", "", map[string]string{"email": "nope", "password": "short", "confirm_password": "other"}, nil)
+	e := expectError(resp, body, http.StatusUnprocessableEntity, "validation_failed")
+	for _, field := range []string{"email", "password", "confirm_password"} {
+		if len(e.Error.Fields[field]) == 0 {
+			t.Errorf("expected an error for %v; got %v", field, e.Error.Fields)
+		}
+	}
+	resp, body = call(http.MethodPost, "/auth/signup", "", map[string]string{"email": "foo@bar.com", "password": "Secret#123", "confirm_password": "Secret#123"}, nil)
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(body, `"email":"foo@bar.com"`) {
+		t.Fatalf("expected the user to be created; got %v %v", resp.Status, body)
+	}
+	resp, body = call(http.MethodPost, "/auth/signup", "", "{", nil)
+	expectError(resp, body, http.StatusBadRequest, "invalid_json")
+
+	login := map[string]any{"email": "foo@bar.com", "password": "Wrong#123", "name": "cli", "scopes": []string{"account:read", "account:write"}, "expires_in_days": 30}
+	resp, body = call(http.MethodPost, "/auth/token", "", login, nil)
+	expectError(resp, body, http.StatusUnauthorized, "invalid_credentials")
+	login["password"] = "Secret#123"
+	login["scopes"] = []string{"admin"}
+	resp, body = call(http.MethodPost, "/auth/token", "", login, nil)
+	if e := expectError(resp, body, http.StatusUnprocessableEntity, "validation_failed"); len(e.Error.Fields["scopes"]) == 0 {
+		t.Errorf("expected an error for scopes; got %v", e.Error.Fields)
+	}
+	login["scopes"] = []string{"account:read", "account:write"}
+	resp, body = call(http.MethodPost, "/auth/token", "", login, nil)
+	var created struct {
+		Token     string     `json:"token"`
+		Name      string     `json:"name"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal([]byte(body), &created); err != nil || resp.StatusCode != http.StatusCreated || !personalToken.MatchString(created.Token) || created.ExpiresAt == nil {
+		t.Fatalf("expected a token; got %v %v", resp.Status, body)
+	}
+	token := created.Token
+
+	resp, body = call(http.MethodGet, "/account", "", nil, nil)
+	expectError(resp, body, http.StatusUnauthorized, "unauthorized")
+	resp, body = call(http.MethodGet, "/account", token, nil, nil)
+	expectError(resp, body, http.StatusNotFound, "account_not_found")
+
+	resp, body = call(http.MethodPost, "/account", token, map[string]string{"username": "fo"}, nil)
+	if e := expectError(resp, body, http.StatusUnprocessableEntity, "validation_failed"); len(e.Error.Fields["username"]) == 0 {
+		t.Errorf("expected an error for username; got %v", e.Error.Fields)
+	}
+	resp, body = call(http.MethodPost, "/account", token, map[string]string{"username": "foobar"}, nil)
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(body, `"username":"foobar"`) {
+		t.Fatalf("expected the account to be set up; got %v %v", resp.Status, body)
+	}
+	resp, body = call(http.MethodPost, "/account", token, map[string]string{"username": "foobar"}, nil)
+	expectError(resp, body, http.StatusConflict, "account_exists")
+
+	resp, body = call(http.MethodPatch, "/account", token, map[string]string{"username": "scripted"}, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"username":"scripted"`) {
+		t.Fatalf("expected the username to be updated; got %v %v", resp.Status, body)
+	}
+	resp, body = call(http.MethodGet, "/account", token, nil, nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"username":"scripted"`) || !strings.Contains(body, `"role":"user"`) {
+		t.Errorf("expected the account; got %v %v", resp.Status, body)
+	}
+	app.db.mu.Lock()
+	audited := slices.ContainsFunc(app.db.auditEvents, func(e types.AuditEvent) bool {
+		return e.Action == types.AuditUsernameChanged && e.Metadata["to"] == "scripted"
+	})
+	app.db.mu.Unlock()
+	if !audited {
+		t.Errorf("expected the username change to be audited")
+	}
+
+	resp, body = call(http.MethodDelete, "/account", token, nil, nil)
+	expectError(resp, body, http.StatusMethodNotAllowed, "method_not_allowed")
+	resp, body = call(http.MethodGet, "/nope", token, nil, nil)
+	expectError(resp, body, http.StatusNotFound, "not_found")
+
+	t.Run("session cookie is ignored", func(t *testing.T) {
+		cookies := app.login(t, "foo@bar.com", "Secret#123")
+		resp, body := call(http.MethodGet, "/account", "", nil, cookies)
+		expectError(resp, body, http.StatusUnauthorized, "unauthorized")
+	})
+
+	t.Run("scopes", func(t *testing.T) {
+		login := map[string]any{"email": "foo@bar.com", "password": "Secret#123", "name": "exports", "scopes": []string{"exports"}}
+		_, body := call(http.MethodPost, "/auth/token", "", login, nil)
+		var created struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal([]byte(body), &created); err != nil {
+			t.Fatal(err)
+		}
+		exports := created.Token
+		resp, body := call(http.MethodGet, "/account", exports, nil, nil)
+		expectError(resp, body, http.StatusForbidden, "forbidden")
+		resp, body = call(http.MethodGet, "/auth/token", exports, nil, nil)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"name":"exports"`) || strings.Contains(body, exports) {
+			t.Errorf("expected the token without its secret; got %v %v", resp.Status, body)
+		}
+	})
+
+	t.Run("disabled account", func(t *testing.T) {
+		account, err := app.db.GetAccountByUserID(context.Background(), app.userID(t, "foo@bar.com"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := app.db.SetAccountDisabled(context.Background(), account.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		for _, method := range []string{http.MethodGet, http.MethodDelete} {
+			resp, body := call(method, "/auth/token", token, nil, nil)
+			expectError(resp, body, http.StatusForbidden, "account_disabled")
+		}
+		if err := app.db.SetAccountDisabled(context.Background(), account.ID, false); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	resp, _ = call(http.MethodDelete, "/auth/token", token, nil, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status No Content; got %v", resp.Status)
+	}
+	resp, body = call(http.MethodGet, "/account", token, nil, nil)
+	expectError(resp, body, http.StatusUnauthorized, "unauthorized")
+}
+
+func TestAPITokenSecondFactor(t *testing.T) {
+	t.Setenv("LOGIN_LOCKOUT_EMAIL_THRESHOLD", "3")
+	app := newTestApp(t)
+	devices := app.withAccount(t, "foo@bar.com", 1)
+	_, body := app.post(t, "/settings/2fa/setup", nil, devices[0])
+	match := totpSecret.FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("expected a secret; got %v", body)
+	}
+	code, _ := otptotp.GenerateCode(match[1], time.Now())
+	_, body = app.post(t, "/settings/2fa/confirm", url.Values{"code": {code}}, devices[0])
+	codes := recoveryCode.FindAllStringSubmatch(body, -1)
+	if len(codes) == 0 {
+		t.Fatalf("expected recovery codes; got %v", body)
+	}
+	userID := app.userID(t, "foo@bar.com")
+	deletion := types.AccountDeletion{UserID: uuid.MustParse(userID), Username: "foobar", DeleteAfter: time.Now().Add(time.Hour)}
+	if err := app.db.CreateAccountDeletion(context.Background(), &deletion); err != nil {
+		t.Fatal(err)
+	}
+
+	createToken := func(code string) (*http.Response, string) {
+		t.Helper()
+		b, err := json.Marshal(map[string]any{"email": "foo@bar.com", "password": "Secret#123", "code": code, "name": "cli", "scopes": []string{"account:read"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, app.URL+"/api/v1/auth/token", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return app.do(t, req, nil)
+	}
+
+	resp, body := createToken(codes[0][1])
+	if resp.StatusCode != http.StatusCreated || !personalToken.MatchString(body) {
+		t.Fatalf("expected a token with a recovery code; got %v %v", resp.Status, body)
+	}
+	app.db.mu.Lock()
+	cancelled := !app.db.deletions[0].CancelledAt.IsZero()
+	app.db.mu.Unlock()
+	if !cancelled {
+		t.Errorf("expected the login to cancel the account deletion")
+	}
+
+	// The password is right every time, it must not clear the failed codes.
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		resp, body := createToken("000000")
+		if resp.StatusCode != want {
+			t.Fatalf("expected attempt %d to answer %v; got %v %v", i+1, want, resp.Status, body)
+		}
+	}
+	resp, body = createToken(codes[1][1])
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(body, "too_many_attempts") {
+		t.Errorf("expected the email to stay locked out; got %v %v", resp.Status, body)
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestOpenAPI fails when the document of the API changes, review the diff
+// and rerun with -update to accept it.
+func TestOpenAPI(t *testing.T) {
+	app := newTestApp(t)
+	resp, body := app.get(t, "/api/openapi.json", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the OpenAPI document; got %v %v", resp.Status, body)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["openapi"] != "3.1.0" {
+		t.Errorf("expected OpenAPI 3.1.0; got %v", doc["openapi"])
+	}
+	got, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	golden := "testdata/openapi.json"
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the OpenAPI document differs from %v, rerun with -update if the change is intended; got\n%s", golden, got)
+	}
+
+	resp, body = app.get(t, "/api/docs", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `spec-url="/api/openapi.json"`) {
+		t.Errorf("expected the docs page; got %v %v", resp.Status, body)
 	}
 }
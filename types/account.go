@@ -7,8 +7,23 @@ import (
 )
 
 type Account struct {
-	ID        int `bun:"id,pk,autoincrement"`
-	UserID    uuid.UUID
-	Username  string
+	ID       int `bun:"id,pk,autoincrement"`
+	UserID   uuid.UUID
+	Username string
+	// Role names the row in roles granting the account its permissions.
+	Role      string    `bun:",nullzero,default:'user'"`
 	CreatedAt time.Time `bun:"default:'now()'"`
+	// DisabledAt is set while an admin has disabled the account.
+	DisabledAt time.Time `bun:",nullzero"`
+}
+
+func (a Account) Disabled() bool {
+	return !a.DisabledAt.IsZero()
+}
+
+// AccountSummary is an account as listed in the admin console, along with
+// the email of its user.
+type AccountSummary struct {
+	Account `bun:",extend"`
+	Email   string `bun:",scanonly"`
 }
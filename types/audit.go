@@ -0,0 +1,88 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AuditLoginSucceeded     = "login.success"
+	AuditLoginFailed        = "login.failure"
+	AuditReauthFailed       = "reauth.failure"
+	AuditLogout             = "logout"
+	AuditSignup             = "signup"
+	AuditAccountSetup       = "account.setup"
+	AuditPasswordChanged    = "password.change"
+	AuditUsernameChanged    = "username.change"
+	AuditImpersonationStart = "impersonation.start"
+	AuditImpersonationStop  = "impersonation.stop"
+	AuditAccountSecured     = "account.secure"
+	AuditTokenCreated       = "token.create"
+	AuditTokenRevoked       = "token.revoke"
+	AuditPasskeyAdded       = "passkey.add"
+	AuditPasskeyRemoved     = "passkey.remove"
+	// The purge of a deleted account has no actor, it runs in the
+	// background.
+	AuditAccountDeletionRequested = "deletion.request"
+	AuditAccountDeletionCancelled = "deletion.cancel"
+	AuditAccountDeletionPurged    = "deletion.purge"
+	// Admin actions on an account, the admin being the actor.
+	AuditAccountDisabled  = "account.disable"
+	AuditAccountEnabled   = "account.enable"
+	AuditAccountLoggedOut = "account.logout"
+	AuditUsernameReset    = "username.reset"
+	AuditPasswordReset    = "password.reset"
+)
+
+// AuditActions lists every action, in the order admins pick from.
+var AuditActions = []string{
+	AuditLoginSucceeded,
+	AuditLoginFailed,
+	AuditReauthFailed,
+	AuditLogout,
+	AuditSignup,
+	AuditAccountSetup,
+	AuditPasswordChanged,
+	AuditUsernameChanged,
+	AuditImpersonationStart,
+	AuditImpersonationStop,
+	AuditAccountSecured,
+	AuditTokenCreated,
+	AuditTokenRevoked,
+	AuditPasskeyAdded,
+	AuditPasskeyRemoved,
+	AuditAccountDeletionRequested,
+	AuditAccountDeletionCancelled,
+	AuditAccountDeletionPurged,
+	AuditAccountDisabled,
+	AuditAccountEnabled,
+	AuditAccountLoggedOut,
+	AuditUsernameReset,
+	AuditPasswordReset,
+}
+
+// AuditEvent records a security relevant action. ActorID is who acted and
+// UserID whose account it concerns, they differ when an admin acts on a
+// user. Failed logins have no user, their metadata holds the email tried.
+type AuditEvent struct {
+	ID        int `bun:"id,pk,autoincrement"`
+	Action    string
+	ActorID   uuid.UUID `bun:",nullzero"`
+	UserID    uuid.UUID `bun:",nullzero"`
+	IP        string
+	UserAgent string
+	TraceID   string
+	Metadata  map[string]string `bun:",type:jsonb"`
+	CreatedAt time.Time         `bun:"default:'now()'"`
+}
+
+// AuditFilter selects audit events, zero fields match everything.
+type AuditFilter struct {
+	Action string
+	UserID uuid.UUID
+	Since  time.Time
+	Until  time.Time
+	// BeforeID pages through the events, newest first.
+	BeforeID int
+}
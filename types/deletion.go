@@ -0,0 +1,24 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AccountDeletion is a request of a user to delete their account. It is
+// kept once the account is gone, as the record of the deletion.
+type AccountDeletion struct {
+	ID          int `bun:"id,pk,autoincrement"`
+	UserID      uuid.UUID
+	Username    string
+	RequestedAt time.Time `bun:"default:'now()'"`
+	DeleteAfter time.Time
+	CancelledAt time.Time `bun:",nullzero"`
+	DeletedAt   time.Time `bun:",nullzero"`
+}
+
+// Pending reports whether the deletion is neither cancelled nor done.
+func (d AccountDeletion) Pending() bool {
+	return d.CancelledAt.IsZero() && d.DeletedAt.IsZero()
+}
@@ -0,0 +1,20 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// KnownDevice is a browser and address an account logged in from. Only a
+// hash of them is kept, to tell new devices apart.
+type KnownDevice struct {
+	ID          int `bun:"id,pk,autoincrement"`
+	UserID      uuid.UUID
+	Fingerprint string
+	// RevokeToken is the SHA-256 of the token in the "this wasn't me" link
+	// of the new device alert.
+	RevokeToken string    `bun:",nullzero"`
+	CreatedAt   time.Time `bun:"default:'now()'"`
+	LastSeenAt  time.Time
+}
@@ -0,0 +1,28 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// DataExport is an archive of the data held about a user, built in the
+// background on request.
+type DataExport struct {
+	ID     int `bun:"id,pk,autoincrement"`
+	UserID uuid.UUID
+	// Token names the archive in download links, which only work for its
+	// owner until ExpiresAt.
+	Token     string
+	Status    string
+	Archive   []byte
+	CreatedAt time.Time `bun:"default:'now()'"`
+	ReadyAt   time.Time `bun:",nullzero"`
+	ExpiresAt time.Time
+}
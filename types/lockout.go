@@ -0,0 +1,28 @@
+package types
+
+import "time"
+
+// LoginAttempt counts the recent failed logins for a key, which is either
+// an email or an IP address.
+type LoginAttempt struct {
+	Key          string `bun:",pk"`
+	Failures     int
+	LastFailedAt time.Time
+	LockedUntil  time.Time `bun:",nullzero"`
+}
+
+// Locked reports whether logins for the key are refused at now.
+func (a LoginAttempt) Locked(now time.Time) bool {
+	return now.Before(a.LockedUntil)
+}
+
+// Lockout records a key being locked out, kept for admins to review.
+type Lockout struct {
+	ID          int `bun:"id,pk,autoincrement"`
+	Key         string
+	IP          string
+	Email       string
+	Failures    int
+	LockedUntil time.Time
+	CreatedAt   time.Time `bun:"default:'now()'"`
+}
@@ -0,0 +1,30 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type TOTPFactor struct {
+	UserID uuid.UUID `bun:",pk"`
+	Secret string
+	// LastUsedStep is the time step of the last accepted code, codes for it
+	// or earlier steps are rejected.
+	LastUsedStep int64
+	ConfirmedAt  time.Time `bun:",nullzero"`
+	CreatedAt    time.Time `bun:"default:'now()'"`
+}
+
+// Enabled reports whether the user confirmed the factor with a valid code.
+func (f TOTPFactor) Enabled() bool {
+	return !f.ConfirmedAt.IsZero()
+}
+
+type RecoveryCode struct {
+	ID        int `bun:"id,pk,autoincrement"`
+	UserID    uuid.UUID
+	CodeHash  string
+	UsedAt    time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:"default:'now()'"`
+}
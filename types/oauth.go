@@ -0,0 +1,11 @@
+package types
+
+// OAuthProvider is a third party identity provider users can log in with.
+type OAuthProvider struct {
+	// Name is the provider name as known to the auth backend, e.g. "github".
+	Name       string
+	Label      string
+	Icon       string
+	RedirectTo string
+	Scopes     []string
+}
@@ -0,0 +1,22 @@
+package types
+
+import "time"
+
+type Passkey struct {
+	ID              int `bun:"id,pk,autoincrement"`
+	AccountID       int
+	Name            string
+	CredentialID    []byte
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte   `bun:"aaguid"`
+	Transports      []string `bun:",array"`
+	SignCount       int64
+	// CloneWarning is set when the authenticator reported a sign count that
+	// did not go up, the passkey is not accepted anymore.
+	CloneWarning   bool
+	BackupEligible bool
+	BackupState    bool
+	CreatedAt      time.Time `bun:"default:'now()'"`
+	LastUsedAt     time.Time `bun:",nullzero"`
+}
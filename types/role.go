@@ -0,0 +1,44 @@
+package types
+
+import (
+	"slices"
+	"time"
+)
+
+// Permission is an action a role allows, named "area:action".
+type Permission string
+
+const (
+	PermissionAdminAccess Permission = "admin:access"
+	PermissionUsersRead   Permission = "users:read"
+	PermissionUsersManage Permission = "users:manage"
+	// PermissionUsersImpersonate lets support act as a user to see what
+	// they see.
+	PermissionUsersImpersonate Permission = "users:impersonate"
+	PermissionRolesManage      Permission = "roles:manage"
+	PermissionContentModerate  Permission = "content:moderate"
+	PermissionAuditRead        Permission = "audit:read"
+)
+
+// The built-in roles, seeded by the migration. Every account starts with
+// RoleUser.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// Role is a named set of permissions. Besides the built-in ones, custom
+// roles can be added to the roles table.
+type Role struct {
+	Name        string `bun:",pk"`
+	Description string
+	Permissions []Permission `bun:",array"`
+	BuiltIn     bool
+	CreatedAt   time.Time `bun:"default:'now()'"`
+}
+
+// Has reports whether the role allows p.
+func (r Role) Has(p Permission) bool {
+	return slices.Contains(r.Permissions, p)
+}
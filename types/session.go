@@ -0,0 +1,19 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Session struct {
+	// ID is the SHA-256 of the opaque session id kept in the cookie.
+	ID         string    `bun:"id,pk"`
+	UserID     uuid.UUID `bun:",nullzero"`
+	Data       []byte
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time `bun:"default:'now()'"`
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
@@ -0,0 +1,44 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TokenScope is what a personal access token may be used for.
+type TokenScope string
+
+const (
+	ScopeAccountRead  TokenScope = "account:read"
+	ScopeAccountWrite TokenScope = "account:write"
+	ScopeExports      TokenScope = "exports"
+)
+
+// TokenScopes lists every scope, in the order users pick from.
+var TokenScopes = []TokenScope{
+	ScopeAccountRead,
+	ScopeAccountWrite,
+	ScopeExports,
+}
+
+// PersonalAccessToken lets scripts act as the user without a browser
+// session. Only the SHA-256 of the token is kept, Prefix is enough of it
+// for the user to tell tokens apart.
+type PersonalAccessToken struct {
+	ID         int `bun:"id,pk,autoincrement"`
+	UserID     uuid.UUID
+	Name       string
+	TokenHash  string
+	Prefix     string
+	Scopes     []TokenScope `bun:",array"`
+	ExpiresAt  time.Time    `bun:",nullzero"`
+	LastUsedAt time.Time    `bun:",nullzero"`
+	CreatedAt  time.Time    `bun:"default:'now()'"`
+}
+
+// Expired reports whether the token expired, tokens without an expiry never
+// do.
+func (t PersonalAccessToken) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
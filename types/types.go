@@ -1,10 +1,35 @@
 package types
 
-import "github.com/google/uuid"
+import (
+	"slices"
+
+	"github.com/google/uuid"
+)
 
 const (
-	UserContextKey = "user"
-	AccessTokenKey = "accessToken"
+	UserContextKey  = "user"
+	AccessTokenKey  = "accessToken"
+	RefreshTokenKey = "refreshToken"
+	ExpiresAtKey    = "expiresAt"
+	CodeVerifierKey = "codeVerifier"
+	AuthStateKey    = "authState"
+	AuthNextKey     = "authNext"
+	CSRFTokenKey    = "csrfToken"
+	UserIDKey       = "userID"
+	// TwoFactorPendingKey holds a login waiting for its second factor.
+	TwoFactorPendingKey = "twoFactorPending"
+	// PasskeyRegistrationKey and PasskeyLoginKey hold the WebAuthn ceremony
+	// in progress.
+	PasskeyRegistrationKey = "passkeyRegistration"
+	PasskeyLoginKey        = "passkeyLogin"
+	// ReauthKey holds the confirmation by email standing in for the
+	// password before sensitive changes.
+	ReauthKey = "reauth"
+	// ImpersonationKey holds the admin login set aside while impersonating.
+	ImpersonationKey = "impersonation"
+	// TokenScopeKey marks requests to routes personal access tokens may
+	// call.
+	TokenScopeKey = "tokenScope"
 )
 
 type AuthenticatedUser struct {
@@ -12,4 +37,34 @@ type AuthenticatedUser struct {
 	ID         uuid.UUID
 	Email      string
 	IsLoggedIn bool
+	// EmailConfirmed is false until the user opens the confirmation link
+	// mailed on signup.
+	EmailConfirmed bool
+	// Permissions are those of the account role, they are loaded along with
+	// the account.
+	Permissions []Permission
+	// Impersonator is the email of the admin acting as the user, empty
+	// unless impersonating.
+	Impersonator string
+	// TokenID is the personal access token the request authenticated with,
+	// zero for browser sessions. Scopes are what the token allows.
+	TokenID int
+	Scopes  []TokenScope
+}
+
+// ViaToken reports whether the user authenticated with a personal access
+// token rather than a browser session.
+func (u AuthenticatedUser) ViaToken() bool {
+	return u.TokenID > 0
+}
+
+// Can reports whether the user has every one of perms.
+func (u AuthenticatedUser) Can(perms ...Permission) bool {
+	for _, p := range perms {
+		if !slices.Contains(u.Permissions, p) {
+			return false
+		}
+	}
+
+	return true
 }